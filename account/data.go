@@ -0,0 +1,161 @@
+package account
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"shop/handlers"
+	"shop/handlers/render"
+	"shop/services/auth"
+	"shop/services/store"
+	"shop/views/account"
+	"time"
+)
+
+func Data(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/login")
+		return err
+	}
+	mfa, err := auth.HasMFA(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	countCart, err := store.Pub.CartCountItems(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	return render.Template(w, r, account.Data(user, countCart, mfa))
+}
+
+// ExportData downloads everything the shop keeps of the user as json files
+// in a zip, it is built in memory so a failed query doesnt send half of it.
+func ExportData(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/login")
+		return err
+	}
+	files, err := exportFiles(r, user)
+	if err != nil {
+		return err
+	}
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, file := range files {
+		f, err := zw.Create(file.name)
+		if err != nil {
+			return err
+		}
+		content, err := json.MarshalIndent(file.data, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(content)
+		if err != nil {
+			return err
+		}
+	}
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"my-data-%s.zip\"", time.Now().Format("2006-01-02")))
+	w.Header().Set("Cache-Control", "no-store")
+	_, err = w.Write(archive.Bytes())
+	return err
+}
+
+type exportFile struct {
+	name string
+	data any
+}
+
+func exportFiles(r *http.Request, user store.User) ([]exportFile, error) {
+	ctx := r.Context()
+	addresses, err := store.Pub.GetAddresses(ctx, user.Id)
+	if err != nil {
+		return nil, err
+	}
+	cart, err := store.Pub.GetCart(ctx, user.Id)
+	if err != nil {
+		return nil, err
+	}
+	favorites, err := store.Pub.GetFavorites(ctx, user.Id)
+	if err != nil {
+		return nil, err
+	}
+	summaries, err := store.Pub.GetOrders(ctx, user.Id)
+	if err != nil {
+		return nil, err
+	}
+	orders := make([]store.OrderDetail, 0, len(summaries))
+	for _, summary := range summaries {
+		order, err := store.Pub.GetOrder(ctx, summary.Id)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	sessions, err := store.Pub.GetSessions(ctx, user.Id)
+	if err != nil {
+		return nil, err
+	}
+	return []exportFile{
+		{"profile.json", user},
+		{"addresses.json", addresses},
+		{"cart.json", cart},
+		{"favorites.json", favorites},
+		{"orders.json", orders},
+		{"devices.json", sessions},
+	}, nil
+}
+
+// DeleteAccount removes the account after typing delete, users with two
+// factor on confirm it with a code too.
+func DeleteAccount(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/login")
+		return err
+	}
+	err = r.ParseForm()
+	if err != nil {
+		return handlers.UserError(err)
+	}
+	mfa, err := auth.HasMFA(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	if r.PostForm.Get("confirm") != "delete" {
+		err = errors.New("type delete to confirm")
+		render.Template(w, r, account.DeleteForm(mfa, err.Error()))
+		return handlers.UserError(err)
+	}
+	if mfa {
+		err = auth.StepUp(r, r.PostForm.Get("code"))
+		if err == auth.ErrStepUpRequired || err == auth.ErrInvalidCode {
+			render.Template(w, r, account.DeleteForm(mfa, err.Error()))
+			return handlers.UserError(err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = auth.DeleteUser(w, r, handlers.ProviderService(user), user)
+	if errors.Is(err, store.ErrDeleteLastOwner) {
+		err = errors.New("the shop needs at least one owner, grant it to someone else first")
+		render.Template(w, r, account.DeleteForm(mfa, err.Error()))
+		return handlers.UserError(err)
+	}
+	if err != nil {
+		return err
+	}
+	handlers.Redirect(w, r, "/")
+	return nil
+}
@@ -0,0 +1,196 @@
+package account
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"shop/config"
+	"shop/handlers"
+	"shop/handlers/render"
+	"shop/services/auth"
+	"shop/services/auth/authMagicLink"
+	"shop/services/logs"
+	"shop/services/notify"
+	"shop/services/store"
+	"shop/views/account"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// emailChangeTTL is how long the link sent to a new email works, it goes to
+// an inbox the user may not check right away.
+const emailChangeTTL = 24 * time.Hour
+
+var ErrInvalidEmailChange = errors.New("the link was used, expired or is of another account")
+
+func Profile(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/login")
+		return err
+	}
+	addresses, err := store.Pub.GetAddresses(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	favorites, err := store.Pub.GetFavorites(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	mfa, err := auth.HasMFA(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	countCart, err := store.Pub.CartCountItems(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	page := account.ProfilePage{Addresses: addresses, Favorites: favorites, MFA: mfa}
+	return render.Template(w, r, account.Profile(user, countCart, page))
+}
+
+// UpdateProfile saves the preferences and reloads the page, the language
+// and currency change how every page renders.
+func UpdateProfile(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/login")
+		return err
+	}
+	err = r.ParseForm()
+	if err != nil {
+		return handlers.UserError(err)
+	}
+	currency, err := store.ToCurrency(r.PostForm.Get("currency"))
+	if err != nil {
+		render.Template(w, r, account.ProfileForm(user, err.Error()))
+		return handlers.UserError(err)
+	}
+	profile := store.Profile{
+		Name:      r.PostForm.Get("name"),
+		AvatarUrl: r.PostForm.Get("avatar-url"),
+		Locale:    r.PostForm.Get("locale"),
+		Currency:  currency,
+	}
+	if err := profile.Valid(); err != nil {
+		render.Template(w, r, account.ProfileForm(user, err.Error()))
+		return handlers.UserError(err)
+	}
+	err = store.Pub.UpdateProfile(r.Context(), user.Id, profile)
+	if err != nil {
+		return err
+	}
+	handlers.Redirect(w, r, "/account")
+	return nil
+}
+
+// ChangeEmail mails a link to the new email, the account keeps the current
+// one until the link is opened while logged in.
+func ChangeEmail(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/login")
+		return err
+	}
+	err = r.ParseForm()
+	if err != nil {
+		return handlers.UserError(err)
+	}
+	mfa, err := auth.HasMFA(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	email, err := authMagicLink.NormalizeEmail(r.PostForm.Get("email"))
+	if err == nil && len(email) > 50 {
+		err = errors.New("the email cant be longer than 50 characters")
+	}
+	if err == nil && email == user.Email {
+		err = errors.New("you already use that email")
+	}
+	if err != nil {
+		render.Template(w, r, account.EmailForm(user.Email, mfa, err.Error()))
+		return handlers.UserError(err)
+	}
+	if mfa {
+		err = auth.StepUp(r, r.PostForm.Get("code"))
+		if err == auth.ErrStepUpRequired || err == auth.ErrInvalidCode {
+			render.Template(w, r, account.EmailForm(user.Email, mfa, err.Error()))
+			return handlers.UserError(err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	token := make([]byte, 32)
+	_, err = rand.Read(token)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(token)
+	err = store.Pub.RequestEmailChange(r.Context(), user.Id, email, hash[:], emailChangeTTL)
+	if err == store.ErrEmailInUse {
+		err = errors.New("another account uses that email")
+		render.Template(w, r, account.EmailForm(user.Email, mfa, err.Error()))
+		return handlers.UserError(err)
+	}
+	if err != nil {
+		return err
+	}
+	link := config.Envs.PublicURL + account.ConfirmEmailUrl() + "?token=" + base64.RawURLEncoding.EncodeToString(token)
+	err = notify.ConfirmEmail(r.Context(), email, link, emailChangeTTL)
+	if err != nil {
+		return err
+	}
+	return render.Template(w, r, account.EmailForm(user.Email, mfa, fmt.Sprintf("we sent a link to %s, open it to confirm", email)))
+}
+
+// ConfirmEmailPage asks for a click before spending the link, mail scanners
+// open links but dont submit forms.
+func ConfirmEmailPage(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/login")
+		return err
+	}
+	token := r.URL.Query().Get("token")
+	if len(token) <= 0 {
+		return handlers.UserError(errors.New("the email link has no token"))
+	}
+	return render.Template(w, r, account.ConfirmEmail(user, token))
+}
+
+func ConfirmEmail(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/login")
+		return err
+	}
+	err = r.ParseForm()
+	if err != nil {
+		return handlers.UserError(err)
+	}
+	token, err := base64.RawURLEncoding.DecodeString(r.PostForm.Get("token"))
+	if err != nil || len(token) <= 0 {
+		return handlers.UserError(ErrInvalidEmailChange)
+	}
+	hash := sha256.Sum256(token)
+	oldEmail, newEmail, err := store.Pub.ConfirmEmailChange(r.Context(), user.Id, hash[:])
+	if err == pgx.ErrNoRows {
+		return handlers.UserError(ErrInvalidEmailChange)
+	}
+	if err == store.ErrEmailInUse {
+		return handlers.UserError(errors.New("another account uses that email"))
+	}
+	if err != nil {
+		return err
+	}
+	if err := notify.EmailChanged(r.Context(), oldEmail, newEmail); err != nil {
+		logs.FromContext(r.Context()).Error("couldnt tell the old email about the change", "err", err, "user", user.Id)
+	}
+	handlers.Redirect(w, r, "/account")
+	return nil
+}
@@ -0,0 +1,78 @@
+package account
+
+import (
+	"net/http"
+	"shop/handlers"
+	"shop/handlers/render"
+	"shop/services/auth"
+	"shop/services/store"
+	"shop/views/account"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func Sessions(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/login")
+		return err
+	}
+	currentId, err := auth.CurrentSessionId(r)
+	if err != nil {
+		return err
+	}
+	sessions, err := store.Pub.GetSessions(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	countCart, err := store.Pub.CartCountItems(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	return render.Template(w, r, account.Sessions(user, countCart, sessions, currentId))
+}
+
+func RevokeSession(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/login")
+		return err
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return handlers.NotFound(err)
+	}
+	err = store.Pub.RevokeSession(r.Context(), user.Id, id)
+	if err != nil {
+		return err
+	}
+	currentId, err := auth.CurrentSessionId(r)
+	if err != nil {
+		return err
+	}
+	sessions, err := store.Pub.GetSessions(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	return render.Template(w, r, account.SessionList(sessions, currentId))
+}
+
+// RevokeAllSessions logs the user out of every device, this one included.
+func RevokeAllSessions(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/login")
+		return err
+	}
+	_, err = store.Pub.RevokeSessions(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	err = auth.RemoveUserSession(w, r)
+	if err != nil {
+		return err
+	}
+	handlers.Redirect(w, r, "/login")
+	return nil
+}
@@ -0,0 +1,178 @@
+package account
+
+import (
+	"errors"
+	"net/http"
+	"shop/handlers"
+	"shop/handlers/render"
+	"shop/services/auth"
+	"shop/services/store"
+	"shop/services/totp"
+	"shop/views/account"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/pquerna/otp"
+)
+
+// TwoFactor shows the state of the second factor, while it is off the page
+// shows the secret waiting to be confirmed.
+func TwoFactor(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/login")
+		return err
+	}
+	t, err := store.Pub.GetTOTP(r.Context(), user.Id)
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+	countCart, err := store.Pub.CartCountItems(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	if t.Enabled {
+		return render.Template(w, r, account.TwoFactor(user, countCart, t, account.Enrollment{}))
+	}
+	key, err := enrollmentKey(r, user, t)
+	if err != nil {
+		return err
+	}
+	qrCode, err := totp.QRCode(key)
+	if err != nil {
+		return err
+	}
+	staff, err := auth.IsStaff(r.Context(), user)
+	if err != nil {
+		return err
+	}
+	enrollment := account.Enrollment{Secret: key.Secret(), QRCode: qrCode, Required: staff}
+	return render.Template(w, r, account.TwoFactor(user, countCart, t, enrollment))
+}
+
+// enrollmentKey reuses the secret waiting to be confirmed, a new one is only
+// stored the first time so reloading the page doesnt swap the secret under
+// an app that already scanned it.
+func enrollmentKey(r *http.Request, user store.User, t store.TOTP) (*otp.Key, error) {
+	if len(t.Secret) > 0 {
+		return totp.PendingKey(user.Email, t.Secret)
+	}
+	key, err := totp.NewKey(user.Email)
+	if err != nil {
+		return nil, err
+	}
+	err = store.Pub.EnrollTOTP(r.Context(), user.Id, key.Secret())
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// EnableTwoFactor turns the enrolled secret on once a code of it checks out,
+// the recovery codes are shown this time only.
+func EnableTwoFactor(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/login")
+		return err
+	}
+	err = r.ParseForm()
+	if err != nil {
+		return handlers.UserError(err)
+	}
+	t, err := store.Pub.GetTOTP(r.Context(), user.Id)
+	if err == pgx.ErrNoRows || t.Enabled {
+		handlers.Redirect(w, r, "/account/2fa")
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	step, ok := totp.Match(t.Secret, r.PostForm.Get("code"), time.Now())
+	if !ok {
+		render.Template(w, r, account.EnableForm(auth.ErrInvalidCode.Error()))
+		return handlers.UserError(auth.ErrInvalidCode)
+	}
+	codes, hashes, err := totp.RecoveryCodes()
+	if err != nil {
+		return err
+	}
+	err = store.Pub.EnableTOTP(r.Context(), user.Id, step, hashes)
+	if err != nil {
+		return err
+	}
+	sessionId, err := auth.CurrentSessionId(r)
+	if err != nil {
+		return err
+	}
+	err = store.Pub.VerifySessionMFA(r.Context(), sessionId)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("HX-Retarget", "#two-factor")
+	return render.Template(w, r, account.RecoveryCodes(codes))
+}
+
+func RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/login")
+		return err
+	}
+	err = r.ParseForm()
+	if err != nil {
+		return handlers.UserError(err)
+	}
+	err = auth.StepUp(r, r.PostForm.Get("code"))
+	if err == auth.ErrStepUpRequired || err == auth.ErrInvalidCode {
+		render.Template(w, r, account.CodeForm(account.RecoveryCodesUrl(), "new recovery codes", err.Error()))
+		return handlers.UserError(err)
+	}
+	if err != nil {
+		return err
+	}
+	codes, hashes, err := totp.RecoveryCodes()
+	if err != nil {
+		return err
+	}
+	err = store.Pub.ReplaceRecoveryCodes(r.Context(), user.Id, hashes)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("HX-Retarget", "#two-factor")
+	return render.Template(w, r, account.RecoveryCodes(codes))
+}
+
+// DisableTwoFactor always asks for a fresh code, staff cant turn it off.
+func DisableTwoFactor(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/login")
+		return err
+	}
+	staff, err := auth.IsStaff(r.Context(), user)
+	if err != nil {
+		return err
+	}
+	if staff {
+		return handlers.UserError(errors.New("admin accounts must keep two factor authentication on"))
+	}
+	err = r.ParseForm()
+	if err != nil {
+		return handlers.UserError(err)
+	}
+	err = auth.VerifyCode(r.Context(), user.Id, r.PostForm.Get("code"))
+	if err == auth.ErrInvalidCode {
+		render.Template(w, r, account.CodeForm(account.DisableTwoFactorUrl(), "turn off", err.Error()))
+		return handlers.UserError(err)
+	}
+	if err != nil {
+		return err
+	}
+	err = store.Pub.DisableTOTP(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	handlers.Redirect(w, r, "/account/2fa")
+	return nil
+}
@@ -0,0 +1,51 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"shop/handlers"
+	"shop/handlers/render"
+	"shop/services/auth"
+	"shop/services/store"
+	"shop/views/admin"
+)
+
+func LoginPage(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/login")
+		return err
+	}
+	return render.Template(w, r, admin.Login(user))
+}
+
+// Login promotes the logged user session to an admin one when the user has
+// a role, admins need two factor on and the new session waits for a code.
+func Login(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/login")
+		return err
+	}
+	permissions, err := store.Pub.GetPermissions(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	if len(permissions) <= 0 {
+		return handlers.Forbidden(errors.New("user has no role"))
+	}
+	err = auth.SetUserSession(w, r, store.Admin(user))
+	if err == auth.ErrMFANotEnabled {
+		handlers.Redirect(w, r, "/account/2fa")
+		return err
+	}
+	if err == auth.ErrMFARequired {
+		handlers.Redirect(w, r, "/login/2fa")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	handlers.Redirect(w, r, handlers.AdminLanding(permissions))
+	return nil
+}
@@ -0,0 +1,192 @@
+package admin
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"shop/handlers"
+	"shop/handlers/render"
+	"shop/services/auth"
+	"shop/services/notify"
+	"shop/services/store"
+	"shop/views/admin"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func Orders(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetAdminSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/admin/login")
+		return err
+	}
+	orders, err := store.Pub.GetOpenOrders(r.Context(), 50)
+	if err != nil {
+		return err
+	}
+	return render.Template(w, r, admin.Orders(user, orders))
+}
+
+func Order(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetAdminSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/admin/login")
+		return err
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return handlers.NotFound(err)
+	}
+	order, err := store.Pub.GetOrder(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	return render.Template(w, r, admin.Order(user, order))
+}
+
+func PackOrder(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetAdminSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/admin/login")
+		return err
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return handlers.NotFound(err)
+	}
+	err = store.Pub.PackOrder(r.Context(), id, user.Actor())
+	return renderDetail(w, r, id, err)
+}
+
+func CreateShipment(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetAdminSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/admin/login")
+		return err
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return handlers.NotFound(err)
+	}
+	err = r.ParseForm()
+	if err != nil {
+		return handlers.UserError(err)
+	}
+	skus := r.PostForm["sku"]
+	quantities := r.PostForm["quantity"]
+	if len(skus) != len(quantities) {
+		return renderDetail(w, r, id, errors.New("skus and quantities from the shipment form dont match"))
+	}
+	items := make([]store.OrderItems, 0, len(skus))
+	for i, sku := range skus {
+		quantity, err := strconv.Atoi(quantities[i])
+		if err != nil {
+			return renderDetail(w, r, id, err)
+		}
+		if quantity <= 0 {
+			continue
+		}
+		items = append(items, store.OrderItems{Sku: store.Sku(sku), Quantity: quantity})
+	}
+	if len(items) <= 0 {
+		return renderDetail(w, r, id, errors.New("select at least one item to ship"))
+	}
+	shipmentId, err := store.Pub.CreateShipment(r.Context(), id, user.Actor(), r.PostForm.Get("carrier"), r.PostForm.Get("tracking_number"), items)
+	if err != nil {
+		return renderDetail(w, r, id, err)
+	}
+	order, err := store.Pub.GetOrder(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	for _, shipment := range order.Shipments {
+		if shipment.Id != shipmentId {
+			continue
+		}
+		if err := notify.OrderShipped(r.Context(), order, shipment); err != nil {
+			log.Printf("couldnt notify shipment %d of order %d: %v", shipmentId, id, err)
+		}
+	}
+	return render.Template(w, r, admin.OrderDetail(order, ""))
+}
+
+func DeliverShipment(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetAdminSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/admin/login")
+		return err
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return handlers.NotFound(err)
+	}
+	shipmentId, err := strconv.Atoi(chi.URLParam(r, "shipment"))
+	if err != nil {
+		return handlers.NotFound(err)
+	}
+	err = store.Pub.DeliverShipment(r.Context(), id, shipmentId, user.Actor())
+	return renderDetail(w, r, id, err)
+}
+
+func UpdatePaymentStatus(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetAdminSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/admin/login")
+		return err
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return handlers.NotFound(err)
+	}
+	err = r.ParseForm()
+	if err != nil {
+		return handlers.UserError(err)
+	}
+	order, err := store.Pub.GetOrder(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	status, err := store.ToOrderStatus(r.PostForm.Get("status"))
+	if err != nil {
+		return renderDetail(w, r, id, err)
+	}
+	reason := r.PostForm.Get("reason")
+	if len(reason) <= 0 {
+		return renderDetail(w, r, id, errors.New("a reason is needed to change the payment status"))
+	}
+	err = auth.StepUp(r, r.PostForm.Get("code"))
+	if err != nil {
+		return renderDetail(w, r, id, err)
+	}
+	to := store.OrderState{Status: status, Fulfillment: order.Status}
+	err = store.Pub.TransitionOrder(r.Context(), id, to, user.Actor(), reason)
+	if err != nil {
+		return renderDetail(w, r, id, err)
+	}
+	order, err = store.Pub.GetOrder(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if status == store.Refunded || status == store.PartiallyRefunded {
+		if err := notify.OrderRefunded(r.Context(), order, reason); err != nil {
+			log.Printf("couldnt notify refund of order %d: %v", id, err)
+		}
+	}
+	return render.Template(w, r, admin.OrderDetail(order, ""))
+}
+
+// renderDetail renders the order detail again, showing the failed action error
+// when there is one.
+func renderDetail(w http.ResponseWriter, r *http.Request, id int, actionErr error) error {
+	order, err := store.Pub.GetOrder(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if actionErr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		render.Template(w, r, admin.OrderDetail(order, actionErr.Error()))
+		return actionErr
+	}
+	return render.Template(w, r, admin.OrderDetail(order, ""))
+}
@@ -0,0 +1,121 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"shop/handlers"
+	"shop/handlers/render"
+	"shop/services/auth"
+	"shop/services/store"
+	"shop/views/admin"
+	"strconv"
+)
+
+func Roles(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetAdminSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/admin/login")
+		return err
+	}
+	page, err := rolesPage(r)
+	if err != nil {
+		return err
+	}
+	return render.Template(w, r, admin.Roles(user, page))
+}
+
+// GrantRole gives a role to the user of the email, role changes ask for a
+// recent second factor like refunds do.
+func GrantRole(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetAdminSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/admin/login")
+		return err
+	}
+	err = r.ParseForm()
+	if err != nil {
+		return handlers.UserError(err)
+	}
+	err = auth.StepUp(r, r.PostForm.Get("code"))
+	if err != nil {
+		return renderRoles(w, r, err)
+	}
+	err = store.Pub.GrantRole(r.Context(), r.PostForm.Get("email"), r.PostForm.Get("role"), user.Actor())
+	return renderRoles(w, r, err)
+}
+
+func RevokeRole(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetAdminSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/admin/login")
+		return err
+	}
+	err = r.ParseForm()
+	if err != nil {
+		return handlers.UserError(err)
+	}
+	userId, err := strconv.Atoi(r.PostForm.Get("user-id"))
+	if err != nil {
+		return handlers.UserError(err)
+	}
+	err = auth.StepUp(r, r.PostForm.Get("code"))
+	if err != nil {
+		return renderRoles(w, r, err)
+	}
+	err = store.Pub.RevokeRole(r.Context(), userId, r.PostForm.Get("role"), user.Actor())
+	return renderRoles(w, r, err)
+}
+
+func rolesPage(r *http.Request) (admin.RolesPage, error) {
+	roles, err := store.Pub.GetRoles(r.Context())
+	if err != nil {
+		return admin.RolesPage{}, err
+	}
+	staff, err := store.Pub.GetStaff(r.Context())
+	if err != nil {
+		return admin.RolesPage{}, err
+	}
+	events, err := store.Pub.GetRoleEvents(r.Context(), 50)
+	if err != nil {
+		return admin.RolesPage{}, err
+	}
+	return admin.RolesPage{Roles: roles, Staff: staff, Events: events}, nil
+}
+
+// renderRoles renders the roles section again, showing the failed action
+// error when the admin can do something about it. Any other error is
+// returned as is for the middleware to answer.
+func renderRoles(w http.ResponseWriter, r *http.Request, actionErr error) error {
+	message, known := roleErrMessage(actionErr)
+	if actionErr != nil && !known {
+		return actionErr
+	}
+	page, err := rolesPage(r)
+	if err != nil {
+		return err
+	}
+	if actionErr != nil {
+		page.Err = message
+		w.WriteHeader(http.StatusBadRequest)
+		render.Template(w, r, admin.RolesSection(page))
+		return actionErr
+	}
+	return render.Template(w, r, admin.RolesSection(page))
+}
+
+func roleErrMessage(err error) (string, bool) {
+	switch {
+	case errors.Is(err, store.ErrRoleUserNotFound):
+		return "no user with that email, they need to log in once first", true
+	case errors.Is(err, store.ErrLastOwner):
+		return "the shop needs at least one owner, grant it to someone else first", true
+	case errors.Is(err, store.ErrRoleNotFound):
+		return "that role doesnt exist", true
+	case errors.Is(err, store.ErrRoleNotGranted):
+		return "the user doesnt have that role", true
+	case errors.Is(err, auth.ErrStepUpRequired), errors.Is(err, auth.ErrInvalidCode):
+		return err.Error(), true
+	default:
+		return "", false
+	}
+}
@@ -1,12 +1,12 @@
 package cart
 
 import (
-	"context"
 	"errors"
 	"net/http"
 	"shop/handlers"
 	"shop/handlers/render"
 	"shop/services/auth"
+	"shop/services/metrics"
 	"shop/services/store"
 	viewCart "shop/views/cart"
 	"shop/views/component"
@@ -19,17 +19,30 @@ func Page(w http.ResponseWriter, r *http.Request) error {
 		handlers.Redirect(w, r, "/login")
 		return errors.New("needs user for the cart page")
 	}
-	cartItems, err := store.Pub.GetCart(context.Background(), user.Id)
+	cartItems, err := store.Pub.GetCart(r.Context(), user.Id)
 	if err != nil {
-		handlers.Redirect(w, r, "/oops")
 		return err
 	}
-	countCart, cartBalance, err := store.Pub.CartCountItemsWithTotal(context.Background(), user.Id)
+	countCart, cartBalance, err := store.Pub.CartCountItemsWithTotal(r.Context(), user.Id)
 	if err != nil {
-		handlers.Redirect(w, r, "/oops")
 		return err
 	}
-	return render.Template(w, r, viewCart.Index(user, countCart, cartBalance, cartItems))
+	taxes := []store.LineTax{}
+	if len(cartItems) > 0 {
+		addresses, err := store.Pub.GetAddresses(r.Context(), user.Id)
+		if err != nil {
+			return err
+		}
+		var address store.Address
+		if len(addresses) > 0 {
+			address = addresses[0].Address
+		}
+		taxes, err = store.Pub.LineTaxes(r.Context(), store.ToOrderItems(cartItems...), address)
+		if err != nil {
+			return err
+		}
+	}
+	return render.Template(w, r, viewCart.Index(user, countCart, cartBalance, cartItems, taxes))
 }
 
 func AddToCart(w http.ResponseWriter, r *http.Request) error {
@@ -38,26 +51,31 @@ func AddToCart(w http.ResponseWriter, r *http.Request) error {
 		handlers.Redirect(w, r, "/login")
 		return errors.New("needs user for adding to the cart")
 	}
-	params := r.URL.Query()
+	err = r.ParseForm()
+	if err != nil {
+		return handlers.UserError(err)
+	}
+	params := r.Form
 	sku := store.Sku(params.Get("sku"))
 	if len(sku) <= 0 {
 		render.Template(w, r, component.ErrorModalCart("An error occurred", errors.New("App error")))
-		return errors.New("need sku which is not present in params")
+		return handlers.UserError(errors.New("need sku which is not present in params"))
 	}
 	quantity, err := strconv.Atoi(params.Get("quantity"))
 	if err != nil {
 		render.Template(w, r, component.ErrorModalCart("An error occurred", errors.New("App error")))
 		return err
 	}
-	cartItemQuantity, err := store.Pub.AddToCart(context.Background(), user.Id, sku, quantity)
+	cartItemQuantity, err := store.Pub.AddToCart(r.Context(), user.Id, sku, quantity)
 	if err == store.ErrNoStock {
-		render.Template(w, r, component.ErrorModalCart("Not enough stock", errors.New("Can't add more of this product to the cart, because there is not enough stock")))
+		render.Template(w, r, component.ErrorModalNoStock(sku, false))
 		return err
 	}
 	if err != nil {
 		render.Template(w, r, component.ErrorModalCart("An error occurred", errors.New("App error")))
 		return err
 	}
+	metrics.CartAdds.Inc()
 	return render.Template(w, r, component.AddToCart(cartItemQuantity))
 }
 
@@ -67,20 +85,22 @@ func UpdateProductCount(w http.ResponseWriter, r *http.Request) error {
 		handlers.Redirect(w, r, "/login")
 		return errors.New("needs user for adding to the cart")
 	}
-	params := r.URL.Query()
+	err = r.ParseForm()
+	if err != nil {
+		return handlers.UserError(err)
+	}
+	params := r.Form
 	sku := store.Sku(params.Get("sku"))
 	if len(sku) <= 0 {
-		handlers.Redirect(w, r, "/oops")
-		return errors.New("need sku which is not present in params")
+		return handlers.UserError(errors.New("need sku which is not present in params"))
 	}
 	quantity, err := strconv.Atoi(params.Get("quantity"))
 	if err != nil {
 		render.Template(w, r, component.ErrorModalCart("An error occurred", errors.New("App error")))
 		return err
 	}
-	cartCount, err := store.Pub.UpdateCartCount(context.Background(), user.Id, sku, quantity)
+	cartCount, err := store.Pub.UpdateCartCount(r.Context(), user.Id, sku, quantity)
 	if err != nil {
-		handlers.Redirect(w, r, "/oops")
 		return err
 	}
 	return render.Template(w, r, component.UpdateCartPage(
@@ -102,9 +122,9 @@ func RemoveProduct(w http.ResponseWriter, r *http.Request) error {
 	sku := store.Sku(params.Get("sku"))
 	if len(sku) <= 0 {
 		render.Template(w, r, component.ErrorModalCart("An error occurred", errors.New("App error")))
-		return errors.New("need sku which is not present in params")
+		return handlers.UserError(errors.New("need sku which is not present in params"))
 	}
-	cartCount, err := store.Pub.RemoveProductFromCart(context.Background(), user.Id, sku)
+	cartCount, err := store.Pub.RemoveProductFromCart(r.Context(), user.Id, sku)
 	if err != nil {
 		render.Template(w, r, component.ErrorModalCart("An error occurred", errors.New("App error")))
 		return err
@@ -0,0 +1,77 @@
+package checkout
+
+import (
+	"errors"
+	"net/http"
+	"shop/handlers"
+	"shop/handlers/render"
+	"shop/services/auth"
+	"shop/services/store"
+	"shop/views/checkout"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func SaveAddress(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/login")
+		return err
+	}
+	err = r.ParseForm()
+	if err != nil {
+		return handlers.UserError(err)
+	}
+	address := store.Address{
+		FullName:     strings.TrimSpace(r.PostForm.Get("full_name")),
+		AddressLine1: strings.TrimSpace(r.PostForm.Get("address_line_1")),
+		AddressLine2: strings.TrimSpace(r.PostForm.Get("address_line_2")),
+		AdminArea2:   strings.TrimSpace(r.PostForm.Get("admin_area_2")),
+		AdminArea1:   strings.TrimSpace(r.PostForm.Get("admin_area_1")),
+		PostalCode:   strings.TrimSpace(r.PostForm.Get("postal_code")),
+		CountryCode:  strings.ToUpper(strings.TrimSpace(r.PostForm.Get("country_code"))),
+	}
+	isDefault := r.PostForm.Get("is_default") == "true"
+	if err := address.Valid(); err != nil {
+		addresses, errAddresses := store.Pub.GetAddresses(r.Context(), user.Id)
+		if errAddresses != nil {
+			return errors.Join(err, errAddresses)
+		}
+		return render.Template(w, r, checkout.Addresses(addresses, checkout.DefaultAddressId(addresses), err.Error()))
+	}
+	id, err := store.Pub.SaveAddress(r.Context(), user.Id, address, isDefault)
+	if err != nil {
+		return err
+	}
+	addresses, err := store.Pub.GetAddresses(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("HX-Trigger", checkout.AddressChangedEvent)
+	return render.Template(w, r, checkout.Addresses(addresses, id, ""))
+}
+
+func DeleteAddress(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/login")
+		return err
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return err
+	}
+	err = store.Pub.DeleteAddress(r.Context(), user.Id, id)
+	if err != nil {
+		return err
+	}
+	addresses, err := store.Pub.GetAddresses(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("HX-Trigger", checkout.AddressChangedEvent)
+	return render.Template(w, r, checkout.Addresses(addresses, checkout.DefaultAddressId(addresses), ""))
+}
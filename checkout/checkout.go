@@ -22,17 +22,23 @@ func PaymentPageCart(w http.ResponseWriter, r *http.Request) error {
 		handlers.Redirect(w, r, "/login")
 		return err
 	}
-	cartItems, err := store.Pub.GetCart(context.Background(), user.Id)
+	cartItems, err := store.Pub.GetCart(r.Context(), user.Id)
 	if err != pgx.ErrNoRows && err != nil {
-		handlers.Redirect(w, r, "/oops")
 		return err
 	}
-	countCart, cartTotal, err := store.Pub.CartCountItemsWithTotal(context.Background(), user.Id)
+	countCart, err := store.Pub.CartCountItems(r.Context(), user.Id)
 	if err != nil {
-		handlers.Redirect(w, r, "/oops")
 		return err
 	}
-	return render.Template(w, r, checkout.Index(user, countCart, cartTotal, true, cartItems...))
+	addresses, err := store.Pub.GetAddresses(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	quote, options, err := quoteCheckout(r.Context(), user.Id, "", defaultAddress(addresses), 0, cartItems...)
+	if err != nil {
+		return err
+	}
+	return render.Template(w, r, checkout.Index(user, countCart, quote, options, addresses, true, cartItems...))
 }
 
 func PaymentPageBuyNow(w http.ResponseWriter, r *http.Request) error {
@@ -46,32 +52,24 @@ func PaymentPageBuyNow(w http.ResponseWriter, r *http.Request) error {
 	}
 	sku := store.Sku(chi.URLParam(r, "sku"))
 	if len(sku) <= 0 {
-		handlers.Redirect(w, r, "/oops")
-		return errors.New("sku not present in the params")
+		return handlers.NotFound(errors.New("sku not present in the params"))
 	}
 
 	params := r.URL.Query()
 	quantityProd, err := strconv.Atoi(params.Get("quantity"))
 	if err != nil {
-		handlers.Redirect(w, r, "/oops")
-		return fmt.Errorf("quantity of product within url params encounter a error: %w", err)
+		return handlers.UserError(fmt.Errorf("quantity of product within url params encounter a error: %w", err))
 	}
 	if quantityProd <= 0 {
-		handlers.Redirect(w, r, "/oops")
-		return errors.New("quantity for products is below or equals zero")
+		return handlers.UserError(errors.New("quantity for products is below or equals zero"))
 	}
 	productId, err := sku.ProductId()
 	if err != nil {
-		handlers.Redirect(w, r, "/oops")
-		return err
+		return handlers.NotFound(err)
 	}
 
-	ctx := context.Background()
-	ctx = context.WithValue(ctx, "productId", productId)
-	ctx = context.WithValue(ctx, "sku", sku)
-	product, err := store.Pub.GetProduct(ctx)
+	product, err := store.Pub.GetProduct(r.Context(), productId)
 	if err != nil {
-		handlers.Redirect(w, r, "/oops")
 		return err
 	}
 	item := store.Items{
@@ -85,18 +83,120 @@ func PaymentPageBuyNow(w http.ResponseWriter, r *http.Request) error {
 	}
 	err = item.SetComb(sku, product.Combinations)
 	if err != nil {
-		handlers.Redirect(w, r, "/oops")
+		return handlers.NotFound(err)
+	}
+	countCart, err := store.Pub.CartCountItems(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	addresses, err := store.Pub.GetAddresses(r.Context(), user.Id)
+	if err != nil {
 		return err
 	}
-	countCart, err := store.Pub.CartCountItems(context.Background(), user.Id)
+	quote, options, err := quoteCheckout(r.Context(), user.Id, "", defaultAddress(addresses), 0, item)
 	if err != nil {
-		handlers.Redirect(w, r, "/oops")
 		return err
 	}
-	cartTotal, err := store.TotalItems(item.Comb.Currency, item)
+	return render.Template(w, r, checkout.Index(user, countCart, quote, options, addresses, false, item))
+}
+
+func UpdateSummary(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
 	if err != nil {
-		handlers.Redirect(w, r, "/oops")
+		handlers.Redirect(w, r, "/login")
 		return err
 	}
-	return render.Template(w, r, checkout.Index(user, countCart, cartTotal, false, item))
+	err = r.ParseForm()
+	if err != nil {
+		return handlers.UserError(err)
+	}
+	skus := r.PostForm["sku"]
+	quantities := r.PostForm["quantity"]
+	if len(skus) <= 0 || len(skus) != len(quantities) {
+		return handlers.UserError(errors.New("skus and quantities from the summary form dont match"))
+	}
+	currency, err := store.ToCurrency(r.PostForm.Get("currency"))
+	if err != nil {
+		return handlers.UserError(err)
+	}
+	items := make([]store.Items, 0, len(skus))
+	for i, sku := range skus {
+		quantity, err := strconv.Atoi(quantities[i])
+		if err != nil {
+			return handlers.UserError(err)
+		}
+		items = append(items, store.Items{
+			Comb:     store.Combination{Sku: store.Sku(sku), Currency: currency},
+			Quantity: quantity,
+		})
+	}
+	var address store.Address
+	if addressId, _ := strconv.Atoi(r.PostForm.Get("address-id")); addressId > 0 {
+		userAddress, err := store.Pub.GetAddress(r.Context(), user.Id, addressId)
+		if err != nil {
+			return err
+		}
+		address = userAddress.Address
+	}
+	shippingMethodId, _ := strconv.Atoi(r.PostForm.Get("shipping-method"))
+	quote, options, err := quoteCheckout(r.Context(), user.Id, r.PostForm.Get("coupon"), address, shippingMethodId, items...)
+	if err != nil {
+		return err
+	}
+	return render.Template(w, r, checkout.Summary(items, quote, options))
+}
+
+// quoteCheckout quotes the items for the given address, when the shipping method
+// is missing or not available there the cheapest available one is picked.
+func quoteCheckout(ctx context.Context, userId int, coupon string, address store.Address, shippingMethodId int, items ...store.Items) (store.Quote, []store.ShippingOption, error) {
+	if len(items) <= 0 {
+		return store.Quote{Currency: store.USD}, []store.ShippingOption{}, nil
+	}
+	currency := items[0].Comb.Currency
+	if err := currency.Valid(); err != nil {
+		currency = store.USD
+	}
+	orderItems := store.ToOrderItems(items...)
+	options := []store.ShippingOption{}
+	if !address.Empty() {
+		var err error
+		options, err = store.Pub.ShippingOptions(ctx, orderItems, currency, address)
+		if err != nil {
+			return store.Quote{}, []store.ShippingOption{}, err
+		}
+		if !hasShippingOption(options, shippingMethodId) && len(options) > 0 {
+			shippingMethodId = options[0].MethodId
+		}
+	}
+	quote, err := store.Pub.QuoteItems(ctx, store.QuoteRequest{
+		Items:            orderItems,
+		UserId:           userId,
+		Currency:         currency,
+		CouponCode:       coupon,
+		ShippingMethodId: shippingMethodId,
+		Address:          address,
+	})
+	if err != nil {
+		return store.Quote{}, []store.ShippingOption{}, err
+	}
+	return quote, options, nil
+}
+
+func hasShippingOption(options []store.ShippingOption, methodId int) bool {
+	for _, option := range options {
+		if option.MethodId == methodId {
+			return true
+		}
+	}
+	return false
+}
+
+func defaultAddress(addresses []store.UserAddress) store.Address {
+	id := checkout.DefaultAddressId(addresses)
+	for _, address := range addresses {
+		if address.Id == id {
+			return address.Address
+		}
+	}
+	return store.Address{}
 }
@@ -3,14 +3,17 @@ package config
 import (
 	"fmt"
 	"github.com/joho/godotenv"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 )
 
 type Config struct {
 	Production              bool
-	PublicHost              string
+	PublicURL               string
 	Port                    string
 	DBPort                  string
 	DBUser                  string
@@ -21,13 +24,61 @@ type Config struct {
 	DBsslMode               string
 	CookiesPath             string
 	CookiesAuthSecret       string
+	CSRFSecret              string
+	MagicLinkSecret         string
 	CookiesAuthAgeInSeconds int
+	DrainTimeoutInSeconds   int
+	DrainGraceInSeconds     int
+	MetricsAddr             string
+	RequestTimeoutInSeconds int
+	MagicLinkTTLInMinutes   int
 	CookiesAuthIsSecure     bool
 	CookiesAuthIsHttpOnly   bool
 	GoogleKey               string
 	GoogleSecret            string
 	PaypalKey               string
 	PaypalSecret            string
+	AdminEmails             []string
+	AllowedOrigins          []string
+	SMTPHost                string
+	SMTPPort                string
+	SMTPUsername            string
+	SMTPPassword            string
+	EmailFrom               string
+	EmailDir                string
+	TracesExporter          string
+	OIDCProviders           []OIDCProvider
+	RateLimitStore          string
+	RateLimits              map[string]RateLimit
+	TrustedProxies          []netip.Prefix
+}
+
+// RateLimit is a token bucket, Burst requests go through at once and the
+// bucket refills PerMinute tokens a minute. PerMinute at zero turns it off.
+type RateLimit struct {
+	PerMinute int
+	Burst     int
+}
+
+// rateLimits are the policies routes use, each one reads its overrides from
+// RATE_LIMIT_<NAME>_PER_MINUTE and RATE_LIMIT_<NAME>_BURST.
+var rateLimits = map[string]RateLimit{
+	"auth":     {PerMinute: 10, Burst: 5},
+	"cart":     {PerMinute: 60, Burst: 20},
+	"checkout": {PerMinute: 20, Burst: 5},
+}
+
+// OIDCProvider is an OpenID Connect issuer users can log in with, each one
+// listed in OIDC_PROVIDERS reads its settings from OIDC_<NAME>_* variables.
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	EmailClaim   string
+	NameClaim    string
+	PictureClaim string
 }
 
 const (
@@ -39,7 +90,7 @@ var Envs Config
 func InitEnvConfig() Config {
 	return Config{
 		Production:              getEnvAsBool("PROD", false),
-		PublicHost:              getEnv("HOST", "http://localhost"),
+		PublicURL:               strings.TrimSuffix(getEnv("PUBLIC_URL", "http://localhost:8000"), "/"),
 		Port:                    getEnv("PORT", "8000"),
 		DBPort:                  getEnv("DB_PORT", "5432"),
 		DBHost:                  getEnv("DB_HOST", "localhost"),
@@ -50,14 +101,124 @@ func InitEnvConfig() Config {
 		DBsslMode:               getEnv("DB_SSL_MODE", "require"),
 		CookiesPath:             getEnv("COOKIES_AUTH_PATH", "/"),
 		CookiesAuthSecret:       getEnv("COOKIES_AUTH_SECRET", "secret_cookie"),
+		CSRFSecret:              getEnvOrError("CSRF_SECRET"),
+		MagicLinkSecret:         getEnvOrError("MAGIC_LINK_SECRET"),
 		CookiesAuthAgeInSeconds: getEnvAsInt("COOKIES_AUTH_AGE", twoDaysInSeconds),
+		DrainTimeoutInSeconds:   getEnvAsInt("DRAIN_TIMEOUT", 30),
+		DrainGraceInSeconds:     getEnvAsInt("DRAIN_GRACE", 5),
+		MetricsAddr:             getEnv("METRICS_ADDR", "127.0.0.1:9100"),
+		RequestTimeoutInSeconds: getEnvAsInt("REQUEST_TIMEOUT", 15),
+		MagicLinkTTLInMinutes:   getEnvAsInt("MAGIC_LINK_TTL", 15),
 		CookiesAuthIsSecure:     getEnvAsBool("COOKIES_AUTH_IS_SECURE", true),
 		CookiesAuthIsHttpOnly:   getEnvAsBool("COOKIES_AUTH_IS_HTTP_ONLY", true),
 		GoogleKey:               getEnvOrError("GOOGLE_KEY"),
 		GoogleSecret:            getEnvOrError("GOOGLE_SECRET"),
 		PaypalKey:               getEnvOrError("PAYPAL_KEY"),
 		PaypalSecret:            getEnvOrError("PAYPAL_SECRET"),
+		AdminEmails:             getEnvAsList("ADMIN_EMAILS"),
+		AllowedOrigins:          getEnvAsList("ALLOWED_ORIGINS"),
+		SMTPHost:                getEnv("SMTP_HOST", ""),
+		SMTPPort:                getEnv("SMTP_PORT", "587"),
+		SMTPUsername:            getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:            getEnv("SMTP_PASSWORD", ""),
+		EmailFrom:               getEnv("EMAIL_FROM", "shop@localhost"),
+		EmailDir:                getEnv("EMAIL_DIR", "tmp/emails"),
+		TracesExporter:          getEnv("OTEL_TRACES_EXPORTER", "none"),
+		OIDCProviders:           getOIDCProviders(),
+		RateLimitStore:          getEnv("RATE_LIMIT_STORE", "memory"),
+		RateLimits:              getRateLimits(),
+		TrustedProxies:          getTrustedProxies(),
+	}
+}
+
+// reservedProviders are the providers the shop has built in, the values
+// match the store providers so an OIDC provider cant take their identities.
+var reservedProviders = []string{"google", "local", "email", "magic_link"}
+
+func getOIDCProviders() []OIDCProvider {
+	providers := []OIDCProvider{}
+	for _, name := range getEnvAsList("OIDC_PROVIDERS") {
+		name = strings.ToLower(name)
+		if slices.Contains(reservedProviders, name) {
+			panic(fmt.Sprintf("OIDC_PROVIDERS has a reserved provider name %q", name))
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		scopes := getEnvAsList(prefix + "SCOPES")
+		if len(scopes) <= 0 {
+			scopes = []string{"openid", "email", "profile"}
+		}
+		providers = append(providers, OIDCProvider{
+			Name:         name,
+			Issuer:       getEnvOrError(prefix + "ISSUER"),
+			ClientID:     getEnvOrError(prefix + "CLIENT_ID"),
+			ClientSecret: getEnvOrError(prefix + "CLIENT_SECRET"),
+			Scopes:       scopes,
+			EmailClaim:   getEnv(prefix+"EMAIL_CLAIM", "email"),
+			NameClaim:    getEnv(prefix+"NAME_CLAIM", "name"),
+			PictureClaim: getEnv(prefix+"PICTURE_CLAIM", "picture"),
+		})
 	}
+	return providers
+}
+
+func getRateLimits() map[string]RateLimit {
+	limits := make(map[string]RateLimit, len(rateLimits))
+	for name, limit := range rateLimits {
+		prefix := "RATE_LIMIT_" + strings.ToUpper(name) + "_"
+		limits[name] = RateLimit{
+			PerMinute: getEnvAsInt(prefix+"PER_MINUTE", limit.PerMinute),
+			Burst:     max(getEnvAsInt(prefix+"BURST", limit.Burst), 1),
+		}
+	}
+	return limits
+}
+
+// getTrustedProxies reads TRUSTED_PROXIES, addresses or CIDRs of the proxies
+// in front of the shop. Only requests coming from them are trusted to tell
+// the client address in X-Forwarded-For.
+func getTrustedProxies() []netip.Prefix {
+	proxies := []netip.Prefix{}
+	for _, value := range getEnvAsList("TRUSTED_PROXIES") {
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				panic(fmt.Sprintf("TRUSTED_PROXIES has an invalid address %q: %v", value, err))
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			panic(fmt.Sprintf("TRUSTED_PROXIES has an invalid range %q: %v", value, err))
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies
+}
+
+// TrustedProxy tells if the address is one of TRUSTED_PROXIES.
+func (c Config) TrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range c.TrustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimit returns the policy by name, unknown names arent limited.
+func (c Config) RateLimit(name string) RateLimit {
+	return c.RateLimits[name]
+}
+
+func (c Config) OIDCProvider(name string) (OIDCProvider, bool) {
+	for _, provider := range c.OIDCProviders {
+		if provider.Name == name {
+			return provider, true
+		}
+	}
+	return OIDCProvider{}, false
 }
 
 func getEnv(key, fallback string) string {
@@ -88,6 +249,17 @@ func getEnvAsInt(key string, fallback int) int {
 	return i
 }
 
+func getEnvAsList(key string) []string {
+	list := []string{}
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		value = strings.TrimSpace(value)
+		if len(value) > 0 {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
 func getEnvAsBool(key string, fallback bool) bool {
 	value := os.Getenv(key)
 	b, err := strconv.ParseBool(value)
@@ -1,7 +1,12 @@
+CREATE TYPE currency AS ENUM ('USD', 'COP');
+
 CREATE TABLE users (
     id SERIAL PRIMARY KEY,
     name VARCHAR(50),
     email VARCHAR(50) UNIQUE,
+    avatar_url VARCHAR(500),
+    locale VARCHAR(10) NOT NULL DEFAULT 'en',
+    currency currency NOT NULL DEFAULT 'USD',
     created_at TIMESTAMPTZ DEFAULT (CURRENT_TIMESTAMP AT TIME ZONE 'America/Bogota')
 );
 
@@ -16,12 +21,34 @@ CREATE TYPE items AS (
     quantity INT
 );
 
+CREATE TYPE address AS (
+    full_name VARCHAR(300),
+    address_line_1 VARCHAR(300),
+    address_line_2 VARCHAR(300),
+    admin_area_2 VARCHAR(120),
+    admin_area_1 VARCHAR(300),
+    postal_code VARCHAR(60),
+    country_code CHAR(2)
+);
+
+CREATE TYPE line_tax AS (
+    sku VARCHAR,
+    quantity INT,
+    line_total DECIMAL,
+    tax_name VARCHAR,
+    tax_rate DECIMAL,
+    tax_inclusive BOOLEAN,
+    tax_amount DECIMAL
+);
+
 CREATE TABLE products (
     id SERIAL PRIMARY KEY,
     name VARCHAR(255) NOT NULL,
     description TEXT NOT NULL,
     short_description VARCHAR(255),
     images TEXT[],
+    category VARCHAR(50),
+    tax_class VARCHAR(50) NOT NULL DEFAULT 'standard',
     created_at TIMESTAMPTZ DEFAULT (CURRENT_TIMESTAMP AT TIME ZONE 'America/Bogota'),
     updated_at TIMESTAMPTZ DEFAULT (CURRENT_TIMESTAMP AT TIME ZONE 'America/Bogota')
 );
@@ -35,7 +62,6 @@ CREATE TABLE variants (
     UNIQUE(product_id, label)
 );
 
-CREATE TYPE currency AS ENUM ('USD', 'COP');
 CREATE TABLE combinations (
     sku VARCHAR(255) UNIQUE PRIMARY KEY,
     price DECIMAL(15, 4) NOT NULL,
@@ -43,7 +69,15 @@ CREATE TABLE combinations (
     product_id INT NOT NULL,
     stock INT DEFAULT 0,
     options option[],
-    FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
+    sale_price DECIMAL(15, 4),
+    sale_starts_at TIMESTAMPTZ,
+    sale_ends_at TIMESTAMPTZ,
+    weight DECIMAL(10, 3) NOT NULL DEFAULT 0,
+    length DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    width DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    height DECIMAL(10, 2) NOT NULL DEFAULT 0,
+    FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE,
+    CHECK (sale_price IS NULL OR (sale_price > 0 AND sale_price < price))
 );
 
 CREATE TABLE carts (
@@ -65,27 +99,90 @@ CREATE TABLE cart_items (
 
 CREATE TYPE order_status AS ENUM ('COMPLETED', 'PENDING', 'PARTIALLY_REFUNDED', 'DECLINED', 'REFUNDED', 'FAILED');
 CREATE TYPE payment_provider AS ENUM ('paypal');
+CREATE TYPE fulfillment_status AS ENUM ('paid', 'packed', 'partially_shipped', 'shipped', 'delivered');
 
 CREATE TABLE orders (
     id SERIAL PRIMARY KEY,
     order_id VARCHAR(255) NOT NULL,
     capture_ids TEXT[],
     reference_ids TEXT[],
-    user_id INT NOT NULL,
+    user_id INT,
     cart_items items[] NOT NULL,
     payer_name VARCHAR(255),
     payer_email VARCHAR(255),
     payer_id VARCHAR(255) NOT NULL,
     currency currency NOT NULL,
     total DECIMAL(15, 4) NOT NULL,
+    item_total DECIMAL(15, 4) NOT NULL DEFAULT 0,
+    discount DECIMAL(15, 4) NOT NULL DEFAULT 0,
+    coupon_code VARCHAR(50),
+    promotions TEXT[] NOT NULL DEFAULT '{}',
+    shipping_address address,
+    shipping_method_id INT,
+    shipping_method VARCHAR(100),
+    shipping_total DECIMAL(15, 4) NOT NULL DEFAULT 0,
+    tax_total DECIMAL(15, 4) NOT NULL DEFAULT 0,
+    tax_included DECIMAL(15, 4) NOT NULL DEFAULT 0,
+    fulfillment_status fulfillment_status NOT NULL DEFAULT 'paid',
+    packed_at TIMESTAMPTZ,
+    shipped_at TIMESTAMPTZ,
+    delivered_at TIMESTAMPTZ,
     status order_status DEFAULT 'PENDING',
     payment_provider payment_provider NOT NULL,
     created_at TIMESTAMPTZ DEFAULT (CURRENT_TIMESTAMP AT TIME ZONE 'America/Bogota'),
     updated_at TIMESTAMPTZ DEFAULT (CURRENT_TIMESTAMP AT TIME ZONE 'America/Bogota'),
-    FOREIGN KEY (user_id) REFERENCES users(id),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL,
     UNIQUE(id, user_id, order_id)
 );
 
+CREATE TABLE order_items (
+    id SERIAL PRIMARY KEY,
+    order_id INT NOT NULL,
+    sku VARCHAR(255) NOT NULL,
+    quantity INT NOT NULL,
+    line_total DECIMAL(15, 4) NOT NULL,
+    tax_name VARCHAR(100) NOT NULL DEFAULT '',
+    tax_rate DECIMAL(7, 4) NOT NULL DEFAULT 0,
+    tax_inclusive BOOLEAN NOT NULL DEFAULT FALSE,
+    tax_amount DECIMAL(15, 4) NOT NULL DEFAULT 0,
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+);
+
+CREATE TABLE shipments (
+    id SERIAL PRIMARY KEY,
+    order_id INT NOT NULL,
+    carrier VARCHAR(100) NOT NULL,
+    tracking_number VARCHAR(255) NOT NULL,
+    shipped_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMPTZ,
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+);
+
+CREATE TABLE shipment_items (
+    id SERIAL PRIMARY KEY,
+    shipment_id INT NOT NULL,
+    order_item_id INT NOT NULL,
+    quantity INT NOT NULL,
+    FOREIGN KEY (shipment_id) REFERENCES shipments(id) ON DELETE CASCADE,
+    FOREIGN KEY (order_item_id) REFERENCES order_items(id) ON DELETE CASCADE,
+    CHECK (quantity > 0)
+);
+
+CREATE TABLE order_events (
+    id SERIAL PRIMARY KEY,
+    order_id INT NOT NULL,
+    from_status order_status,
+    to_status order_status NOT NULL,
+    from_fulfillment fulfillment_status,
+    to_fulfillment fulfillment_status NOT NULL,
+    actor VARCHAR(255) NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_order_events_order ON order_events(order_id, created_at);
+
 CREATE TABLE favorites (
     id SERIAL PRIMARY KEY,
     user_id INT UNIQUE,
@@ -101,6 +198,461 @@ CREATE TABLE favorites_items (
     FOREIGN KEY (product_id) REFERENCES products(id) ON DELETE CASCADE
 );
 
+CREATE TABLE stock_subscriptions (
+    id SERIAL PRIMARY KEY,
+    sku VARCHAR(255) NOT NULL,
+    user_id INT,
+    email VARCHAR(255) NOT NULL,
+    restocked_at TIMESTAMPTZ,
+    notified_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT (CURRENT_TIMESTAMP AT TIME ZONE 'America/Bogota'),
+    FOREIGN KEY (sku) REFERENCES combinations(sku) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    UNIQUE (sku, email)
+);
+
+CREATE TABLE user_identities (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    provider VARCHAR(50) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(255),
+    refresh_token TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_login_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    UNIQUE (provider, subject)
+);
+
+CREATE INDEX idx_user_identities_user ON user_identities(user_id);
+
+CREATE TABLE sessions (
+    id SERIAL PRIMARY KEY,
+    token_hash BYTEA NOT NULL UNIQUE,
+    user_id INT NOT NULL,
+    is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+    provider VARCHAR(50) NOT NULL,
+    avatar_url TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    ip_address VARCHAR(64) NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ,
+    mfa_pending BOOLEAN NOT NULL DEFAULT FALSE,
+    mfa_verified_at TIMESTAMPTZ,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_sessions_user ON sessions(user_id) WHERE revoked_at IS NULL;
+
+CREATE TABLE roles (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(50) NOT NULL UNIQUE,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TABLE role_permissions (
+    role_id INT NOT NULL,
+    permission VARCHAR(50) NOT NULL,
+    FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission)
+);
+
+CREATE TABLE user_roles (
+    user_id INT NOT NULL,
+    role_id INT NOT NULL,
+    granted_by VARCHAR(255) NOT NULL,
+    granted_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+-- role_events audits every grant and revoke, the email is copied so the
+-- trail outlives the user.
+CREATE TABLE role_events (
+    id SERIAL PRIMARY KEY,
+    user_id INT,
+    email VARCHAR(255) NOT NULL,
+    role VARCHAR(50) NOT NULL,
+    action VARCHAR(10) NOT NULL CHECK (action IN ('grant', 'revoke')),
+    actor VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX idx_role_events_created ON role_events(created_at);
+
+INSERT INTO roles(name, description) VALUES
+    ('owner', 'everything, including who else has access'),
+    ('order_manager', 'fulfills orders and refunds them'),
+    ('catalog_editor', 'edits products, prices and stock'),
+    ('support', 'looks up orders to answer customers')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permissions(role_id, permission)
+SELECT r.id, p.permission
+FROM roles AS r
+JOIN (VALUES
+    ('owner', 'orders:view'),
+    ('owner', 'orders:fulfill'),
+    ('owner', 'orders:refund'),
+    ('owner', 'catalog:edit'),
+    ('owner', 'roles:manage'),
+    ('order_manager', 'orders:view'),
+    ('order_manager', 'orders:fulfill'),
+    ('order_manager', 'orders:refund'),
+    ('catalog_editor', 'catalog:edit'),
+    ('support', 'orders:view')
+) AS p(role, permission) ON p.role = r.name
+ON CONFLICT DO NOTHING;
+
+CREATE TABLE user_totp (
+    user_id INT PRIMARY KEY,
+    secret VARCHAR(64) NOT NULL,
+    last_step BIGINT NOT NULL DEFAULT 0,
+    enabled_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    code_hash BYTEA NOT NULL,
+    used_at TIMESTAMPTZ,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    UNIQUE (user_id, code_hash)
+);
+
+CREATE TABLE magic_links (
+    id SERIAL PRIMARY KEY,
+    token_hash BYTEA NOT NULL UNIQUE,
+    email VARCHAR(255) NOT NULL,
+    ip_address VARCHAR(64) NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ
+);
+
+CREATE INDEX idx_magic_links_email ON magic_links(lower(email), created_at);
+CREATE INDEX idx_magic_links_ip ON magic_links(ip_address, created_at);
+
+CREATE TABLE email_changes (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    email VARCHAR(50) NOT NULL,
+    token_hash BYTEA NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- rate_limits holds the token buckets shared by every instance, losing them
+-- on a crash only refills them so the table skips the write ahead log.
+CREATE UNLOGGED TABLE rate_limits (
+    key VARCHAR(255) PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE email_outbox (
+    id SERIAL PRIMARY KEY,
+    recipient VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    html_body TEXT NOT NULL,
+    text_body TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    last_error TEXT,
+    send_after TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_until TIMESTAMPTZ,
+    sent_at TIMESTAMPTZ,
+    failed_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_email_outbox_pending ON email_outbox(send_after)
+    WHERE sent_at IS NULL AND failed_at IS NULL;
+
+CREATE TABLE jobs (
+    id SERIAL PRIMARY KEY,
+    kind VARCHAR(100) NOT NULL,
+    payload JSONB NOT NULL DEFAULT '{}',
+    attempts INT NOT NULL DEFAULT 0,
+    max_attempts INT NOT NULL DEFAULT 10,
+    run_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_until TIMESTAMPTZ,
+    last_error TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CHECK (max_attempts > 0)
+);
+
+CREATE INDEX idx_jobs_run_at ON jobs(run_at);
+
+CREATE TABLE dead_jobs (
+    id INT PRIMARY KEY,
+    kind VARCHAR(100) NOT NULL,
+    payload JSONB NOT NULL,
+    attempts INT NOT NULL,
+    last_error TEXT,
+    created_at TIMESTAMPTZ NOT NULL,
+    failed_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TYPE coupon_kind AS ENUM ('percentage', 'fixed_amount', 'free_shipping');
+
+CREATE TABLE coupons (
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(50) UNIQUE NOT NULL,
+    kind coupon_kind NOT NULL,
+    value DECIMAL(15, 4) NOT NULL DEFAULT 0,
+    currency currency,
+    min_spend DECIMAL(15, 4) NOT NULL DEFAULT 0,
+    usage_limit INT,
+    per_user_limit INT,
+    skus TEXT[] NOT NULL DEFAULT '{}',
+    categories TEXT[] NOT NULL DEFAULT '{}',
+    starts_at TIMESTAMPTZ,
+    ends_at TIMESTAMPTZ,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ DEFAULT (CURRENT_TIMESTAMP AT TIME ZONE 'America/Bogota'),
+    CHECK (code = UPPER(code)),
+    CHECK (kind <> 'percentage' OR (value > 0 AND value <= 100)),
+    CHECK (kind <> 'fixed_amount' OR (value > 0 AND currency IS NOT NULL))
+);
+
+CREATE TABLE coupon_redemptions (
+    id SERIAL PRIMARY KEY,
+    coupon_id INT NOT NULL,
+    user_id INT,
+    order_id INT,
+    over_limit BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ DEFAULT (CURRENT_TIMESTAMP AT TIME ZONE 'America/Bogota'),
+    FOREIGN KEY (coupon_id) REFERENCES coupons(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL,
+    FOREIGN KEY (order_id) REFERENCES orders(id) ON DELETE CASCADE
+);
+
+CREATE TYPE promotion_kind AS ENUM ('buy_x_get_y', 'percentage_over');
+
+CREATE TABLE promotions (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    kind promotion_kind NOT NULL,
+    buy_quantity INT,
+    get_quantity INT,
+    percent DECIMAL(5, 2),
+    min_subtotal DECIMAL(15, 4) NOT NULL DEFAULT 0,
+    currency currency,
+    skus TEXT[] NOT NULL DEFAULT '{}',
+    starts_at TIMESTAMPTZ,
+    ends_at TIMESTAMPTZ,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ DEFAULT (CURRENT_TIMESTAMP AT TIME ZONE 'America/Bogota'),
+    CHECK (kind <> 'buy_x_get_y' OR (buy_quantity > 0 AND get_quantity > 0)),
+    CHECK (kind <> 'percentage_over' OR (percent > 0 AND percent <= 100))
+);
+
+CREATE TABLE addresses (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    full_name VARCHAR(300) NOT NULL,
+    address_line_1 VARCHAR(300) NOT NULL,
+    address_line_2 VARCHAR(300) NOT NULL DEFAULT '',
+    admin_area_2 VARCHAR(120) NOT NULL,
+    admin_area_1 VARCHAR(300) NOT NULL DEFAULT '',
+    postal_code VARCHAR(60) NOT NULL DEFAULT '',
+    country_code CHAR(2) NOT NULL,
+    is_default BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ DEFAULT (CURRENT_TIMESTAMP AT TIME ZONE 'America/Bogota'),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX addresses_one_default ON addresses(user_id) WHERE is_default;
+
+CREATE TYPE shipping_rate_kind AS ENUM ('flat', 'weight', 'price_tier');
+
+CREATE TABLE shipping_zones (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    countries TEXT[] NOT NULL DEFAULT '{}',
+    regions TEXT[] NOT NULL DEFAULT '{}',
+    active BOOLEAN NOT NULL DEFAULT TRUE
+);
+
+CREATE TABLE shipping_methods (
+    id SERIAL PRIMARY KEY,
+    zone_id INT NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    rate_kind shipping_rate_kind NOT NULL,
+    currency currency NOT NULL,
+    flat_rate DECIMAL(15, 4),
+    min_days INT NOT NULL DEFAULT 0,
+    max_days INT NOT NULL DEFAULT 0,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    FOREIGN KEY (zone_id) REFERENCES shipping_zones(id) ON DELETE CASCADE,
+    CHECK (rate_kind <> 'flat' OR flat_rate >= 0),
+    CHECK (min_days <= max_days)
+);
+
+-- min_value is a weight in kg for weight rates and an item total for price tiers,
+-- the tier with the highest min_value not above the cart value applies.
+CREATE TABLE shipping_rate_tiers (
+    id SERIAL PRIMARY KEY,
+    method_id INT NOT NULL,
+    min_value DECIMAL(15, 4) NOT NULL DEFAULT 0,
+    rate DECIMAL(15, 4) NOT NULL,
+    FOREIGN KEY (method_id) REFERENCES shipping_methods(id) ON DELETE CASCADE,
+    UNIQUE (method_id, min_value),
+    CHECK (rate >= 0)
+);
+
+-- inclusive rates are already part of the price (IVA in COP), exclusive ones
+-- are added on top (US sales tax). An empty region applies to the whole country
+-- and loses against a rate for the region.
+CREATE TABLE tax_rates (
+    id SERIAL PRIMARY KEY,
+    country_code CHAR(2) NOT NULL,
+    region VARCHAR(300) NOT NULL DEFAULT '',
+    tax_class VARCHAR(50) NOT NULL DEFAULT 'standard',
+    name VARCHAR(100) NOT NULL,
+    rate DECIMAL(7, 4) NOT NULL,
+    inclusive BOOLEAN NOT NULL DEFAULT FALSE,
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    UNIQUE (country_code, region, tax_class),
+    CHECK (country_code = UPPER(country_code)),
+    CHECK (rate >= 0 AND rate <= 100)
+);
+
+CREATE OR REPLACE FUNCTION on_sale(
+    in_combination combinations
+) RETURNS BOOLEAN AS $$
+BEGIN
+    RETURN in_combination.sale_price IS NOT NULL
+	AND (in_combination.sale_starts_at IS NULL OR in_combination.sale_starts_at <= CURRENT_TIMESTAMP)
+	AND (in_combination.sale_ends_at IS NULL OR in_combination.sale_ends_at > CURRENT_TIMESTAMP);
+END;
+$$ LANGUAGE plpgsql STABLE;
+
+CREATE OR REPLACE FUNCTION current_price(
+    in_combination combinations
+) RETURNS DECIMAL AS $$
+BEGIN
+    IF on_sale(in_combination) THEN
+	RETURN in_combination.sale_price;
+    END IF;
+    RETURN in_combination.price;
+END;
+$$ LANGUAGE plpgsql STABLE;
+
+CREATE OR REPLACE FUNCTION compare_at_price(
+    in_combination combinations
+) RETURNS DECIMAL AS $$
+BEGIN
+    IF on_sale(in_combination) THEN
+	RETURN in_combination.price;
+    END IF;
+    RETURN 0;
+END;
+$$ LANGUAGE plpgsql STABLE;
+
+CREATE OR REPLACE FUNCTION promotions_discount(
+    in_items items[],
+    in_currency currency
+) RETURNS TABLE (
+    discount DECIMAL,
+    promotion_names TEXT[]
+) AS $$
+DECLARE
+    promotion_var promotions;
+    item_total_var DECIMAL;
+    eligible_total_var DECIMAL;
+    promotion_discount_var DECIMAL;
+BEGIN
+    discount := 0;
+    promotion_names := '{}';
+
+    SELECT COALESCE(SUM(current_price(combinations) * i.quantity), 0)
+    INTO item_total_var
+    FROM UNNEST(in_items) AS i
+    JOIN combinations ON combinations.sku = i.sku;
+
+    FOR promotion_var IN
+	SELECT *
+	FROM promotions AS p
+	WHERE p.active
+	    AND (p.starts_at IS NULL OR p.starts_at <= CURRENT_TIMESTAMP)
+	    AND (p.ends_at IS NULL OR p.ends_at > CURRENT_TIMESTAMP)
+	    AND (p.currency IS NULL OR p.currency = in_currency)
+	ORDER BY p.id
+    LOOP
+	promotion_discount_var := 0;
+
+	CASE promotion_var.kind
+	    WHEN 'buy_x_get_y' THEN
+		SELECT COALESCE(SUM(
+		    FLOOR(i.quantity::DECIMAL / (promotion_var.buy_quantity + promotion_var.get_quantity))
+		    * promotion_var.get_quantity * current_price(combinations)
+		), 0)
+		INTO promotion_discount_var
+		FROM UNNEST(in_items) AS i
+		JOIN combinations ON combinations.sku = i.sku
+		WHERE CARDINALITY(promotion_var.skus) = 0 OR combinations.sku = ANY(promotion_var.skus);
+	    WHEN 'percentage_over' THEN
+		SELECT COALESCE(SUM(current_price(combinations) * i.quantity), 0)
+		INTO eligible_total_var
+		FROM UNNEST(in_items) AS i
+		JOIN combinations ON combinations.sku = i.sku
+		WHERE CARDINALITY(promotion_var.skus) = 0 OR combinations.sku = ANY(promotion_var.skus);
+
+		IF eligible_total_var > 0 AND eligible_total_var >= promotion_var.min_subtotal THEN
+		    promotion_discount_var := ROUND(eligible_total_var * promotion_var.percent / 100, 2);
+		END IF;
+	END CASE;
+
+	IF promotion_discount_var > 0 THEN
+	    discount := discount + promotion_discount_var;
+	    promotion_names := ARRAY_APPEND(promotion_names, promotion_var.name::TEXT);
+	END IF;
+    END LOOP;
+
+    discount := LEAST(discount, item_total_var);
+
+    RETURN QUERY
+    SELECT discount, promotion_names;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION cart_balance(
+    in_cart_id INT
+) RETURNS DECIMAL AS $$
+DECLARE
+    items_var items[];
+    currency_var currency;
+    total_var DECIMAL;
+    discount_var DECIMAL;
+BEGIN
+    SELECT ARRAY_AGG(ROW(ci.sku, ci.quantity)::items), MIN(c.currency),
+	SUM(current_price(c) * ci.quantity)
+    INTO items_var, currency_var, total_var
+    FROM cart_items AS ci
+    JOIN combinations AS c ON c.sku = ci.sku
+    WHERE ci.cart_id = in_cart_id;
+
+    IF items_var IS NULL THEN
+	RETURN 0;
+    END IF;
+
+    SELECT discount
+    INTO discount_var
+    FROM promotions_discount(items_var, currency_var);
+
+    RETURN total_var - discount_var;
+END;
+$$ LANGUAGE plpgsql;
+
 CREATE OR REPLACE FUNCTION get_cart_items(
     in_user_id INT
 ) RETURNS TABLE (
@@ -225,7 +777,7 @@ BEGIN
 
     SELECT products.id, combinations.sku, cart_items.quantity,
 	cart_items.created_at, products.name, products.short_description,
-	combinations.price, products.images, combinations.options
+	current_price(combinations), products.images, combinations.options
     INTO product_id, sku, quantity, created_at, name,
 	short_description, price, images, options
     FROM cart_items
@@ -293,13 +845,9 @@ BEGIN
     FROM cart_items
     WHERE cart_items.cart_id = cart_id_var;
 
-    SELECT SUM(combinations.price * cart_items.quantity)
-    INTO total_cart_balance
-    FROM cart_items
-    JOIN combinations ON cart_items.sku = combinations.sku
-    WHERE cart_items.cart_id = cart_id_var;
+    total_cart_balance := cart_balance(cart_id_var);
 
-    SELECT SUM(combinations.price * cart_items.quantity)
+    SELECT SUM(current_price(combinations) * cart_items.quantity)
     INTO total_product_balance
     FROM cart_items
     JOIN combinations ON cart_items.sku = combinations.sku
@@ -359,11 +907,7 @@ BEGIN
     FROM cart_items
     WHERE cart_items.cart_id = cart_id_var;
 
-    SELECT SUM(combinations.price * cart_items.quantity)
-    INTO total_cart_balance
-    FROM cart_items
-    JOIN combinations ON cart_items.sku = combinations.sku
-    WHERE cart_items.cart_id = cart_id_var;
+    total_cart_balance := cart_balance(cart_id_var);
 
     IF cart_count_items IS NULL THEN
 	cart_count_items := 0;
@@ -408,11 +952,7 @@ BEGIN
     FROM cart_items
     WHERE cart_id = cart_id_var;
 
-    SELECT SUM(combinations.price * cart_items.quantity)
-    INTO total_cart_balance
-    FROM cart_items
-    JOIN combinations ON cart_items.sku = combinations.sku
-    WHERE cart_items.cart_id = cart_id_var;
+    total_cart_balance := cart_balance(cart_id_var);
 
     IF cart_count_items IS NULL THEN
 	cart_count_items := 0;
@@ -480,7 +1020,7 @@ BEGIN
     total_items_balance := 0;
     FOREACH item_var IN ARRAY in_items
     LOOP
-	SELECT SUM(price * item_var.quantity)
+	SELECT SUM(current_price(combinations) * item_var.quantity)
 	INTO sum_holder_var
 	FROM combinations
 	WHERE combinations.sku = item_var.sku
@@ -665,6 +1205,16 @@ CREATE OR REPLACE FUNCTION make_order(
     in_payment_provider payment_provider,
     in_user_id INT,
     in_cart_items items[],
+    in_item_total DECIMAL,
+    in_discount DECIMAL,
+    in_coupon_code VARCHAR,
+    in_promotions TEXT[],
+    in_shipping_address address,
+    in_shipping_method_id INT,
+    in_shipping_method VARCHAR,
+    in_shipping_total DECIMAL,
+    in_tax_total DECIMAL,
+    in_tax_included DECIMAL,
     in_total DECIMAL,
     in_currency currency,
     in_order_id VARCHAR,
@@ -676,42 +1226,1342 @@ CREATE OR REPLACE FUNCTION make_order(
 ) RETURNS TABLE (
     order_id INT
 ) AS $$
+DECLARE
+    coupon_var coupons;
+    over_limit_var BOOLEAN;
 BEGIN
-    INSERT INTO orders (payment_provider, user_id, cart_items,
-	total, currency, order_id,
+    INSERT INTO orders (status, payment_provider, user_id, cart_items,
+	item_total, discount, coupon_code, promotions,
+	shipping_address, shipping_method_id, shipping_method, shipping_total,
+	tax_total, tax_included, total, currency, order_id,
 	payer_name, payer_email, payer_id,
 	reference_ids, capture_ids)
-    VALUES (in_payment_provider, in_user_id, in_cart_items,
-	in_total, in_currency, in_order_id,
+    VALUES ('COMPLETED', in_payment_provider, in_user_id, in_cart_items,
+	in_item_total, in_discount, NULLIF(in_coupon_code, ''), in_promotions,
+	in_shipping_address, in_shipping_method_id, NULLIF(in_shipping_method, ''), in_shipping_total,
+	in_tax_total, in_tax_included, in_total, in_currency, in_order_id,
 	in_payer_name, in_payer_email, in_payer_id,
 	in_reference_ids, in_capture_ids)
     RETURNING id INTO order_id;
 
+    PERFORM record_order_event(order_id, NULL, 'COMPLETED', NULL, 'paid',
+	in_payment_provider::VARCHAR, 'payment captured');
+
+    INSERT INTO order_items(order_id, sku, quantity, line_total,
+	tax_name, tax_rate, tax_inclusive, tax_amount)
+    SELECT order_id, lt.sku, lt.quantity, lt.line_total,
+	lt.tax_name, lt.tax_rate, lt.tax_inclusive, lt.tax_amount
+    FROM line_taxes(in_cart_items, in_shipping_address,
+	CASE WHEN in_item_total > 0 THEN (in_item_total - in_discount) / in_item_total ELSE 1 END) AS lt;
+
+    IF LENGTH(in_coupon_code) > 0 THEN
+	-- the row lock makes concurrent orders with the same coupon count the
+	-- redemptions one after the other. the payment is already captured, so
+	-- a coupon that ran out of uses is flagged for review instead of
+	-- losing the order.
+	SELECT *
+	INTO coupon_var
+	FROM coupons
+	WHERE coupons.code = in_coupon_code
+	FOR UPDATE;
+
+	IF FOUND THEN
+	    over_limit_var := (coupon_var.usage_limit IS NOT NULL AND (
+		SELECT COUNT(*)
+		FROM coupon_redemptions
+		WHERE coupon_id = coupon_var.id) >= coupon_var.usage_limit)
+	    OR (coupon_var.per_user_limit IS NOT NULL AND (
+		SELECT COUNT(*)
+		FROM coupon_redemptions
+		WHERE coupon_id = coupon_var.id AND user_id = in_user_id) >= coupon_var.per_user_limit);
+
+	    INSERT INTO coupon_redemptions(coupon_id, user_id, order_id, over_limit)
+	    VALUES (coupon_var.id, in_user_id, order_id, over_limit_var);
+
+	    IF over_limit_var THEN
+		PERFORM record_order_event(order_id, 'COMPLETED', 'COMPLETED', 'paid', 'paid',
+		    in_payment_provider::VARCHAR, FORMAT('coupon %s was over its usage limit when paid', in_coupon_code));
+	    END IF;
+	END IF;
+    END IF;
+
     RETURN QUERY
     SELECT order_id;
 END;
 $$ LANGUAGE plpgsql;
 
+CREATE OR REPLACE FUNCTION line_taxes(
+    in_items items[],
+    in_address address,
+    in_net_ratio DECIMAL
+) RETURNS SETOF line_tax AS $$
+BEGIN
+    RETURN QUERY
+    SELECT l.sku, l.quantity, l.line_total,
+	COALESCE(tr.name, '')::VARCHAR, COALESCE(tr.rate, 0)::DECIMAL, COALESCE(tr.inclusive, FALSE),
+	CASE
+	    WHEN tr.id IS NULL THEN 0
+	    WHEN tr.inclusive THEN ROUND(l.line_total * in_net_ratio * tr.rate / (100 + tr.rate), 2)
+	    ELSE ROUND(l.line_total * in_net_ratio * tr.rate / 100, 2)
+	END::DECIMAL
+    FROM (
+	SELECT i.sku::VARCHAR AS sku, i.quantity, current_price(c) * i.quantity AS line_total, p.tax_class
+	FROM UNNEST(in_items) AS i
+	JOIN combinations AS c ON c.sku = i.sku
+	JOIN products AS p ON p.id = c.product_id
+    ) AS l
+    LEFT JOIN LATERAL (
+	SELECT t.id, t.name, t.rate, t.inclusive
+	FROM tax_rates AS t
+	WHERE t.active AND t.tax_class = l.tax_class
+	    AND t.country_code = UPPER(in_address.country_code)
+	    AND (t.region = '' OR t.region = in_address.admin_area_1)
+	ORDER BY t.region = ''
+	LIMIT 1
+    ) AS tr ON TRUE;
+END;
+$$ LANGUAGE plpgsql;
 
-DROP FUNCTION IF EXISTS update_cart_count(INT, CHARVAR, INT, INT);
-DROP FUNCTION IF EXISTS count_cart_items(INT);
-DROP FUNCTION IF EXISTS cart_count_items(INT);
-DROP FUNCTION IF EXISTS get_core_user_data(INT, VARCHAR);
-DROP FUNCTION IF EXISTS create_user(VARCHAR, VARCHAR);
-DROP FUNCTION IF EXISTS insert_variants(INT, variant[]);
-DROP FUNCTION IF EXISTS insert_combinations(INT, VARCHAR, combination[]);
-DROP FUNCTION IF EXISTS insert_product(VARCHAR, TEXT, VARCHAR, TEXT[]);
-DROP FUNCTION IF EXISTS get_cart_items(INT);
-DROP FUNCTION IF EXISTS add_to_cart(INT, VARCHAR, INT, INT);
+CREATE OR REPLACE FUNCTION record_order_event(
+    in_order_id INT,
+    in_from_status order_status,
+    in_to_status order_status,
+    in_from_fulfillment fulfillment_status,
+    in_to_fulfillment fulfillment_status,
+    in_actor VARCHAR,
+    in_reason TEXT
+) RETURNS VOID AS $$
+BEGIN
+    INSERT INTO order_events(order_id, from_status, to_status,
+	from_fulfillment, to_fulfillment, actor, reason)
+    VALUES (in_order_id, in_from_status, in_to_status,
+	in_from_fulfillment, in_to_fulfillment, in_actor, COALESCE(in_reason, ''));
+END;
+$$ LANGUAGE plpgsql;
 
-DROP TYPE IF EXISTS combination CASCADE;
-DROP TYPE IF EXISTS variant CASCADE;
-DROP TYPE IF EXISTS option CASCADE;
-DROP TYPE IF EXISTS items CASCADE;
-DROP TYPE IF EXISTS order_status CASCADE;
-DROP TYPE IF EXISTS currency CASCADE;
-DROP TYPE IF EXISTS payment_provider CASCADE;
+-- transition_order only moves the order when it is still in the state the
+-- caller validated the transition from.
+-- check_order_transition mirrors OrderState.Transition, the functions that
+-- move an order call it so the rules hold whatever path changes the row.
+CREATE OR REPLACE FUNCTION check_order_transition(
+    in_from_status order_status,
+    in_to_status order_status,
+    in_from_fulfillment fulfillment_status,
+    in_to_fulfillment fulfillment_status
+) RETURNS VOID AS $$
+BEGIN
+    IF in_from_status <> in_to_status AND NOT (
+	(in_from_status = 'PENDING' AND in_to_status IN ('COMPLETED', 'DECLINED', 'FAILED'))
+	OR (in_from_status IN ('COMPLETED', 'PARTIALLY_REFUNDED') AND in_to_status IN ('PARTIALLY_REFUNDED', 'REFUNDED'))) THEN
+	RAISE EXCEPTION 'illegal order transition: order cant go from % to %', in_from_status, in_to_status;
+    END IF;
+
+    IF in_from_fulfillment <> in_to_fulfillment AND NOT (
+	(in_from_fulfillment = 'paid' AND in_to_fulfillment = 'packed')
+	OR (in_from_fulfillment IN ('packed', 'partially_shipped') AND in_to_fulfillment IN ('partially_shipped', 'shipped'))
+	OR (in_from_fulfillment = 'shipped' AND in_to_fulfillment = 'delivered')) THEN
+	RAISE EXCEPTION 'illegal order transition: order cant go from % to %', in_from_fulfillment, in_to_fulfillment;
+    END IF;
+
+    IF in_from_status = in_to_status AND in_from_fulfillment = in_to_fulfillment
+	AND in_to_status <> 'PARTIALLY_REFUNDED' AND in_to_fulfillment <> 'partially_shipped' THEN
+	RAISE EXCEPTION 'illegal order transition: order is already % and %', in_to_status, in_to_fulfillment;
+    END IF;
+
+    IF in_from_fulfillment <> in_to_fulfillment AND in_to_status NOT IN ('COMPLETED', 'PARTIALLY_REFUNDED') THEN
+	RAISE EXCEPTION 'illegal order transition: order cant be % while its payment is %', in_to_fulfillment, in_to_status;
+    END IF;
+END;
+$$ LANGUAGE plpgsql IMMUTABLE;
+
+CREATE OR REPLACE FUNCTION transition_order(
+    in_order_id INT,
+    in_from_status order_status,
+    in_from_fulfillment fulfillment_status,
+    in_to_status order_status,
+    in_to_fulfillment fulfillment_status,
+    in_actor VARCHAR,
+    in_reason TEXT
+) RETURNS VOID AS $$
+BEGIN
+    PERFORM check_order_transition(in_from_status, in_to_status,
+	in_from_fulfillment, in_to_fulfillment);
+
+    UPDATE orders
+    SET status = in_to_status,
+	fulfillment_status = in_to_fulfillment,
+	packed_at = CASE WHEN in_to_fulfillment = 'packed' AND in_from_fulfillment <> 'packed'
+	    THEN CURRENT_TIMESTAMP ELSE orders.packed_at END,
+	shipped_at = CASE WHEN in_to_fulfillment = 'shipped' AND in_from_fulfillment <> 'shipped'
+	    THEN CURRENT_TIMESTAMP ELSE orders.shipped_at END,
+	delivered_at = CASE WHEN in_to_fulfillment = 'delivered' AND in_from_fulfillment <> 'delivered'
+	    THEN CURRENT_TIMESTAMP ELSE orders.delivered_at END,
+	updated_at = CURRENT_TIMESTAMP
+    WHERE orders.id = in_order_id
+	AND COALESCE(orders.status, 'PENDING') = in_from_status
+	AND orders.fulfillment_status = in_from_fulfillment;
+
+    IF NOT FOUND THEN
+	RAISE EXCEPTION 'order state changed, try again.';
+    END IF;
+
+    -- a full refund puts back what never left the warehouse, restocking it
+    -- lets the back in stock trigger tell the subscribers.
+    IF in_to_status = 'REFUNDED' AND in_from_status <> 'REFUNDED' THEN
+	PERFORM restock(ARRAY(
+	    SELECT ROW(oi.sku, oi.quantity - COALESCE(shipped.quantity, 0))::items
+	    FROM order_items AS oi
+	    LEFT JOIN (
+		SELECT si.order_item_id, SUM(si.quantity)::INT AS quantity
+		FROM shipment_items AS si
+		GROUP BY si.order_item_id
+	    ) AS shipped ON shipped.order_item_id = oi.id
+	    WHERE oi.order_id = in_order_id
+		AND oi.quantity - COALESCE(shipped.quantity, 0) > 0
+	));
+    END IF;
+
+    PERFORM record_order_event(in_order_id, in_from_status, in_to_status,
+	in_from_fulfillment, in_to_fulfillment, in_actor, in_reason);
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION create_shipment(
+    in_order_id INT,
+    in_carrier VARCHAR,
+    in_tracking_number VARCHAR,
+    in_items items[],
+    in_actor VARCHAR
+) RETURNS TABLE (
+    shipment_id INT
+) AS $$
+DECLARE
+    payment_var order_status;
+    status_var fulfillment_status;
+    to_status_var fulfillment_status;
+    item_var items;
+    order_item_var order_items;
+    shipped_var INT;
+    pending_var INT;
+BEGIN
+    SELECT COALESCE(orders.status, 'PENDING'), orders.fulfillment_status
+    INTO payment_var, status_var
+    FROM orders
+    WHERE orders.id = in_order_id
+    FOR UPDATE;
+
+    IF NOT FOUND THEN
+	RAISE EXCEPTION 'order does not exist.';
+    END IF;
+
+    -- partially shipped and shipped are reachable from the same states, the
+    -- pending items decide between them below.
+    PERFORM check_order_transition(payment_var, payment_var,
+	status_var, 'partially_shipped');
+
+    IF CARDINALITY(in_items) = 0 THEN
+	RAISE EXCEPTION 'shipment has no items.';
+    END IF;
+
+    INSERT INTO shipments(order_id, carrier, tracking_number)
+    VALUES (in_order_id, in_carrier, in_tracking_number)
+    RETURNING id INTO shipment_id;
+
+    FOREACH item_var IN ARRAY in_items
+    LOOP
+	IF item_var.quantity <= 0 THEN
+	    RAISE EXCEPTION 'item quantity cant be equals or below zero.';
+	END IF;
+
+	SELECT *
+	INTO order_item_var
+	FROM order_items
+	WHERE order_items.order_id = in_order_id AND order_items.sku = item_var.sku
+	LIMIT 1;
+
+	IF NOT FOUND THEN
+	    RAISE EXCEPTION 'item is not part of the order.';
+	END IF;
+
+	SELECT COALESCE(SUM(si.quantity), 0)
+	INTO shipped_var
+	FROM shipment_items AS si
+	WHERE si.order_item_id = order_item_var.id;
+
+	IF shipped_var + item_var.quantity > order_item_var.quantity THEN
+	    RAISE EXCEPTION 'item quantity overpass the ordered quantity.';
+	END IF;
+
+	INSERT INTO shipment_items(shipment_id, order_item_id, quantity)
+	VALUES (shipment_id, order_item_var.id, item_var.quantity);
+    END LOOP;
+
+    SELECT COALESCE(SUM(oi.quantity - COALESCE(s.shipped, 0)), 0)
+    INTO pending_var
+    FROM order_items AS oi
+    LEFT JOIN (
+	SELECT si.order_item_id, SUM(si.quantity) AS shipped
+	FROM shipment_items AS si
+	GROUP BY si.order_item_id
+    ) AS s ON s.order_item_id = oi.id
+    WHERE oi.order_id = in_order_id;
+
+    to_status_var := CASE WHEN pending_var > 0
+	THEN 'partially_shipped'::fulfillment_status
+	ELSE 'shipped'::fulfillment_status END;
+
+    UPDATE orders
+    SET fulfillment_status = to_status_var,
+	shipped_at = CASE WHEN pending_var > 0 THEN NULL ELSE CURRENT_TIMESTAMP END,
+	updated_at = CURRENT_TIMESTAMP
+    WHERE id = in_order_id;
+
+    PERFORM record_order_event(in_order_id, payment_var, payment_var,
+	status_var, to_status_var, in_actor,
+	'shipped with ' || in_carrier || ', tracking ' || in_tracking_number);
+
+    RETURN QUERY
+    SELECT shipment_id;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION deliver_shipment(
+    in_order_id INT,
+    in_shipment_id INT,
+    in_actor VARCHAR
+) RETURNS VOID AS $$
+DECLARE
+    payment_var order_status;
+    status_var fulfillment_status;
+BEGIN
+    SELECT COALESCE(orders.status, 'PENDING'), orders.fulfillment_status
+    INTO payment_var, status_var
+    FROM orders
+    WHERE orders.id = in_order_id
+    FOR UPDATE;
+
+    IF NOT FOUND THEN
+	RAISE EXCEPTION 'order does not exist.';
+    END IF;
+
+    UPDATE shipments
+    SET delivered_at = CURRENT_TIMESTAMP
+    WHERE id = in_shipment_id AND order_id = in_order_id AND delivered_at IS NULL;
+
+    IF NOT FOUND THEN
+	RAISE EXCEPTION 'shipment does not exist or was already delivered.';
+    END IF;
 
+    IF status_var = 'shipped' AND NOT EXISTS (
+	SELECT 1 FROM shipments
+	WHERE shipments.order_id = in_order_id AND shipments.delivered_at IS NULL
+    ) THEN
+	PERFORM check_order_transition(payment_var, payment_var, 'shipped', 'delivered');
+
+	UPDATE orders
+	SET fulfillment_status = 'delivered', delivered_at = CURRENT_TIMESTAMP,
+	    updated_at = CURRENT_TIMESTAMP
+	WHERE id = in_order_id;
+
+	PERFORM record_order_event(in_order_id, payment_var, payment_var,
+	    'shipped', 'delivered', in_actor, 'all shipments delivered');
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION shipping_rate(
+    in_method shipping_methods,
+    in_weight DECIMAL,
+    in_item_total DECIMAL
+) RETURNS DECIMAL AS $$
+DECLARE
+    value_var DECIMAL := in_item_total;
+BEGIN
+    IF in_method.rate_kind = 'flat' THEN
+	RETURN in_method.flat_rate;
+    END IF;
+
+    IF in_method.rate_kind = 'weight' THEN
+	value_var := in_weight;
+    END IF;
+
+    RETURN (
+	SELECT t.rate
+	FROM shipping_rate_tiers AS t
+	WHERE t.method_id = in_method.id AND t.min_value <= value_var
+	ORDER BY t.min_value DESC
+	LIMIT 1
+    );
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION shipping_options(
+    in_items items[],
+    in_currency currency,
+    in_address address
+) RETURNS TABLE (
+    method_id INT,
+    method_name VARCHAR,
+    zone_name VARCHAR,
+    rate DECIMAL,
+    min_days INT,
+    max_days INT
+) AS $$
+DECLARE
+    weight_var DECIMAL;
+    item_total_var DECIMAL;
+BEGIN
+    SELECT COALESCE(SUM(c.weight * i.quantity), 0),
+	COALESCE(SUM(current_price(c) * i.quantity), 0)
+    INTO weight_var, item_total_var
+    FROM UNNEST(in_items) AS i
+    JOIN combinations AS c ON c.sku = i.sku;
+
+    RETURN QUERY
+    SELECT sm.id, sm.name, sz.name, r.rate, sm.min_days, sm.max_days
+    FROM shipping_methods AS sm
+    JOIN shipping_zones AS sz ON sz.id = sm.zone_id
+    CROSS JOIN LATERAL (SELECT shipping_rate(sm, weight_var, item_total_var) AS rate) AS r
+    WHERE sm.active AND sz.active
+	AND sm.currency = in_currency
+	AND (CARDINALITY(sz.countries) = 0 OR UPPER(in_address.country_code) = ANY(sz.countries))
+	AND (CARDINALITY(sz.regions) = 0 OR in_address.admin_area_1 = ANY(sz.regions))
+	AND r.rate IS NOT NULL
+    ORDER BY CARDINALITY(sz.countries) = 0, r.rate, sm.id;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION quote_items(
+    in_items items[],
+    in_user_id INT,
+    in_currency currency,
+    in_coupon_code VARCHAR,
+    in_shipping_method_id INT,
+    in_address address
+) RETURNS TABLE (
+    item_total DECIMAL,
+    promotion_discount DECIMAL,
+    promotions TEXT[],
+    discount DECIMAL,
+    free_shipping BOOLEAN,
+    shipping_total DECIMAL,
+    shipping_method_id INT,
+    shipping_method VARCHAR,
+    shipping_error TEXT,
+    tax_total DECIMAL,
+    tax_included DECIMAL,
+    tax_lines line_tax[],
+    total DECIMAL,
+    coupon_code VARCHAR,
+    coupon_error TEXT
+) AS $$
+DECLARE
+    coupon_var coupons;
+    eligible_total_var DECIMAL := 0;
+    net_ratio_var DECIMAL := 1;
+    uses_var INT;
+BEGIN
+    discount := 0;
+    free_shipping := FALSE;
+    shipping_total := 0;
+    shipping_method_id := NULL;
+    shipping_method := '';
+    shipping_error := '';
+    coupon_code := '';
+    coupon_error := '';
+
+    SELECT COALESCE(SUM(current_price(combinations) * i.quantity), 0)
+    INTO item_total
+    FROM UNNEST(in_items) AS i
+    JOIN combinations ON combinations.sku = i.sku;
+
+    SELECT pd.discount, pd.promotion_names
+    INTO promotion_discount, promotions
+    FROM promotions_discount(in_items, in_currency) AS pd;
+
+    IF LENGTH(COALESCE(in_coupon_code, '')) > 0 THEN
+	SELECT *
+	INTO coupon_var
+	FROM coupons
+	WHERE coupons.code = UPPER(TRIM(in_coupon_code))
+	LIMIT 1;
+
+	IF NOT FOUND OR NOT coupon_var.active THEN
+	    coupon_error := 'coupon does not exist';
+	ELSIF coupon_var.starts_at IS NOT NULL AND coupon_var.starts_at > CURRENT_TIMESTAMP THEN
+	    coupon_error := 'coupon is not active yet';
+	ELSIF coupon_var.ends_at IS NOT NULL AND coupon_var.ends_at <= CURRENT_TIMESTAMP THEN
+	    coupon_error := 'coupon has expired';
+	ELSIF coupon_var.kind = 'fixed_amount' AND coupon_var.currency <> in_currency THEN
+	    coupon_error := FORMAT('coupon is only valid for %s', coupon_var.currency);
+	ELSIF item_total < coupon_var.min_spend THEN
+	    coupon_error := FORMAT('coupon needs a minimum spend of %s', ROUND(coupon_var.min_spend, 2));
+	END IF;
+
+	IF coupon_error = '' AND coupon_var.usage_limit IS NOT NULL THEN
+	    SELECT COUNT(*)
+	    INTO uses_var
+	    FROM coupon_redemptions
+	    WHERE coupon_id = coupon_var.id;
+
+	    IF uses_var >= coupon_var.usage_limit THEN
+		coupon_error := 'coupon has reached its usage limit';
+	    END IF;
+	END IF;
+
+	IF coupon_error = '' AND coupon_var.per_user_limit IS NOT NULL THEN
+	    SELECT COUNT(*)
+	    INTO uses_var
+	    FROM coupon_redemptions
+	    WHERE coupon_id = coupon_var.id AND user_id = in_user_id;
+
+	    IF uses_var >= coupon_var.per_user_limit THEN
+		coupon_error := 'you already used this coupon';
+	    END IF;
+	END IF;
+
+	IF coupon_error = '' THEN
+	    SELECT COALESCE(SUM(current_price(combinations) * i.quantity), 0)
+	    INTO eligible_total_var
+	    FROM UNNEST(in_items) AS i
+	    JOIN combinations ON combinations.sku = i.sku
+	    JOIN products ON products.id = combinations.product_id
+	    WHERE (CARDINALITY(coupon_var.skus) = 0 OR combinations.sku = ANY(coupon_var.skus))
+		AND (CARDINALITY(coupon_var.categories) = 0 OR products.category = ANY(coupon_var.categories));
+
+	    IF eligible_total_var <= 0 THEN
+		coupon_error := 'coupon does not apply to these products';
+	    END IF;
+	END IF;
+
+	IF coupon_error = '' THEN
+	    coupon_code := coupon_var.code;
+	    CASE coupon_var.kind
+		WHEN 'percentage' THEN
+		    discount := ROUND(eligible_total_var * coupon_var.value / 100, 2);
+		WHEN 'fixed_amount' THEN
+		    discount := LEAST(coupon_var.value, eligible_total_var);
+		WHEN 'free_shipping' THEN
+		    free_shipping := TRUE;
+	    END CASE;
+	END IF;
+    END IF;
+
+    IF in_address IS NULL OR in_address.country_code IS NULL THEN
+	shipping_error := 'select a shipping address';
+    ELSIF COALESCE(in_shipping_method_id, 0) <= 0 THEN
+	shipping_error := 'select a shipping method';
+    ELSE
+	SELECT so.method_id, so.method_name, so.rate
+	INTO shipping_method_id, shipping_method, shipping_total
+	FROM shipping_options(in_items, in_currency, in_address) AS so
+	WHERE so.method_id = in_shipping_method_id;
+
+	IF NOT FOUND THEN
+	    shipping_total := 0;
+	    shipping_method := '';
+	    shipping_error := 'shipping method is not available for this address';
+	ELSIF free_shipping THEN
+	    shipping_total := 0;
+	END IF;
+    END IF;
+
+    discount := LEAST(discount, item_total - promotion_discount);
+
+    IF item_total > 0 THEN
+	net_ratio_var := (item_total - promotion_discount - discount) / item_total;
+    END IF;
+
+    SELECT COALESCE(array_agg(lt), '{}'),
+	COALESCE(SUM(lt.tax_amount) FILTER (WHERE NOT lt.tax_inclusive), 0),
+	COALESCE(SUM(lt.tax_amount) FILTER (WHERE lt.tax_inclusive), 0)
+    INTO tax_lines, tax_total, tax_included
+    FROM line_taxes(in_items, in_address, net_ratio_var) AS lt;
+
+    total := item_total - promotion_discount - discount + shipping_total + tax_total;
+
+    RETURN QUERY
+    SELECT item_total, promotion_discount, promotions, discount, free_shipping,
+	shipping_total, shipping_method_id, shipping_method, shipping_error,
+	tax_total, tax_included, tax_lines, total, coupon_code, coupon_error;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION save_address(
+    in_user_id INT,
+    in_address address,
+    in_is_default BOOLEAN
+) RETURNS TABLE (
+    address_id INT
+) AS $$
+DECLARE
+    is_default_var BOOLEAN := in_is_default;
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM addresses WHERE user_id = in_user_id) THEN
+	is_default_var := TRUE;
+    END IF;
+
+    IF is_default_var THEN
+	UPDATE addresses
+	SET is_default = FALSE
+	WHERE user_id = in_user_id AND is_default;
+    END IF;
+
+    INSERT INTO addresses(user_id, full_name, address_line_1, address_line_2,
+	admin_area_2, admin_area_1, postal_code, country_code, is_default)
+    VALUES (in_user_id, in_address.full_name, in_address.address_line_1,
+	COALESCE(in_address.address_line_2, ''), in_address.admin_area_2,
+	COALESCE(in_address.admin_area_1, ''), COALESCE(in_address.postal_code, ''),
+	UPPER(in_address.country_code), is_default_var)
+    RETURNING id INTO address_id;
+
+    RETURN QUERY
+    SELECT address_id;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION delete_address(
+    in_user_id INT,
+    in_address_id INT
+) RETURNS VOID AS $$
+DECLARE
+    was_default_var BOOLEAN;
+BEGIN
+    DELETE FROM addresses
+    WHERE id = in_address_id AND user_id = in_user_id
+    RETURNING is_default INTO was_default_var;
+
+    IF NOT FOUND THEN
+	RAISE EXCEPTION 'address does not exist.';
+    END IF;
+
+    IF was_default_var THEN
+	UPDATE addresses
+	SET is_default = TRUE
+	WHERE id = (
+	    SELECT id FROM addresses
+	    WHERE user_id = in_user_id
+	    ORDER BY created_at DESC
+	    LIMIT 1
+	);
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION restock(
+    in_items items[]
+) RETURNS VOID AS $$
+DECLARE
+    item_var items;
+BEGIN
+    FOREACH item_var IN ARRAY in_items
+    LOOP
+	IF item_var.quantity <= 0 THEN
+	    RAISE EXCEPTION 'item quantity cant be equals or below zero.';
+	END IF;
+
+	UPDATE combinations
+	SET stock = stock + item_var.quantity
+	WHERE sku = item_var.sku;
+    END LOOP;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION subscribe_back_in_stock(
+    in_sku VARCHAR,
+    in_user_id INT,
+    in_email VARCHAR
+) RETURNS VOID AS $$
+DECLARE
+    stock_var INT;
+BEGIN
+    SELECT stock
+    INTO stock_var
+    FROM combinations
+    WHERE sku = in_sku
+    LIMIT 1;
+
+    IF NOT FOUND THEN
+	RAISE EXCEPTION 'item does not exist.';
+    END IF;
+
+    IF stock_var > 0 THEN
+	RAISE EXCEPTION 'item is in stock.';
+    END IF;
+
+    INSERT INTO stock_subscriptions(sku, user_id, email)
+    VALUES (in_sku, in_user_id, in_email)
+    ON CONFLICT (sku, email) DO UPDATE
+    SET restocked_at = NULL, notified_at = NULL,
+	user_id = COALESCE(EXCLUDED.user_id, stock_subscriptions.user_id)
+    WHERE stock_subscriptions.notified_at IS NOT NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION flag_back_in_stock() RETURNS TRIGGER AS $$
+BEGIN
+    IF COALESCE(OLD.stock, 0) <= 0 AND NEW.stock > 0 THEN
+	UPDATE stock_subscriptions
+	SET restocked_at = CURRENT_TIMESTAMP
+	WHERE sku = NEW.sku AND restocked_at IS NULL AND notified_at IS NULL;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER combinations_back_in_stock
+AFTER UPDATE OF stock ON combinations
+FOR EACH ROW EXECUTE FUNCTION flag_back_in_stock();
+
+CREATE OR REPLACE FUNCTION claim_back_in_stock(
+    in_limit INT
+) RETURNS TABLE (
+    id INT,
+    sku VARCHAR,
+    user_id INT,
+    email VARCHAR,
+    product_name VARCHAR,
+    created_at TIMESTAMPTZ
+) AS $$
+BEGIN
+    RETURN QUERY
+    WITH claimed AS (
+	UPDATE stock_subscriptions AS ss
+	SET notified_at = CURRENT_TIMESTAMP
+	WHERE ss.id IN (
+	    SELECT s.id
+	    FROM stock_subscriptions AS s
+	    WHERE s.restocked_at IS NOT NULL AND s.notified_at IS NULL
+	    ORDER BY s.restocked_at
+	    LIMIT in_limit
+	    FOR UPDATE SKIP LOCKED
+	)
+	RETURNING ss.id, ss.sku, ss.user_id, ss.email, ss.created_at
+    )
+    SELECT claimed.id, claimed.sku, claimed.user_id, claimed.email,
+	products.name, claimed.created_at
+    FROM claimed
+    JOIN combinations ON combinations.sku = claimed.sku
+    JOIN products ON products.id = combinations.product_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- claim_emails leases the due emails for a few minutes, an email whose sender
+-- crashed before reporting back is claimed again once the lease runs out.
+CREATE OR REPLACE FUNCTION claim_emails(
+    in_limit INT
+) RETURNS TABLE (
+    id INT,
+    recipient VARCHAR,
+    subject VARCHAR,
+    html_body TEXT,
+    text_body TEXT,
+    attempts INT,
+    created_at TIMESTAMPTZ
+) AS $$
+BEGIN
+    RETURN QUERY
+    WITH claimed AS (
+	UPDATE email_outbox AS eo
+	SET attempts = eo.attempts + 1,
+	    locked_until = CURRENT_TIMESTAMP + INTERVAL '5 minutes'
+	WHERE eo.id IN (
+	    SELECT e.id
+	    FROM email_outbox AS e
+	    WHERE e.sent_at IS NULL AND e.failed_at IS NULL
+		AND e.send_after <= CURRENT_TIMESTAMP
+		AND (e.locked_until IS NULL OR e.locked_until < CURRENT_TIMESTAMP)
+	    ORDER BY e.send_after
+	    LIMIT in_limit
+	    FOR UPDATE SKIP LOCKED
+	)
+	RETURNING eo.id, eo.recipient, eo.subject, eo.html_body, eo.text_body,
+	    eo.attempts, eo.created_at
+    )
+    SELECT claimed.id, claimed.recipient, claimed.subject, claimed.html_body,
+	claimed.text_body, claimed.attempts, claimed.created_at
+    FROM claimed;
+END;
+$$ LANGUAGE plpgsql;
+
+-- fail_email retries with an exponential backoff until max attempts.
+CREATE OR REPLACE FUNCTION fail_email(
+    in_id INT,
+    in_error TEXT,
+    in_max_attempts INT
+) RETURNS VOID AS $$
+BEGIN
+    UPDATE email_outbox
+    SET last_error = in_error,
+	locked_until = NULL,
+	send_after = CURRENT_TIMESTAMP + INTERVAL '1 minute' * POWER(2, email_outbox.attempts),
+	failed_at = CASE WHEN email_outbox.attempts >= in_max_attempts
+	    THEN CURRENT_TIMESTAMP ELSE NULL END
+    WHERE email_outbox.id = in_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- claim_jobs leases due jobs for in_lease_seconds, jobs of a worker that died
+-- mid run are picked up again when the lease expires.
+CREATE OR REPLACE FUNCTION claim_jobs(
+    in_limit INT,
+    in_lease_seconds INT
+) RETURNS TABLE (
+    id INT,
+    kind VARCHAR,
+    payload JSONB,
+    attempts INT,
+    max_attempts INT,
+    created_at TIMESTAMPTZ
+) AS $$
+BEGIN
+    RETURN QUERY
+    WITH claimed AS (
+	UPDATE jobs AS j
+	SET attempts = j.attempts + 1,
+	    locked_until = CURRENT_TIMESTAMP + make_interval(secs => in_lease_seconds)
+	WHERE j.id IN (
+	    SELECT due.id
+	    FROM jobs AS due
+	    WHERE due.run_at <= CURRENT_TIMESTAMP
+		AND (due.locked_until IS NULL OR due.locked_until < CURRENT_TIMESTAMP)
+	    ORDER BY due.run_at
+	    LIMIT in_limit
+	    FOR UPDATE SKIP LOCKED
+	)
+	RETURNING j.id, j.kind, j.payload, j.attempts, j.max_attempts, j.created_at
+    )
+    SELECT claimed.id, claimed.kind, claimed.payload, claimed.attempts,
+	claimed.max_attempts, claimed.created_at
+    FROM claimed;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION bury_job(
+    in_id INT,
+    in_error TEXT
+) RETURNS VOID AS $$
+BEGIN
+    WITH moved AS (
+	DELETE FROM jobs
+	WHERE jobs.id = in_id
+	RETURNING jobs.id, jobs.kind, jobs.payload, jobs.attempts, jobs.created_at
+    )
+    INSERT INTO dead_jobs(id, kind, payload, attempts, last_error, created_at)
+    SELECT moved.id, moved.kind, moved.payload, moved.attempts, in_error, moved.created_at
+    FROM moved;
+END;
+$$ LANGUAGE plpgsql;
+
+-- complete_stock_job takes the stock of a job and deletes the job in one
+-- transaction, a job run again after its lease ran out finds nothing to do.
+CREATE OR REPLACE FUNCTION complete_stock_job(
+    in_job_id INT,
+    in_items items[]
+) RETURNS VOID AS $$
+BEGIN
+    DELETE FROM jobs
+    WHERE jobs.id = in_job_id;
+
+    IF NOT FOUND THEN
+	RETURN;
+    END IF;
+
+    PERFORM update_stock(in_items);
+END;
+$$ LANGUAGE plpgsql;
+
+-- get_session returns the user of a live session. The expiry slides on use,
+-- last_seen_at is only written once a minute to keep reads cheap.
+CREATE OR REPLACE FUNCTION get_session(
+    in_token_hash BYTEA,
+    in_max_age_seconds INT
+) RETURNS TABLE (
+    session_id INT,
+    user_id INT,
+    name VARCHAR,
+    email VARCHAR,
+    created_at TIMESTAMPTZ,
+    cart_id INT,
+    favorites_id INT,
+    is_admin BOOLEAN,
+    provider VARCHAR,
+    avatar_url TEXT,
+    mfa_pending BOOLEAN,
+    mfa_verified_at TIMESTAMPTZ,
+    locale VARCHAR,
+    currency currency
+) AS $$
+BEGIN
+    UPDATE sessions AS s
+    SET last_seen_at = CURRENT_TIMESTAMP,
+	expires_at = CURRENT_TIMESTAMP + make_interval(secs => in_max_age_seconds)
+    WHERE s.token_hash = in_token_hash
+	AND s.revoked_at IS NULL
+	AND s.expires_at > CURRENT_TIMESTAMP
+	AND s.last_seen_at < CURRENT_TIMESTAMP - INTERVAL '1 minute';
+
+    RETURN QUERY
+    SELECT s.id, u.id, u.name, u.email, u.created_at,
+	(SELECT c.id FROM carts AS c WHERE c.user_id = u.id LIMIT 1),
+	(SELECT f.id FROM favorites AS f WHERE f.user_id = u.id LIMIT 1),
+	s.is_admin, s.provider, COALESCE(u.avatar_url, s.avatar_url)::TEXT, s.mfa_pending, s.mfa_verified_at,
+	u.locale, u.currency
+    FROM sessions AS s
+    JOIN users AS u ON u.id = s.user_id
+    WHERE s.token_hash = in_token_hash
+	AND s.revoked_at IS NULL
+	AND s.expires_at > CURRENT_TIMESTAMP;
+END;
+$$ LANGUAGE plpgsql;
+
+-- link_identity returns the user behind a provider identity. A new identity
+-- joins the user with the same email, only when the provider verified it,
+-- or creates the user on its first login.
+CREATE OR REPLACE FUNCTION link_identity(
+    in_provider VARCHAR,
+    in_subject VARCHAR,
+    in_email VARCHAR,
+    in_email_verified BOOLEAN,
+    in_name VARCHAR
+) RETURNS TABLE (
+    out_user_id INT,
+    out_name VARCHAR,
+    out_email VARCHAR,
+    out_created_at TIMESTAMPTZ,
+    out_cart_id INT,
+    out_favorites_id INT
+) AS $$
+DECLARE
+    found_user_id INT;
+BEGIN
+    SELECT ui.user_id
+    INTO found_user_id
+    FROM user_identities AS ui
+    WHERE ui.provider = in_provider AND ui.subject = in_subject;
+
+    IF found_user_id IS NULL THEN
+	IF NOT in_email_verified THEN
+	    RAISE EXCEPTION 'identity email is not verified';
+	END IF;
+
+	SELECT u.id
+	INTO found_user_id
+	FROM users AS u
+	WHERE lower(u.email) = lower(in_email)
+	LIMIT 1;
+
+	IF found_user_id IS NULL THEN
+	    SELECT cu.user_id
+	    INTO found_user_id
+	    FROM create_user(in_name, in_email) AS cu;
+	END IF;
+
+	INSERT INTO user_identities(user_id, provider, subject, email)
+	VALUES (found_user_id, in_provider, in_subject, in_email);
+    ELSE
+	UPDATE user_identities AS ui
+	SET last_login_at = CURRENT_TIMESTAMP, email = in_email
+	WHERE ui.provider = in_provider AND ui.subject = in_subject;
+    END IF;
+
+    RETURN QUERY
+    SELECT g.out_user_id, g.name, g.email, g.created_at, g.cart_id, g.favorites_id
+    FROM get_core_user_data(found_user_id, NULL) AS g;
+END;
+$$ LANGUAGE plpgsql;
+
+-- create_magic_link stores a login link unless the email or the ip address
+-- already asked for too many within the window. The advisory lock on the
+-- email makes concurrent requests for the same address count each other.
+CREATE OR REPLACE FUNCTION create_magic_link(
+    in_token_hash BYTEA,
+    in_email VARCHAR,
+    in_ip_address VARCHAR,
+    in_ttl_seconds INT,
+    in_max_per_email INT,
+    in_max_per_ip INT,
+    in_window_seconds INT
+) RETURNS INT AS $$
+DECLARE
+    link_id INT;
+    since TIMESTAMPTZ := CURRENT_TIMESTAMP - make_interval(secs => in_window_seconds);
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('magic_link:' || lower(in_email)));
+
+    IF (SELECT count(*) FROM magic_links AS ml
+	WHERE lower(ml.email) = lower(in_email) AND ml.created_at > since) >= in_max_per_email
+	OR (SELECT count(*) FROM magic_links AS ml
+	WHERE ml.ip_address = in_ip_address AND ml.created_at > since) >= in_max_per_ip THEN
+	RAISE EXCEPTION 'too many magic links requested';
+    END IF;
+
+    INSERT INTO magic_links(token_hash, email, ip_address, expires_at)
+    VALUES (in_token_hash, in_email, in_ip_address, CURRENT_TIMESTAMP + make_interval(secs => in_ttl_seconds))
+    RETURNING id INTO link_id;
+
+    RETURN link_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- enable_totp turns on the enrolled secret once the user proved it works,
+-- the recovery codes of an earlier enrollment are replaced.
+CREATE OR REPLACE FUNCTION enable_totp(
+    in_user_id INT,
+    in_step BIGINT,
+    in_code_hashes BYTEA[]
+) RETURNS VOID AS $$
+BEGIN
+    UPDATE user_totp AS t
+    SET enabled_at = CURRENT_TIMESTAMP, last_step = in_step
+    WHERE t.user_id = in_user_id AND t.enabled_at IS NULL;
+
+    IF NOT FOUND THEN
+	RAISE EXCEPTION 'totp is not being enrolled';
+    END IF;
+
+    DELETE FROM recovery_codes AS rc WHERE rc.user_id = in_user_id;
+
+    INSERT INTO recovery_codes(user_id, code_hash)
+    SELECT in_user_id, code_hash
+    FROM unnest(in_code_hashes) AS code_hash;
+END;
+$$ LANGUAGE plpgsql;
+
+-- grant_role gives the role to the user of the email and audits it, a
+-- role the user already has is left as is.
+CREATE OR REPLACE FUNCTION grant_role(
+    in_email VARCHAR,
+    in_role VARCHAR,
+    in_actor VARCHAR
+) RETURNS VOID AS $$
+DECLARE
+    found_user_id INT;
+    found_role_id INT;
+BEGIN
+    SELECT u.id INTO found_user_id FROM users AS u WHERE lower(u.email) = lower(in_email);
+    IF found_user_id IS NULL THEN
+	RAISE EXCEPTION 'user for role not found';
+    END IF;
+    SELECT r.id INTO found_role_id FROM roles AS r WHERE r.name = in_role;
+    IF found_role_id IS NULL THEN
+	RAISE EXCEPTION 'role not found';
+    END IF;
+
+    INSERT INTO user_roles(user_id, role_id, granted_by)
+    VALUES (found_user_id, found_role_id, in_actor)
+    ON CONFLICT DO NOTHING;
+
+    IF FOUND THEN
+	INSERT INTO role_events(user_id, email, role, action, actor)
+	VALUES (found_user_id, in_email, in_role, 'grant', in_actor);
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+-- seed_owners makes owner the listed emails that have an account and no
+-- role history, once granted or revoked the roles are left to the admins.
+CREATE OR REPLACE FUNCTION seed_owners(
+    in_emails VARCHAR[],
+    in_actor VARCHAR
+) RETURNS INT AS $$
+DECLARE
+    seed_var RECORD;
+    seeded_var INT := 0;
+BEGIN
+    FOR seed_var IN
+	SELECT u.id, u.email
+	FROM users AS u
+	WHERE lower(u.email) IN (SELECT lower(e) FROM UNNEST(in_emails) AS e)
+	    AND NOT EXISTS (
+		SELECT 1
+		FROM role_events AS re
+		WHERE re.user_id = u.id
+	    )
+    LOOP
+	PERFORM grant_role(seed_var.email, 'owner', in_actor);
+	seeded_var := seeded_var + 1;
+    END LOOP;
+    RETURN seeded_var;
+END;
+$$ LANGUAGE plpgsql;
+
+-- revoke_role takes the role back and audits it, the last owner is kept so
+-- the shop is never left without someone to manage access.
+CREATE OR REPLACE FUNCTION revoke_role(
+    in_user_id INT,
+    in_role VARCHAR,
+    in_actor VARCHAR
+) RETURNS VOID AS $$
+DECLARE
+    found_role_id INT;
+    found_email VARCHAR;
+BEGIN
+    SELECT r.id INTO found_role_id FROM roles AS r WHERE r.name = in_role FOR UPDATE;
+    IF found_role_id IS NULL THEN
+	RAISE EXCEPTION 'role not found';
+    END IF;
+
+    IF in_role = 'owner' AND (SELECT count(*) FROM user_roles AS ur WHERE ur.role_id = found_role_id) <= 1 THEN
+	RAISE EXCEPTION 'cant revoke the last owner';
+    END IF;
+
+    DELETE FROM user_roles AS ur
+    WHERE ur.user_id = in_user_id AND ur.role_id = found_role_id;
+
+    IF NOT FOUND THEN
+	RAISE EXCEPTION 'user doesnt have the role';
+    END IF;
+
+    SELECT u.email INTO found_email FROM users AS u WHERE u.id = in_user_id;
+    INSERT INTO role_events(user_id, email, role, action, actor)
+    VALUES (in_user_id, coalesce(found_email, ''), in_role, 'revoke', in_actor);
+END;
+$$ LANGUAGE plpgsql;
+
+-- take_rate_token refills the bucket of the key for the time it sat unused
+-- and spends a token of it. It returns the seconds until the next token when
+-- the bucket is empty, zero when the token was taken.
+CREATE OR REPLACE FUNCTION take_rate_token(
+    in_key VARCHAR,
+    in_per_minute INT,
+    in_burst INT
+) RETURNS DOUBLE PRECISION AS $$
+DECLARE
+    per_second DOUBLE PRECISION := in_per_minute / 60.0;
+    found_tokens DOUBLE PRECISION;
+BEGIN
+    INSERT INTO rate_limits(key, tokens) VALUES (in_key, in_burst)
+    ON CONFLICT (key) DO NOTHING;
+
+    SELECT LEAST(in_burst, rl.tokens + EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - rl.updated_at) * per_second)
+    INTO found_tokens
+    FROM rate_limits AS rl
+    WHERE rl.key = in_key
+    FOR UPDATE;
+
+    IF found_tokens >= 1 THEN
+	UPDATE rate_limits AS rl SET tokens = found_tokens - 1, updated_at = CURRENT_TIMESTAMP WHERE rl.key = in_key;
+	RETURN 0;
+    END IF;
+
+    UPDATE rate_limits AS rl SET tokens = found_tokens, updated_at = CURRENT_TIMESTAMP WHERE rl.key = in_key;
+    RETURN (1 - found_tokens) / per_second;
+END;
+$$ LANGUAGE plpgsql;
+
+-- request_email_change keeps one pending change per user, asking again
+-- replaces the link sent before.
+CREATE OR REPLACE FUNCTION request_email_change(
+    in_user_id INT,
+    in_email VARCHAR,
+    in_token_hash BYTEA,
+    in_ttl_seconds INT
+) RETURNS VOID AS $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM users AS u WHERE lower(u.email) = lower(in_email)) THEN
+	RAISE EXCEPTION 'email already in use';
+    END IF;
+
+    DELETE FROM email_changes AS ec WHERE ec.user_id = in_user_id AND ec.used_at IS NULL;
+
+    INSERT INTO email_changes(user_id, email, token_hash, expires_at)
+    VALUES (in_user_id, in_email, in_token_hash, CURRENT_TIMESTAMP + make_interval(secs => in_ttl_seconds));
+END;
+$$ LANGUAGE plpgsql;
+
+-- confirm_email_change moves the user to the verified email. Logins by link
+-- to the old address stop working since that identity is dropped.
+CREATE OR REPLACE FUNCTION confirm_email_change(
+    in_user_id INT,
+    in_token_hash BYTEA
+) RETURNS TABLE (
+    old_email VARCHAR,
+    new_email VARCHAR
+) AS $$
+DECLARE
+    change_id INT;
+BEGIN
+    SELECT ec.id, ec.email INTO change_id, new_email
+    FROM email_changes AS ec
+    WHERE ec.token_hash = in_token_hash
+	AND ec.user_id = in_user_id
+	AND ec.used_at IS NULL
+	AND ec.expires_at > CURRENT_TIMESTAMP
+    FOR UPDATE;
+    IF NOT FOUND THEN
+	RETURN;
+    END IF;
+
+    IF EXISTS (SELECT 1 FROM users AS u WHERE lower(u.email) = lower(new_email) AND u.id <> in_user_id) THEN
+	RAISE EXCEPTION 'email already in use';
+    END IF;
+
+    SELECT u.email INTO old_email FROM users AS u WHERE u.id = in_user_id FOR UPDATE;
+
+    UPDATE users AS u SET email = new_email WHERE u.id = in_user_id;
+    UPDATE email_changes AS ec SET used_at = CURRENT_TIMESTAMP WHERE ec.id = change_id;
+    DELETE FROM user_identities AS ui WHERE ui.user_id = in_user_id AND ui.provider = 'email';
+
+    RETURN NEXT;
+END;
+$$ LANGUAGE plpgsql;
+
+-- delete_user removes a user and every trace of its email. Orders stay for
+-- the books without the buyer, only the region and country of the address
+-- are kept since taxes were charged for them. The audit of staff roles is
+-- kept as is.
+CREATE OR REPLACE FUNCTION delete_user(
+    in_user_id INT
+) RETURNS VOID AS $$
+DECLARE
+    found_email VARCHAR;
+BEGIN
+    SELECT u.email INTO found_email FROM users AS u WHERE u.id = in_user_id FOR UPDATE;
+    IF NOT FOUND THEN
+	RAISE EXCEPTION 'user to delete not found';
+    END IF;
+
+    IF EXISTS (
+	SELECT 1 FROM user_roles AS ur
+	JOIN roles AS r ON r.id = ur.role_id
+	WHERE ur.user_id = in_user_id AND r.name = 'owner'
+    ) AND (
+	SELECT count(*) FROM user_roles AS ur
+	JOIN roles AS r ON r.id = ur.role_id
+	WHERE r.name = 'owner'
+    ) <= 1 THEN
+	RAISE EXCEPTION 'cant delete the last owner';
+    END IF;
+
+    UPDATE orders AS o
+    SET payer_name = NULL,
+	payer_email = NULL,
+	payer_id = '',
+	shipping_address = CASE WHEN o.shipping_address IS NULL THEN NULL
+	    ELSE ROW('', '', '', '', (o.shipping_address).admin_area_1, '', (o.shipping_address).country_code)::address
+	END,
+	updated_at = CURRENT_TIMESTAMP
+    WHERE o.user_id = in_user_id;
+
+    -- the audit trails keep what happened but not who it was.
+    UPDATE role_events AS re
+    SET email = 'deleted user'
+    WHERE re.user_id = in_user_id OR lower(re.email) = lower(found_email);
+    UPDATE role_events AS re
+    SET actor = 'admin:deleted user'
+    WHERE lower(re.actor) = lower('admin:' || found_email);
+    UPDATE order_events AS oe
+    SET actor = 'admin:deleted user'
+    WHERE lower(oe.actor) = lower('admin:' || found_email);
+
+    DELETE FROM stock_subscriptions AS ss WHERE ss.user_id = in_user_id OR lower(ss.email) = lower(found_email);
+    DELETE FROM magic_links AS ml WHERE lower(ml.email) = lower(found_email);
+    DELETE FROM email_outbox AS eo WHERE lower(eo.recipient) = lower(found_email);
+    DELETE FROM users AS u WHERE u.id = in_user_id;
+END;
+$$ LANGUAGE plpgsql;
+
+
+DROP FUNCTION IF EXISTS check_order_transition(order_status, order_status, fulfillment_status, fulfillment_status);
+DROP FUNCTION IF EXISTS seed_owners(VARCHAR[], VARCHAR);
+DROP FUNCTION IF EXISTS complete_stock_job(INT, items[]);
+DROP FUNCTION IF EXISTS take_rate_token(VARCHAR, INT, INT);
+DROP FUNCTION IF EXISTS confirm_email_change(INT, BYTEA);
+DROP FUNCTION IF EXISTS request_email_change(INT, VARCHAR, BYTEA, INT);
+DROP FUNCTION IF EXISTS delete_user(INT);
+DROP FUNCTION IF EXISTS revoke_role(INT, VARCHAR, VARCHAR);
+DROP FUNCTION IF EXISTS grant_role(VARCHAR, VARCHAR, VARCHAR);
+DROP FUNCTION IF EXISTS enable_totp(INT, BIGINT, BYTEA[]);
+DROP FUNCTION IF EXISTS create_magic_link(BYTEA, VARCHAR, VARCHAR, INT, INT, INT, INT);
+DROP FUNCTION IF EXISTS link_identity(VARCHAR, VARCHAR, VARCHAR, BOOLEAN, VARCHAR);
+DROP FUNCTION IF EXISTS get_session(BYTEA, INT);
+DROP FUNCTION IF EXISTS bury_job(INT, TEXT);
+DROP FUNCTION IF EXISTS claim_jobs(INT, INT);
+DROP FUNCTION IF EXISTS fail_email(INT, TEXT, INT);
+DROP FUNCTION IF EXISTS claim_emails(INT);
+DROP FUNCTION IF EXISTS deliver_shipment(INT, INT, VARCHAR);
+DROP FUNCTION IF EXISTS create_shipment(INT, VARCHAR, VARCHAR, items[], VARCHAR);
+DROP FUNCTION IF EXISTS transition_order(INT, order_status, fulfillment_status, order_status, fulfillment_status, VARCHAR, TEXT);
+DROP FUNCTION IF EXISTS record_order_event(INT, order_status, order_status, fulfillment_status, fulfillment_status, VARCHAR, TEXT);
+DROP FUNCTION IF EXISTS deliver_shipment(INT, INT);
+DROP FUNCTION IF EXISTS create_shipment(INT, VARCHAR, VARCHAR, items[]);
+DROP FUNCTION IF EXISTS pack_order(INT);
+DROP FUNCTION IF EXISTS line_taxes(items[], address, DECIMAL);
+DROP FUNCTION IF EXISTS make_order(payment_provider, INT, items[], DECIMAL, DECIMAL, VARCHAR, TEXT[], address, INT, VARCHAR, DECIMAL, DECIMAL, DECIMAL, DECIMAL, currency, VARCHAR, VARCHAR, VARCHAR, VARCHAR, TEXT[], TEXT[]);
+DROP FUNCTION IF EXISTS quote_items(items[], INT, currency, VARCHAR, INT, address);
+DROP FUNCTION IF EXISTS shipping_options(items[], currency, address);
+DROP FUNCTION IF EXISTS shipping_rate(shipping_methods, DECIMAL, DECIMAL);
+DROP FUNCTION IF EXISTS make_order(payment_provider, INT, items[], DECIMAL, DECIMAL, VARCHAR, TEXT[], address, INT, VARCHAR, DECIMAL, DECIMAL, currency, VARCHAR, VARCHAR, VARCHAR, VARCHAR, TEXT[], TEXT[]);
+DROP FUNCTION IF EXISTS delete_address(INT, INT);
+DROP FUNCTION IF EXISTS save_address(INT, address, BOOLEAN);
+DROP FUNCTION IF EXISTS make_order(payment_provider, INT, items[], DECIMAL, DECIMAL, VARCHAR, TEXT[], address, DECIMAL, currency, VARCHAR, VARCHAR, VARCHAR, VARCHAR, TEXT[], TEXT[]);
+DROP FUNCTION IF EXISTS make_order(payment_provider, INT, items[], DECIMAL, DECIMAL, VARCHAR, TEXT[], DECIMAL, currency, VARCHAR, VARCHAR, VARCHAR, VARCHAR, TEXT[], TEXT[]);
+DROP FUNCTION IF EXISTS cart_balance(INT);
+DROP FUNCTION IF EXISTS promotions_discount(items[], currency);
+DROP FUNCTION IF EXISTS compare_at_price(combinations);
+DROP FUNCTION IF EXISTS current_price(combinations);
+DROP FUNCTION IF EXISTS on_sale(combinations);
+DROP FUNCTION IF EXISTS quote_items(items[], INT, currency, VARCHAR);
+DROP FUNCTION IF EXISTS make_order(payment_provider, INT, items[], DECIMAL, DECIMAL, VARCHAR, DECIMAL, currency, VARCHAR, VARCHAR, VARCHAR, VARCHAR, TEXT[], TEXT[]);
+DROP FUNCTION IF EXISTS make_order(payment_provider, INT, items[], DECIMAL, currency, VARCHAR, VARCHAR, VARCHAR, VARCHAR, TEXT[], TEXT[]);
+DROP TRIGGER IF EXISTS combinations_back_in_stock ON combinations;
+DROP FUNCTION IF EXISTS claim_back_in_stock(INT);
+DROP FUNCTION IF EXISTS flag_back_in_stock();
+DROP FUNCTION IF EXISTS subscribe_back_in_stock(VARCHAR, INT, VARCHAR);
+DROP FUNCTION IF EXISTS restock(items[]);
+DROP FUNCTION IF EXISTS update_cart_count(INT, CHARVAR, INT, INT);
+DROP FUNCTION IF EXISTS count_cart_items(INT);
+DROP FUNCTION IF EXISTS cart_count_items(INT);
+DROP FUNCTION IF EXISTS get_core_user_data(INT, VARCHAR);
+DROP FUNCTION IF EXISTS create_user(VARCHAR, VARCHAR);
+DROP FUNCTION IF EXISTS insert_variants(INT, variant[]);
+DROP FUNCTION IF EXISTS insert_combinations(INT, VARCHAR, combination[]);
+DROP FUNCTION IF EXISTS insert_product(VARCHAR, TEXT, VARCHAR, TEXT[]);
+DROP FUNCTION IF EXISTS get_cart_items(INT);
+DROP FUNCTION IF EXISTS add_to_cart(INT, VARCHAR, INT, INT);
+
+DROP TYPE IF EXISTS combination CASCADE;
+DROP TYPE IF EXISTS variant CASCADE;
+DROP TYPE IF EXISTS option CASCADE;
+DROP TYPE IF EXISTS items CASCADE;
+DROP TYPE IF EXISTS line_tax CASCADE;
+DROP TYPE IF EXISTS address CASCADE;
+DROP TYPE IF EXISTS order_status CASCADE;
+DROP TYPE IF EXISTS currency CASCADE;
+DROP TYPE IF EXISTS payment_provider CASCADE;
+DROP TYPE IF EXISTS fulfillment_status CASCADE;
+DROP TYPE IF EXISTS coupon_kind CASCADE;
+DROP TYPE IF EXISTS promotion_kind CASCADE;
+DROP TYPE IF EXISTS shipping_rate_kind CASCADE;
+
+DROP TABLE IF EXISTS order_events CASCADE;
+DROP TABLE IF EXISTS shipment_items CASCADE;
+DROP TABLE IF EXISTS shipments CASCADE;
+DROP TABLE IF EXISTS order_items CASCADE;
+DROP TABLE IF EXISTS tax_rates CASCADE;
+DROP TABLE IF EXISTS shipping_rate_tiers CASCADE;
+DROP TABLE IF EXISTS shipping_methods CASCADE;
+DROP TABLE IF EXISTS shipping_zones CASCADE;
+DROP TABLE IF EXISTS addresses CASCADE;
+DROP TABLE IF EXISTS promotions CASCADE;
+DROP TABLE IF EXISTS coupon_redemptions CASCADE;
+DROP TABLE IF EXISTS coupons CASCADE;
+DROP TABLE IF EXISTS dead_jobs CASCADE;
+DROP TABLE IF EXISTS jobs CASCADE;
+DROP TABLE IF EXISTS email_outbox CASCADE;
+DROP TABLE IF EXISTS rate_limits CASCADE;
+DROP TABLE IF EXISTS email_changes CASCADE;
+DROP TABLE IF EXISTS magic_links CASCADE;
+DROP TABLE IF EXISTS recovery_codes CASCADE;
+DROP TABLE IF EXISTS user_totp CASCADE;
+DROP TABLE IF EXISTS role_events CASCADE;
+DROP TABLE IF EXISTS user_roles CASCADE;
+DROP TABLE IF EXISTS role_permissions CASCADE;
+DROP TABLE IF EXISTS roles CASCADE;
+DROP TABLE IF EXISTS sessions CASCADE;
+DROP TABLE IF EXISTS user_identities CASCADE;
+DROP TABLE IF EXISTS stock_subscriptions CASCADE;
 DROP TABLE IF EXISTS favorites_items CASCADE;
 DROP TABLE IF EXISTS favorites CASCADE;
 DROP TABLE IF EXISTS cart_items CASCADE;
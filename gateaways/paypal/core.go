@@ -1,10 +1,40 @@
 package paypal
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"shop/config"
+	"shop/handlers"
+	"shop/services/logs"
+	"shop/services/metrics"
+	"shop/services/tracing"
+	"time"
 )
 
+// do sends the request to PayPal recording its latency, answers with an
+// error status count as errors too. The PayPal debug id is logged next to the
+// request id so a failed call can be looked up with PayPal support.
+func do(ctx context.Context, operation string, req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := tracing.Client.Do(req.WithContext(ctx))
+	duration := time.Since(start)
+	metrics.PaypalDuration.WithLabelValues(operation).Observe(duration.Seconds())
+	logger := logs.FromContext(ctx).With("operation", operation, "duration", duration)
+	if err != nil {
+		metrics.PaypalErrors.WithLabelValues(operation).Inc()
+		logger.Error("paypal call failed", "err", err)
+		return resp, handlers.Upstream(err)
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		metrics.PaypalErrors.WithLabelValues(operation).Inc()
+		logger.Error("paypal call answered with an error", "status", resp.StatusCode, "debug_id", resp.Header.Get("Paypal-Debug-Id"))
+		return resp, nil
+	}
+	logger.Debug("paypal call", "status", resp.StatusCode, "debug_id", resp.Header.Get("Paypal-Debug-Id"))
+	return resp, nil
+}
+
 func Init() error {
 	getPaypal = func() *paypal {
 		if pub == nil {
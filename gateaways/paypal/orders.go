@@ -15,10 +15,14 @@ import (
 	"shop/handlers"
 	"shop/handlers/render"
 	"shop/services/auth"
+	"shop/services/jobs"
+	"shop/services/logs"
+	"shop/services/metrics"
 	"shop/services/store"
 	"shop/views/checkout"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func CreatePaypalOrder(w http.ResponseWriter, r *http.Request) error {
@@ -27,7 +31,7 @@ func CreatePaypalOrder(w http.ResponseWriter, r *http.Request) error {
 		w.WriteHeader(http.StatusUnauthorized)
 		return err
 	}
-	accessToken, err := getAcessToken()
+	accessToken, err := getAcessToken(r.Context())
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return err
@@ -42,8 +46,17 @@ func CreatePaypalOrder(w http.ResponseWriter, r *http.Request) error {
 		w.WriteHeader(http.StatusBadRequest)
 		return err
 	}
+	if cart.AddressId <= 0 {
+		http.Error(w, "select a shipping address", http.StatusUnprocessableEntity)
+		return errors.New("address id cant be equals or below zero")
+	}
+	address, err := store.Pub.GetAddress(r.Context(), user.Id, cart.AddressId)
+	if err != nil {
+		http.Error(w, "shipping address was not found", http.StatusUnprocessableEntity)
+		return err
+	}
 	if cart.FromCart {
-		updatedCart, err := store.Pub.CheckStockFromItemsAndUpdateCart(context.Background(), user.Id, cart.Products)
+		updatedCart, err := store.Pub.CheckStockFromItemsAndUpdateCart(r.Context(), user.Id, cart.Products)
 		if !updatedCart && err != nil {
 			return err
 		}
@@ -51,39 +64,70 @@ func CreatePaypalOrder(w http.ResponseWriter, r *http.Request) error {
 			if err != nil {
 				log.Println(err)
 			}
-			cartItems, err := store.Pub.GetCart(context.Background(), user.Id)
+			cartItems, err := store.Pub.GetCart(r.Context(), user.Id)
 			if err != nil {
 				return err
 			}
-			countCart, cartTotal, err := store.Pub.CartCountItemsWithTotal(context.Background(), user.Id)
+			countCart, err := store.Pub.CartCountItems(r.Context(), user.Id)
 			if err != nil {
 				return err
 			}
-			err = render.Template(w, r, checkout.UpdateItems(cartItems, cart.FromCart, countCart, cartTotal))
+			quote := store.Quote{Currency: cart.Currency}
+			options := []store.ShippingOption{}
+			if len(cartItems) > 0 {
+				options, err = store.Pub.ShippingOptions(r.Context(), store.ToOrderItems(cartItems...), cart.Currency, address.Address)
+				if err != nil {
+					return err
+				}
+				quote, err = store.Pub.QuoteItems(r.Context(), store.QuoteRequest{
+					Items:            store.ToOrderItems(cartItems...),
+					UserId:           user.Id,
+					Currency:         cart.Currency,
+					CouponCode:       cart.Coupon,
+					ShippingMethodId: cart.ShippingMethodId,
+					Address:          address.Address,
+				})
+				if err != nil {
+					return err
+				}
+			}
+			err = render.Template(w, r, checkout.UpdateItems(cartItems, cart.FromCart, countCart, quote, options))
 			if err != nil {
 				return err
 			}
 		}
 	} else {
-		err := store.Pub.CheckStockFromItems(context.Background(), cart.Products)
+		err := store.Pub.CheckStockFromItems(r.Context(), cart.Products)
 		if err != nil {
-			handlers.Redirect(w, r, "/oops")
 			return err
 		}
 	}
-	total, err := store.Pub.TotalItems(context.Background(), cart.Products)
+	quote, err := store.Pub.QuoteItems(r.Context(), store.QuoteRequest{
+		Items:            cart.Products,
+		UserId:           user.Id,
+		Currency:         cart.Currency,
+		CouponCode:       cart.Coupon,
+		ShippingMethodId: cart.ShippingMethodId,
+		Address:          address.Address,
+	})
 	if err != nil {
 		return err
 	}
+	if len(quote.CouponError) > 0 {
+		http.Error(w, quote.CouponError, http.StatusUnprocessableEntity)
+		return errors.New(quote.CouponError)
+	}
+	if len(quote.ShippingError) > 0 {
+		http.Error(w, quote.ShippingError, http.StatusUnprocessableEntity)
+		return errors.New(quote.ShippingError)
+	}
 	referenceId := uuid.New().String()
 	order := CreateOrderRequest{
 		PurchaseUnits: []PurchaseUnit{
 			{
-				Amount: Amount{
-					CurrencyCode: string(cart.Currency),
-					Value:        fmt.Sprintf("%.*f", cart.Currency.Truncate(), total),
-				},
+				Amount:      amountFromQuote(quote),
 				ReferenceID: referenceId,
+				Shipping:    shippingFromAddress(address.Address),
 			},
 		},
 		Intent: "CAPTURE",
@@ -93,9 +137,9 @@ func CreatePaypalOrder(w http.ResponseWriter, r *http.Request) error {
 					PaymentMethodPreference: "IMMEDIATE_PAYMENT_REQUIRED",
 					PaymentMethodSelected:   "PAYPAL",
 					BrandName:               "EXAMPLE INC",
-					Locale:                  "en-US",
+					Locale:                  experienceLocale(user),
 					LandingPage:             "LOGIN",
-					ShippingPreference:      "GET_FROM_FILE",
+					ShippingPreference:      "SET_PROVIDED_ADDRESS",
 					UserAction:              "PAY_NOW",
 				},
 			},
@@ -116,7 +160,7 @@ func CreatePaypalOrder(w http.ResponseWriter, r *http.Request) error {
 	authHeaderValue := "Bearer " + accessToken.Token
 	req.Header.Set("Authorization", authHeaderValue)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := do(r.Context(), "create_order", req)
 	if err != nil {
 		return err
 	}
@@ -127,6 +171,9 @@ func CreatePaypalOrder(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode < http.StatusBadRequest {
+		metrics.OrdersCreated.WithLabelValues(string(gateaways.Paypal)).Inc()
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Authorization", authHeaderValue)
 	w.Header().Set("Reference-Id", referenceId)
@@ -137,7 +184,16 @@ func CreatePaypalOrder(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// captureTimeout bounds the capture and the order bookkeeping after it, they
+// run detached from the request deadline.
+const captureTimeout = 30 * time.Second
+
 func CaptureOrder(w http.ResponseWriter, r *http.Request) error {
+	// the payment is taken once PayPal answers, a client going away must not
+	// cancel the order bookkeeping that follows it.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), captureTimeout)
+	defer cancel()
+	logger := logs.FromContext(ctx)
 	user, err := auth.GetUserSession(r)
 	if err != nil {
 		return err
@@ -155,7 +211,7 @@ func CaptureOrder(w http.ResponseWriter, r *http.Request) error {
 	if len(orderId) <= 0 {
 		return errors.New("order id from params cant be len zero or below")
 	}
-	accessToken, err := getAcessToken()
+	accessToken, err := getAcessToken(ctx)
 	if err != nil {
 		return err
 	}
@@ -167,11 +223,46 @@ func CaptureOrder(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
-	transaction, bod, err := fetchCaptureOrder(orderId, accessToken)
+	var address store.Address
+	if cart.AddressId > 0 {
+		saved, err := store.Pub.GetAddress(ctx, user.Id, cart.AddressId)
+		if err != nil {
+			logger.Error(err.Error())
+		}
+		address = saved.Address
+	}
+	// the quote is checked again before taking the payment, a coupon used up
+	// or a shipping method gone since the order was created refuses the
+	// capture instead of charging an amount the shop wont honor.
+	quote, err := store.Pub.QuoteItems(ctx, store.QuoteRequest{
+		Items:            cart.Products,
+		UserId:           user.Id,
+		Currency:         cart.Currency,
+		CouponCode:       cart.Coupon,
+		ShippingMethodId: cart.ShippingMethodId,
+		Address:          address,
+	})
+	if err != nil {
+		return err
+	}
+	if len(quote.CouponError) > 0 {
+		http.Error(w, quote.CouponError, http.StatusUnprocessableEntity)
+		return errors.New(quote.CouponError)
+	}
+	if len(quote.ShippingError) > 0 {
+		http.Error(w, quote.ShippingError, http.StatusUnprocessableEntity)
+		return errors.New(quote.ShippingError)
+	}
+	transaction, bod, err := fetchCaptureOrder(ctx, orderId, accessToken)
 	if err != nil {
 		return err
 	}
 	if transaction.Status != COMPLETED {
+		failedStatus := string(transaction.Status)
+		if len(failedStatus) <= 0 {
+			failedStatus = "UNKNOWN"
+		}
+		metrics.PaymentsFailed.WithLabelValues(string(gateaways.Paypal), failedStatus).Inc()
 		w.Header().Set("Content-Type", "application/json")
 		_, err = w.Write(bod)
 		if err != nil {
@@ -179,18 +270,17 @@ func CaptureOrder(w http.ResponseWriter, r *http.Request) error {
 		}
 		return errors.New(fmt.Sprintf("transaction went wrong, STATUS:%s", transaction.Status))
 	}
-	go func(user store.User, cart store.Order) {
-		if cart.FromCart {
-			err := store.Pub.EmptyingCart(context.Background(), user.Id)
-			if err != nil {
-				log.Println(err)
-			}
-		}
-		err = store.Pub.UpdateStock(context.Background(), cart.Products)
+	if cart.FromCart {
+		err := jobs.EmptyCart.Enqueue(ctx, jobs.CartPayload{UserId: user.Id})
 		if err != nil {
-			log.Println(err)
+			logger.Error(err.Error())
 		}
-	}(user, cart)
+	}
+	err = jobs.UpdateStock.Enqueue(ctx, jobs.StockPayload{Items: cart.Products})
+	if err != nil {
+		logger.Error(err.Error())
+	}
+	metrics.PaymentsCaptured.WithLabelValues(string(gateaways.Paypal), string(cart.Currency)).Inc()
 	captureIds, err := getCaptureIds(transaction.PurchaseUnits)
 	if err != nil {
 		panic(fmt.Errorf("something went wrong with the transaction err:%w", err))
@@ -203,11 +293,19 @@ func CaptureOrder(w http.ResponseWriter, r *http.Request) error {
 	if err != nil {
 		return err
 	}
+	shipping := getShippingAddress(transaction.PurchaseUnits)
+	if shipping.Empty() {
+		shipping = address
+	}
+	// the order keeps the quote checked before the capture, it is the
+	// discount and coupon that were charged.
 	id, err := store.Pub.MakeOrder(
-		context.Background(),
+		ctx,
 		gateaways.Paypal,
 		user.Id,
 		cart.Products,
+		quote,
+		shipping,
 		total,
 		cart.Currency,
 		transaction.ID,
@@ -217,14 +315,20 @@ func CaptureOrder(w http.ResponseWriter, r *http.Request) error {
 		[]string{referenceId},
 		captureIds)
 	if err != nil {
-		log.Println(err)
+		logger.Error(err.Error())
+	}
+	if id > 0 {
+		err := jobs.ConfirmOrder.Enqueue(ctx, jobs.OrderPayload{OrderId: id})
+		if err != nil {
+			logger.Error(err.Error())
+		}
 	}
-	//func DeliverOrder
-	go func(orderId int, user store.User, cart store.Order, transaction Transaction) {
-	}(id, user, cart, transaction)
-
 	w.Header().Set("Content-Type", "application/json")
-	handlers.Redirect(w, r, "/thanks")
+	if id > 0 {
+		handlers.Redirect(w, r, fmt.Sprintf("/orders/%d", id))
+	} else {
+		handlers.Redirect(w, r, "/thanks")
+	}
 	_, err = w.Write(bod)
 	if err != nil {
 		return err
@@ -233,7 +337,71 @@ func CaptureOrder(w http.ResponseWriter, r *http.Request) error {
 
 }
 
-func fetchCaptureOrder(orderId string, accessToken *accessToken) (Transaction, []byte, error) {
+func amountFromQuote(quote store.Quote) Amount {
+	truncate := quote.Currency.Truncate()
+	money := func(value float64) *Money {
+		return &Money{CurrencyCode: string(quote.Currency), Value: fmt.Sprintf("%.*f", truncate, value)}
+	}
+	amount := Amount{
+		CurrencyCode: string(quote.Currency),
+		Value:        fmt.Sprintf("%.*f", truncate, quote.Total),
+		Breakdown: &AmountBreakdown{
+			ItemTotal: money(quote.ItemTotal),
+			Shipping:  money(quote.Shipping),
+			TaxTotal:  money(quote.Tax),
+		},
+	}
+	if discount := quote.TotalDiscount(); discount > 0 {
+		amount.Breakdown.Discount = money(discount)
+	}
+	return amount
+}
+
+func shippingFromAddress(address store.Address) *Shipping {
+	shipping := &Shipping{
+		Address: ShippingAddress{
+			AddressLine1: address.AddressLine1,
+			AddressLine2: address.AddressLine2,
+			AdminArea2:   address.AdminArea2,
+			AdminArea1:   address.AdminArea1,
+			PostalCode:   address.PostalCode,
+			CountryCode:  address.CountryCode,
+		},
+	}
+	shipping.Name.FullName = address.FullName
+	return shipping
+}
+
+// experienceLocale is the locale the PayPal checkout shows to the user, it
+// follows the locale the shop renders in.
+func experienceLocale(user store.User) string {
+	switch user.Lang() {
+	case "es":
+		return "es-CO"
+	default:
+		return "en-US"
+	}
+}
+
+func getShippingAddress(purchaseUnits []CapturePurchaseUnit) store.Address {
+	for _, unit := range purchaseUnits {
+		address := store.Address{
+			FullName:     unit.Shipping.Name.FullName,
+			AddressLine1: unit.Shipping.Address.AddressLine1,
+			AddressLine2: unit.Shipping.Address.AddressLine2,
+			AdminArea2:   unit.Shipping.Address.AdminArea2,
+			AdminArea1:   unit.Shipping.Address.AdminArea1,
+			PostalCode:   unit.Shipping.Address.PostalCode,
+			CountryCode:  unit.Shipping.Address.CountryCode,
+		}
+		if !address.Empty() {
+			return address
+		}
+	}
+	return store.Address{}
+}
+
+func fetchCaptureOrder(ctx context.Context, orderId string, accessToken *accessToken) (Transaction, []byte, error) {
 	req, err := http.NewRequest("POST", captureOrderURL(orderId), bytes.NewReader([]byte{}))
 	if err != nil {
 		return Transaction{}, []byte{}, err
@@ -242,7 +410,10 @@ func fetchCaptureOrder(orderId string, accessToken *accessToken) (Transaction, [
 
 	authHeaderValue := "Bearer " + accessToken.Token
 	req.Header.Set("Authorization", authHeaderValue)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := do(ctx, "capture_order", req)
+	if err != nil {
+		return Transaction{}, []byte{}, err
+	}
 	defer resp.Body.Close()
 
 	bod, err := io.ReadAll(resp.Body)
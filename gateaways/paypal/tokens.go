@@ -1,6 +1,7 @@
 package paypal
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -11,14 +12,20 @@ import (
 	"time"
 )
 
-func getAcessToken() (*accessToken, error) {
+// Ready tells if PayPal hands out access tokens, a cached token counts.
+func Ready(ctx context.Context) error {
+	_, err := getAcessToken(ctx)
+	return err
+}
+
+func getAcessToken(ctx context.Context) (*accessToken, error) {
 	var accessToken *accessToken
 	paypal := getPaypal()
 	if paypal.accessToken != nil && !time.Now().After(paypal.accessToken.ExpiresIn) {
 		accessToken = paypal.accessToken
 		return accessToken, nil
 	}
-	accessToken, err := fetchAccessToken()
+	accessToken, err := fetchAccessToken(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("could not get access token: %w", err)
 	}
@@ -26,7 +33,7 @@ func getAcessToken() (*accessToken, error) {
 	return accessToken, nil
 }
 
-func fetchAccessToken() (*accessToken, error) {
+func fetchAccessToken(ctx context.Context) (*accessToken, error) {
 	clientID := config.Envs.PaypalKey
 	clientSecret := config.Envs.PaypalSecret
 
@@ -44,7 +51,7 @@ func fetchAccessToken() (*accessToken, error) {
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Set("Authorization", authHeaderValue)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := do(ctx, "access_token", req)
 	if err != nil {
 		return nil, err
 	}
@@ -52,11 +52,41 @@ type CreateOrderRequest struct {
 }
 
 type PurchaseUnit struct {
-	Amount      Amount `json:"amount"`
-	ReferenceID string `json:"reference_id"`
+	Amount      Amount    `json:"amount"`
+	ReferenceID string    `json:"reference_id"`
+	Shipping    *Shipping `json:"shipping,omitempty"`
+}
+
+type Shipping struct {
+	Name struct {
+		FullName string `json:"full_name"`
+	} `json:"name"`
+	Address ShippingAddress `json:"address"`
+}
+
+type ShippingAddress struct {
+	AddressLine1 string `json:"address_line_1"`
+	AddressLine2 string `json:"address_line_2,omitempty"`
+	AdminArea2   string `json:"admin_area_2"`
+	AdminArea1   string `json:"admin_area_1,omitempty"`
+	PostalCode   string `json:"postal_code,omitempty"`
+	CountryCode  string `json:"country_code"`
 }
 
 type Amount struct {
+	CurrencyCode string           `json:"currency_code"`
+	Value        string           `json:"value"`
+	Breakdown    *AmountBreakdown `json:"breakdown,omitempty"`
+}
+
+type AmountBreakdown struct {
+	ItemTotal *Money `json:"item_total,omitempty"`
+	Shipping  *Money `json:"shipping,omitempty"`
+	TaxTotal  *Money `json:"tax_total,omitempty"`
+	Discount  *Money `json:"discount,omitempty"`
+}
+
+type Money struct {
 	CurrencyCode string `json:"currency_code"`
 	Value        string `json:"value"`
 }
@@ -130,20 +160,9 @@ type Capture struct {
 }
 
 type CapturePurchaseUnit struct {
-	ReferenceID string `json:"reference_id"`
-	Shipping    struct {
-		Name struct {
-			FullName string `json:"full_name"`
-		} `json:"name"`
-		Address struct {
-			AddressLine1 string `json:"address_line_1"`
-			AdminArea2   string `json:"admin_area_2"`
-			AdminArea1   string `json:"admin_area_1"`
-			PostalCode   string `json:"postal_code"`
-			CountryCode  string `json:"country_code"`
-		} `json:"address"`
-	} `json:"shipping"`
-	Payments struct {
+	ReferenceID string   `json:"reference_id"`
+	Shipping    Shipping `json:"shipping"`
+	Payments    struct {
 		Captures []Capture `json:"captures"`
 	} `json:"payments"`
 }
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/jackc/pgx/v5"
+)
+
+type ErrorKind string
+
+const (
+	KindUser      ErrorKind = "user"
+	KindNotFound  ErrorKind = "not_found"
+	KindForbidden ErrorKind = "forbidden"
+	KindUpstream  ErrorKind = "upstream"
+	KindLimited   ErrorKind = "rate_limited"
+	KindInternal  ErrorKind = "internal"
+)
+
+// Error tags an error with its kind, handlers return it so the middleware
+// answers with the right status and error page.
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func UserError(err error) error {
+	return &Error{Kind: KindUser, Err: err}
+}
+
+func NotFound(err error) error {
+	return &Error{Kind: KindNotFound, Err: err}
+}
+
+func Forbidden(err error) error {
+	return &Error{Kind: KindForbidden, Err: err}
+}
+
+func Upstream(err error) error {
+	return &Error{Kind: KindUpstream, Err: err}
+}
+
+// TooManyRequests is for clients over their rate limit, the Retry-After
+// header goes in the response before returning it.
+func TooManyRequests(err error) error {
+	return &Error{Kind: KindLimited, Err: err}
+}
+
+func Classify(err error) ErrorKind {
+	var appErr *Error
+	if errors.As(err, &appErr) {
+		return appErr.Kind
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return KindNotFound
+	}
+	return KindInternal
+}
+
+func (k ErrorKind) Status() int {
+	switch k {
+	case KindUser:
+		return http.StatusBadRequest
+	case KindNotFound:
+		return http.StatusNotFound
+	case KindForbidden:
+		return http.StatusForbidden
+	case KindUpstream:
+		return http.StatusBadGateway
+	case KindLimited:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Message is what the customer reads, only user errors show their detail.
+func (k ErrorKind) Message(err error) string {
+	switch k {
+	case KindUser:
+		return err.Error()
+	case KindNotFound:
+		return "we couldnt find what you were looking for"
+	case KindForbidden:
+		return "you dont have access to this"
+	case KindUpstream:
+		return "a service we depend on is failing, try again in a few minutes"
+	case KindLimited:
+		return "too many requests, wait a moment and try again"
+	default:
+		return "something went wrong on our side"
+	}
+}
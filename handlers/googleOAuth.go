@@ -1,13 +1,13 @@
 package handlers
 
 import (
-	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"shop/services/auth"
 	"shop/services/auth/authGoogle"
+	"shop/services/logs"
 	"shop/services/store"
 
 	"google.golang.org/api/idtoken"
@@ -26,26 +26,65 @@ func HandleCredentialsGoogle(w http.ResponseWriter, r *http.Request) error {
 		return fmt.Errorf("missing or invalid credential")
 	}
 
-	payload, err := authGoogle.VerifyIdToken(cred)
+	payload, err := authGoogle.VerifyIdToken(r.Context(), cred)
 	if err != nil {
 		http.Error(w, "Failed to verify ID token", http.StatusInternalServerError)
 		return err
 	}
 
-	user, err := formatToUser(payload)
+	identity, err := formatToIdentity(payload)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to format user: %s", err.Error()), http.StatusBadRequest)
 		return err
 	}
 
-	ctx := context.WithValue(r.Context(), "user", user)
-	_, err = auth.StoreUser(w, r, authGoogle.NewService(), ctx)
+	_, err = auth.StoreUser(w, r, authGoogle.NewService(), identity)
+	path, err := landingPath(err)
 	if err != nil {
 		http.Error(w, "failed to store user", http.StatusInternalServerError)
 		return err
 	}
 
-	redirectResponse("", "/", http.StatusOK, w)
+	redirectResponse("", path, http.StatusOK, w)
+	return nil
+}
+
+const googlePath = "/auth/google"
+
+// GoogleLogin starts the authorization code flow for browsers where One Tap
+// cant run.
+func GoogleLogin(w http.ResponseWriter, r *http.Request) error {
+	state, verifier, _ := startFlow(w, googlePath)
+	http.Redirect(w, r, authGoogle.NewService().AuthCodeURL(state, verifier), http.StatusSeeOther)
+	return nil
+}
+
+func GoogleCallback(w http.ResponseWriter, r *http.Request) error {
+	verifier, _, err := finishFlow(w, r, googlePath)
+	if err != nil {
+		return err
+	}
+	service := authGoogle.NewService()
+	payload, refreshToken, err := service.Exchange(r.Context(), r.URL.Query().Get("code"), verifier)
+	if err != nil {
+		return Upstream(err)
+	}
+	identity, err := formatToIdentity(payload)
+	if err != nil {
+		return err
+	}
+	_, err = auth.StoreUser(w, r, service, identity)
+	path, err := landingPath(err)
+	if err != nil {
+		return err
+	}
+	if len(refreshToken) > 0 {
+		err = store.Pub.SetIdentityToken(r.Context(), store.Google, identity.Subject, refreshToken)
+		if err != nil {
+			logs.FromContext(r.Context()).Error("couldnt keep the google refresh token", "err", err)
+		}
+	}
+	http.Redirect(w, r, path, http.StatusSeeOther)
 	return nil
 }
 
@@ -56,18 +95,26 @@ func redirectResponse(body, redirectURL string, code int, w http.ResponseWriter)
 	_ = json.NewEncoder(w).Encode(response)
 }
 
-func formatToUser(payload *idtoken.Payload) (store.User, error) {
+func formatToIdentity(payload *idtoken.Payload) (store.Identity, error) {
 	name, ok := payload.Claims["name"].(string)
 	if !ok {
-		return store.User{}, errors.New("not name found within payload claims")
+		return store.Identity{}, errors.New("not name found within payload claims")
 	}
 	email, ok := payload.Claims["email"].(string)
 	if !ok {
-		return store.User{}, errors.New("not email found within payload claims")
+		return store.Identity{}, errors.New("not email found within payload claims")
 	}
 	picture, ok := payload.Claims["picture"].(string)
 	if !ok {
-		return store.User{}, errors.New("not picture found within payload claims")
+		return store.Identity{}, errors.New("not picture found within payload claims")
 	}
-	return store.User{Name: name, Email: email, AvatarUrl: picture, Provider: store.Google}, nil
+	verified, _ := payload.Claims["email_verified"].(bool)
+	return store.Identity{
+		Provider:      store.Google,
+		Subject:       payload.Subject,
+		Email:         email,
+		EmailVerified: verified,
+		Name:          name,
+		Picture:       picture,
+	}, nil
 }
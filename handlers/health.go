@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Check reports if a dependency the app needs to serve traffic works.
+type Check func(ctx context.Context) error
+
+var draining atomic.Bool
+
+// Drain makes readiness fail so load balancers stop sending traffic while
+// the server shuts down.
+func Drain() {
+	draining.Store(true)
+}
+
+func Healthz(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err := w.Write([]byte("ok"))
+	return err
+}
+
+func Readyz(checks map[string]Check) func(w http.ResponseWriter, r *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		status := http.StatusOK
+		results := map[string]string{}
+		if draining.Load() {
+			status = http.StatusServiceUnavailable
+			results["server"] = "draining"
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+		defer cancel()
+		for name, check := range checks {
+			if err := check(ctx); err != nil {
+				status = http.StatusServiceUnavailable
+				results[name] = err.Error()
+				continue
+			}
+			results[name] = "ok"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		return json.NewEncoder(w).Encode(results)
+	}
+}
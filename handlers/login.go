@@ -6,21 +6,26 @@ import (
 	"shop/handlers/render"
 	"shop/services/auth"
 	"shop/services/auth/authGoogle"
+	"shop/services/auth/authMagicLink"
+	"shop/services/auth/authOIDC"
 	"shop/services/store"
 	"shop/views/login"
 )
 
 func AuthLogout(w http.ResponseWriter, r *http.Request) error {
 	user, err := auth.GetUserSession(r)
+	if err == auth.ErrMFARequired {
+		err = auth.RemoveUserSession(w, r)
+		if err != nil {
+			return err
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	var service auth.AuthService
-	switch user.Provider {
-	case store.Google:
-		service = authGoogle.NewService()
-	case store.Local:
-	}
+	service := ProviderService(user)
 	if service == nil {
 		err = auth.RemoveUserSession(w, r)
 		if err != nil {
@@ -29,7 +34,7 @@ func AuthLogout(w http.ResponseWriter, r *http.Request) error {
 		return fmt.Errorf("service is nil, cant logout without a provider, has provider: %s", user.Provider)
 	}
 
-	err = auth.LogOutUser(w, r, service, r.Context())
+	err = auth.LogOutUser(w, r, service)
 	if err != nil {
 		return err
 	}
@@ -39,5 +44,26 @@ func AuthLogout(w http.ResponseWriter, r *http.Request) error {
 }
 
 func LoginPage(w http.ResponseWriter, r *http.Request) error {
+	if _, err := auth.GetPendingSession(r); err == nil {
+		Redirect(w, r, login.MFAUrl())
+		return nil
+	}
 	return render.Template(w, r, login.Index())
 }
+
+// ProviderService returns the auth service the user logged in with, it is
+// nil for local users and providers no longer configured.
+func ProviderService(user store.User) auth.AuthService {
+	switch user.Provider {
+	case store.Google:
+		return authGoogle.NewService()
+	case store.MagicLink:
+		return authMagicLink.NewService()
+	case store.Local:
+		return nil
+	}
+	if oidcService, ok := authOIDC.Get(string(user.Provider)); ok {
+		return oidcService
+	}
+	return nil
+}
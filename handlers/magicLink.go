@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"shop/handlers/render"
+	"shop/services/auth"
+	"shop/services/auth/authMagicLink"
+	"shop/services/store"
+	"shop/views/login"
+)
+
+func MagicLinkSend(w http.ResponseWriter, r *http.Request) error {
+	err := r.ParseForm()
+	if err != nil {
+		render.Template(w, r, login.MagicLinkForm("App error"))
+		return err
+	}
+	email := r.PostForm.Get("email")
+	err = authMagicLink.NewService().Send(r.Context(), email, auth.ClientIP(r))
+	if err == authMagicLink.ErrInvalidEmail {
+		render.Template(w, r, login.MagicLinkForm(err.Error()))
+		return UserError(err)
+	}
+	if err == store.ErrTooManyMagicLinks {
+		render.Template(w, r, login.MagicLinkForm("we already sent a few links, check your inbox or try again in a few minutes"))
+		return UserError(err)
+	}
+	if err != nil {
+		render.Template(w, r, login.MagicLinkForm("App error"))
+		return err
+	}
+	return render.Template(w, r, login.MagicLinkSent(email))
+}
+
+func MagicLinkPage(w http.ResponseWriter, r *http.Request) error {
+	token := r.URL.Query().Get("token")
+	if len(token) <= 0 {
+		return UserError(errors.New("the login link has no token"))
+	}
+	return render.Template(w, r, login.MagicLink(token))
+}
+
+func MagicLinkCallback(w http.ResponseWriter, r *http.Request) error {
+	err := r.ParseForm()
+	if err != nil {
+		return UserError(err)
+	}
+	service := authMagicLink.NewService()
+	identity, err := service.Consume(r.Context(), r.PostForm.Get("token"))
+	if err == authMagicLink.ErrInvalidLink {
+		return UserError(err)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = auth.StoreUser(w, r, service, identity)
+	path, err := landingPath(err)
+	if err != nil {
+		return err
+	}
+	Redirect(w, r, path)
+	return nil
+}
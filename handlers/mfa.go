@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"net/http"
+	"shop/handlers/render"
+	"shop/services/auth"
+	"shop/services/store"
+	"shop/views/login"
+)
+
+// landingPath is where a login lands, a session waiting for the second
+// factor goes to its prompt first.
+func landingPath(err error) (string, error) {
+	if err == auth.ErrMFARequired {
+		return login.MFAUrl(), nil
+	}
+	return "/", err
+}
+
+func MFAPage(w http.ResponseWriter, r *http.Request) error {
+	_, err := auth.GetPendingSession(r)
+	if err != nil {
+		Redirect(w, r, "/login")
+		return err
+	}
+	return render.Template(w, r, login.MFA(""))
+}
+
+func MFAVerify(w http.ResponseWriter, r *http.Request) error {
+	_, err := auth.GetPendingSession(r)
+	if err != nil {
+		Redirect(w, r, "/login")
+		return err
+	}
+	err = r.ParseForm()
+	if err != nil {
+		return UserError(err)
+	}
+	session, err := auth.CompleteMFA(r, r.PostForm.Get("code"))
+	if err == auth.ErrInvalidCode {
+		render.Template(w, r, login.MFAForm(err.Error()))
+		return UserError(err)
+	}
+	if err != nil {
+		return err
+	}
+	if session.Admin {
+		permissions, err := store.Pub.GetPermissions(r.Context(), session.User.Id)
+		if err != nil {
+			return err
+		}
+		Redirect(w, r, AdminLanding(permissions))
+		return nil
+	}
+	Redirect(w, r, "/")
+	return nil
+}
+
+// AdminLanding is the first admin page the permissions reach.
+func AdminLanding(permissions store.Permissions) string {
+	switch {
+	case permissions.Has(store.OrdersView):
+		return "/admin/orders"
+	case permissions.Has(store.RolesManage):
+		return "/admin/roles"
+	}
+	return "/"
+}
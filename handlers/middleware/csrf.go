@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"net/http"
+	"shop/config"
+	"shop/services/csrf"
+	"shop/services/logs"
+)
+
+// CSRF keeps a signed token in a cookie and asks every state changing
+// request to send it back through the X-CSRF-Token header or the csrf_token
+// form field. Pages render the token in a meta tag and in hx-headers.
+func CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := []byte(config.Envs.CSRFSecret)
+		token, ok := "", false
+		if cookie, err := r.Cookie(csrf.CookieName); err == nil {
+			token, ok = csrf.Verify(secret, cookie.Value)
+		}
+		if !ok {
+			var err error
+			token, err = csrf.NewToken()
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     csrf.CookieName,
+				Value:    csrf.Sign(secret, token),
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   config.Envs.CookiesAuthIsSecure,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		if !safeMethod(r.Method) {
+			sent := r.Header.Get(csrf.HeaderName)
+			if len(sent) <= 0 {
+				sent = r.PostFormValue(csrf.FieldName)
+			}
+			if !csrf.Equal(sent, token) {
+				logs.FromContext(r.Context()).Warn("csrf token mismatch", "method", r.Method, "path", r.URL.Path)
+				http.Error(w, "invalid csrf token, reload the page and try again", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(csrf.WithToken(r.Context(), token)))
+	})
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"shop/handlers"
+	"shop/services/auth"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// staticRoute is the pattern the public files are mounted on.
+const staticRoute = "/*"
+
+type logEntryKey struct{}
+
+// logEntry is filled by LogErr so the request log carries the handler error.
+type logEntry struct {
+	err  error
+	kind handlers.ErrorKind
+}
+
+// RequestLogger writes one structured log per request, it has to run after
+// chi's RequestID middleware.
+func RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestId := middleware.GetReqID(r.Context())
+		w.Header().Set(middleware.RequestIDHeader, requestId)
+		entry := &logEntry{}
+		r = r.WithContext(context.WithValue(r.Context(), logEntryKey{}, entry))
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		route := ""
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			route = rctx.RoutePattern()
+		}
+		attrs := []slog.Attr{
+			slog.String("request_id", requestId),
+			slog.String("method", r.Method),
+			slog.String("route", route),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Duration("duration", time.Since(start)),
+			slog.Int("bytes", ww.BytesWritten()),
+		}
+		// static files are served from the catch all route, they dont need a
+		// session lookup for the log.
+		if route != staticRoute {
+			if user, err := auth.GetUserSession(r); err == nil {
+				attrs = append(attrs, slog.Int("user_id", user.Id))
+			}
+		}
+		level := slog.LevelInfo
+		if entry.err != nil {
+			level = slog.LevelError
+			if entry.kind == handlers.KindUser || entry.kind == handlers.KindNotFound {
+				level = slog.LevelWarn
+			}
+			attrs = append(attrs, slog.String("err", entry.err.Error()), slog.String("error_class", string(entry.kind)))
+		} else if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.LogAttrs(r.Context(), level, "HTTP request", attrs...)
+	})
+}
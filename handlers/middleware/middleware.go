@@ -1,29 +1,94 @@
 package middleware
 
 import (
-	"log/slog"
 	"net/http"
+	"shop/handlers"
+	"shop/handlers/render"
+	"shop/services/auth"
+	"shop/services/logs"
+	"shop/views/component"
+	"shop/views/errors"
+
+	"github.com/go-chi/chi/v5/middleware"
 )
 
 type HTTPHandler func(w http.ResponseWriter, r *http.Request) error
 
+// LogErr records the handler error in the request log, when the handler
+// returned without answering it responds with the status of the error kind.
 func LogErr(h HTTPHandler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if err := h(w, r); err != nil {			
-			slog.Error("HTTP handler error", "err", err, "path", r.URL.Path)
+		ww := wrap(w, r)
+		if err := h(ww, r); err != nil {
+			kind := recordErr(r, err)
+			if !answered(ww) {
+				writeErr(ww, r, kind, err)
+			}
 		}
 	}
 }
 
 func LogErrAndRedirect(h HTTPHandler, redirectUrl string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if err := h(w, r); err != nil {
-			ok := len(redirectUrl) > 0 
-			slog.Error("HTTP handler error", "err", err, "path", r.URL.Path)
-			if ok {
+		ww := wrap(w, r)
+		if err := h(ww, r); err != nil {
+			kind := recordErr(r, err)
+			if answered(ww) {
+				return
+			}
+			if len(redirectUrl) > 0 {
 				w.Header().Set("Location", redirectUrl)
 				w.WriteHeader(http.StatusSeeOther)
+				return
 			}
+			writeErr(ww, r, kind, err)
 		}
 	}
 }
+
+func wrap(w http.ResponseWriter, r *http.Request) middleware.WrapResponseWriter {
+	if ww, ok := w.(middleware.WrapResponseWriter); ok {
+		return ww
+	}
+	return middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+}
+
+// answered tells if the handler already wrote a status or asked htmx to
+// redirect, in both cases the error was handled by the page.
+func answered(ww middleware.WrapResponseWriter) bool {
+	return ww.Status() != 0 || len(ww.Header().Get("HX-Redirect")) > 0
+}
+
+func recordErr(r *http.Request, err error) handlers.ErrorKind {
+	kind := handlers.Classify(err)
+	if entry, ok := r.Context().Value(logEntryKey{}).(*logEntry); ok {
+		entry.err = err
+		entry.kind = kind
+		return kind
+	}
+	logs.FromContext(r.Context()).Error("HTTP handler error",
+		"err", err,
+		"error_class", kind,
+		"path", r.URL.Path,
+	)
+	return kind
+}
+
+func writeErr(w http.ResponseWriter, r *http.Request, kind handlers.ErrorKind, err error) {
+	if r.Header.Get("HX-Request") != "" && kind == handlers.KindLimited {
+		// htmx swaps it on the page instead of failing silently, the base
+		// layout lets 429 responses through.
+		w.Header().Set("HX-Retarget", "body")
+		w.Header().Set("HX-Reswap", "beforeend")
+		w.WriteHeader(kind.Status())
+		render.Template(w, r, component.ErrorModal("Slow down", kind.Message(err)))
+		return
+	}
+	if r.Header.Get("HX-Request") != "" {
+		http.Error(w, kind.Message(err), kind.Status())
+		return
+	}
+	user, _ := auth.GetUserSession(r)
+	w.WriteHeader(kind.Status())
+	render.Template(w, r, errors.Page(user, kind.Status(), kind.Message(err)))
+}
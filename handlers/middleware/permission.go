@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"shop/handlers"
+	"shop/services/auth"
+	"shop/services/store"
+)
+
+// RequirePermission lets the request through when the admin session has a
+// role allowing it, the permissions go in the context for the templates to
+// show or hide what the admin can do.
+func RequirePermission(permission store.Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return LogErr(func(w http.ResponseWriter, r *http.Request) error {
+			admin, err := auth.GetAdminSession(r)
+			if err != nil {
+				handlers.Redirect(w, r, "/admin/login")
+				return err
+			}
+			permissions, err := store.Pub.GetPermissions(r.Context(), admin.Id)
+			if err != nil {
+				return err
+			}
+			if !permissions.Has(permission) {
+				return handlers.Forbidden(fmt.Errorf("%s lacks permission %s", admin.Actor(), permission))
+			}
+			next.ServeHTTP(w, r.WithContext(auth.WithPermissions(r.Context(), permissions)))
+			return nil
+		})
+	}
+}
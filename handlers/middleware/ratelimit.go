@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"shop/config"
+	"shop/handlers"
+	"shop/services/auth"
+	"shop/services/logs"
+	"shop/services/metrics"
+	"shop/services/ratelimit"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// RateLimit gives every route of the policy a bucket per client ip and, for
+// logged in users, per user, the request goes through while both have
+// tokens. A failing limiter lets requests through rather than take the shop
+// down with it.
+func RateLimit(policy string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return LogErr(func(w http.ResponseWriter, r *http.Request) error {
+			limit := config.Envs.RateLimit(policy)
+			route := chi.RouteContext(r.Context()).RoutePattern()
+			prefix := fmt.Sprintf("%s:%s %s", policy, r.Method, route)
+			wait, err := ratelimit.Pub.Take(r.Context(), prefix+":ip:"+auth.ClientIP(r), limit)
+			if err != nil {
+				logs.FromContext(r.Context()).Warn("rate limit by ip failed", "err", err, "policy", policy)
+			}
+			if wait > 0 {
+				return limited(w, policy, "ip", wait)
+			}
+			user, err := auth.GetUserSession(r)
+			if err == nil {
+				wait, err = ratelimit.Pub.Take(r.Context(), prefix+":user:"+strconv.Itoa(user.Id), limit)
+				if err != nil {
+					logs.FromContext(r.Context()).Warn("rate limit by user failed", "err", err, "policy", policy)
+				}
+				if wait > 0 {
+					return limited(w, policy, "user", wait)
+				}
+			}
+			next.ServeHTTP(w, r)
+			return nil
+		})
+	}
+}
+
+func limited(w http.ResponseWriter, policy, by string, wait time.Duration) error {
+	metrics.RateLimited.WithLabelValues(policy, by).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return handlers.TooManyRequests(fmt.Errorf("over the %s rate limit by %s, retry in %s", policy, by, wait))
+}
@@ -0,0 +1,14 @@
+package middleware
+
+import (
+	"net/http"
+	"shop/services/auth"
+)
+
+// Session makes the request look its session up once, the logger, the rate
+// limiter and the handlers share it. It has to run before RequestLogger.
+func Session(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(auth.WithSessionCache(r.Context())))
+	})
+}
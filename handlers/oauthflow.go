@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"shop/config"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const flowCookie = "oauth_flow"
+
+// startFlow keeps the state, the PKCE verifier and the nonce of an
+// authorization code flow in a short lived cookie scoped to the provider
+// paths until the provider calls back.
+func startFlow(w http.ResponseWriter, path string) (state, verifier, nonce string) {
+	state = oauth2.GenerateVerifier()
+	verifier = oauth2.GenerateVerifier()
+	nonce = oauth2.GenerateVerifier()
+	http.SetCookie(w, &http.Cookie{
+		Name:     flowCookie,
+		Value:    strings.Join([]string{state, verifier, nonce}, "."),
+		Path:     path,
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		HttpOnly: true,
+		Secure:   config.Envs.CookiesAuthIsSecure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return state, verifier, nonce
+}
+
+// finishFlow checks the callback against the cookie of startFlow and returns
+// the verifier and nonce to finish the code exchange with.
+func finishFlow(w http.ResponseWriter, r *http.Request, path string) (verifier, nonce string, err error) {
+	cookie, err := r.Cookie(flowCookie)
+	if err != nil {
+		return "", "", UserError(errors.New("login expired, try again"))
+	}
+	http.SetCookie(w, &http.Cookie{Name: flowCookie, Path: path, MaxAge: -1})
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 {
+		return "", "", UserError(errors.New("login cookie is malformed"))
+	}
+	params := r.URL.Query()
+	if reason := params.Get("error"); len(reason) > 0 {
+		return "", "", UserError(fmt.Errorf("login was cancelled: %s", reason))
+	}
+	if subtle.ConstantTimeCompare([]byte(params.Get("state")), []byte(parts[0])) != 1 {
+		return "", "", UserError(errors.New("login state doesnt match"))
+	}
+	return parts[1], parts[2], nil
+}
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"shop/services/auth"
+	"shop/services/auth/authOIDC"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func OIDCLogin(w http.ResponseWriter, r *http.Request) error {
+	name := chi.URLParam(r, "provider")
+	service, ok := authOIDC.Get(name)
+	if !ok {
+		return NotFound(fmt.Errorf("oidc provider %q is not enabled", name))
+	}
+	state, verifier, nonce := startFlow(w, "/auth/"+name)
+	http.Redirect(w, r, service.AuthCodeURL(state, verifier, nonce), http.StatusSeeOther)
+	return nil
+}
+
+func OIDCCallback(w http.ResponseWriter, r *http.Request) error {
+	name := chi.URLParam(r, "provider")
+	service, ok := authOIDC.Get(name)
+	if !ok {
+		return NotFound(fmt.Errorf("oidc provider %q is not enabled", name))
+	}
+	verifier, nonce, err := finishFlow(w, r, "/auth/"+name)
+	if err != nil {
+		return err
+	}
+	identity, err := service.Exchange(r.Context(), r.URL.Query().Get("code"), verifier, nonce)
+	if err != nil {
+		return Upstream(err)
+	}
+	_, err = auth.StoreUser(w, r, service, identity)
+	path, err := landingPath(err)
+	if err != nil {
+		return err
+	}
+	http.Redirect(w, r, path, http.StatusSeeOther)
+	return nil
+}
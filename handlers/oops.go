@@ -0,0 +1,13 @@
+package handlers
+
+import (
+	"net/http"
+	"shop/handlers/render"
+	"shop/services/auth"
+	"shop/views/errors"
+)
+
+func Oops(w http.ResponseWriter, r *http.Request) error {
+	user, _ := auth.GetUserSession(r)
+	return render.Template(w, r, errors.Page(user, http.StatusInternalServerError, KindInternal.Message(nil)))
+}
@@ -1,16 +1,23 @@
 package main
 
 import (
-	"encoding/gob"
+	"context"
 	"log"
 	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"math/rand/v2"
+	"shop/account"
+	"shop/admin"
 	"shop/cart"
 	"shop/checkout"
 	"shop/config"
@@ -18,9 +25,18 @@ import (
 	"shop/handlers"
 	m "shop/handlers/middleware"
 	"shop/marketplace"
+	"shop/orders"
 	"shop/products"
 	"shop/services/auth"
+	"shop/services/auth/authMagicLink"
+	"shop/services/auth/authOIDC"
+	"shop/services/email"
+	"shop/services/jobs"
+	"shop/services/metrics"
+	"shop/services/notify"
+	"shop/services/ratelimit"
 	"shop/services/store"
+	"shop/services/tracing"
 	"strconv"
 	"time"
 )
@@ -90,44 +106,163 @@ func product(l, t int) store.Product {
 	}
 }
 func main() {
+	defer recoverFromPanic()
 	err := initPkgs()
 	if err != nil {
 		log.Fatalf("init failed with error: %v\n", err)
 	}
+	shutdownTracing, err := tracing.Init(context.Background(), config.Envs.TracesExporter)
+	if err != nil {
+		log.Fatalf("tracing init failed with error: %v\n", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	r := chi.NewRouter()
 	corsConfig := newCors()
 
 	r.Use(corsConfig.Handler)
-	r.Use(middleware.Logger)
-	r.Handle("/*", public())
+	r.Use(m.Tracing)
+	r.Use(middleware.RequestID)
+	r.Use(m.Session)
+	r.Use(m.RequestLogger)
+	r.Use(m.Metrics)
+	r.Use(m.CSRF)
+	// the capture keeps the payment bookkeeping under its own longer deadline,
+	// the global timeout would answer 504 for a payment that went through.
+	r.With(m.RateLimit("checkout")).Post("/capture-paypal-order/{order-id}", m.LogErr(paypal.CaptureOrder))
+
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.Timeout(time.Duration(config.Envs.RequestTimeoutInSeconds) * time.Second))
+		r.Handle("/*", public())
+
+		r.Get("/healthz", m.LogErr(handlers.Healthz))
+		r.Get("/readyz", m.LogErr(handlers.Readyz(map[string]handlers.Check{
+			"postgres": store.Pub.Ping,
+			"paypal":   paypal.Ready,
+		})))
 
-	r.Get("/admin/login", m.LogErr(admin.Login))
+		r.Get("/admin/login", m.LogErr(admin.LoginPage))
+		r.Post("/admin/login", m.LogErr(admin.Login))
 
-	r.Get("/", m.LogErr(marketplace.Home))
-	r.Get("/{name}/p/{sku}", m.LogErr(products.SinglePage))
+		r.Get("/", m.LogErr(marketplace.Home))
+		r.Get("/{name}/p/{sku}", m.LogErr(products.SinglePage))
+		r.With(m.RateLimit("cart")).Post("/products/notify-me", m.LogErr(products.NotifyMe))
 
-	r.Get("/cart", m.LogErr(cart.Page))
-	r.Get("/cart/add-to-cart", m.LogErr(cart.AddToCart))
-	r.Get("/cart/count/update-product", m.LogErr(cart.UpdateProductCount))
-	r.Delete("/cart/count/remove-product", m.LogErr(cart.RemoveProduct))
+		r.Get("/cart", m.LogErr(cart.Page))
+		r.With(m.RateLimit("cart")).Post("/cart/add-to-cart", m.LogErr(cart.AddToCart))
+		r.With(m.RateLimit("cart")).Patch("/cart/count/update-product", m.LogErr(cart.UpdateProductCount))
+		r.With(m.RateLimit("cart")).Delete("/cart/count/remove-product", m.LogErr(cart.RemoveProduct))
 
-	r.Get("/checkout/buy", m.LogErr(checkout.PaymentPageCart))
-	r.Get("/checkout/buynow/{sku}", m.LogErr(checkout.PaymentPageBuyNow))
-	paypalEndpoints(r)
+		r.Get("/checkout/buy", m.LogErr(checkout.PaymentPageCart))
+		r.Get("/checkout/buynow/{sku}", m.LogErr(checkout.PaymentPageBuyNow))
+		r.With(m.RateLimit("checkout")).Post("/checkout/summary", m.LogErr(checkout.UpdateSummary))
+		r.With(m.RateLimit("checkout")).Post("/checkout/addresses", m.LogErr(checkout.SaveAddress))
+		r.Delete("/checkout/addresses/{id}", m.LogErr(checkout.DeleteAddress))
+		r.With(m.RateLimit("checkout")).Post("/create-paypal-order", m.LogErr(paypal.CreatePaypalOrder))
 
-	googleOAuthEndpoints(r)
-	r.Get("/login", m.LogErr(handlers.LoginPage))
-	r.Get("/auth/logout", m.LogErrAndRedirect(handlers.AuthLogout, "/"))
+		r.Get("/orders", m.LogErr(orders.List))
+		r.Get("/orders/{id}", m.LogErr(orders.Page))
+		r.Get("/account", m.LogErr(account.Profile))
+		r.Post("/account/profile", m.LogErr(account.UpdateProfile))
+		r.With(m.RateLimit("auth")).Post("/account/email", m.LogErr(account.ChangeEmail))
+		r.Get("/account/email/confirm", m.LogErr(account.ConfirmEmailPage))
+		r.Post("/account/email/confirm", m.LogErr(account.ConfirmEmail))
+		r.Get("/account/sessions", m.LogErr(account.Sessions))
+		r.Post("/account/sessions/{id}/revoke", m.LogErr(account.RevokeSession))
+		r.Post("/account/sessions/revoke-all", m.LogErr(account.RevokeAllSessions))
+		r.Get("/account/2fa", m.LogErr(account.TwoFactor))
+		r.With(m.RateLimit("auth")).Post("/account/2fa/enable", m.LogErr(account.EnableTwoFactor))
+		r.With(m.RateLimit("auth")).Post("/account/2fa/recovery-codes", m.LogErr(account.RegenerateRecoveryCodes))
+		r.With(m.RateLimit("auth")).Post("/account/2fa/disable", m.LogErr(account.DisableTwoFactor))
+		r.Get("/account/data", m.LogErr(account.Data))
+		r.Get("/account/data/export", m.LogErr(account.ExportData))
+		r.With(m.RateLimit("auth")).Post("/account/delete", m.LogErr(account.DeleteAccount))
+		adminEndpoints(r)
+
+		oauthEndpoints(r)
+		r.Get("/login", m.LogErr(handlers.LoginPage))
+		r.Get("/login/2fa", m.LogErr(handlers.MFAPage))
+		r.With(m.RateLimit("auth")).Post("/login/2fa", m.LogErr(handlers.MFAVerify))
+		r.Get("/oops", m.LogErr(handlers.Oops))
+		r.Get("/auth/logout", m.LogErrAndRedirect(handlers.AuthLogout, "/"))
+	})
 	listenAddr := ":" + config.Envs.Port
 
-	listenNServe(serverSettings(listenAddr, r), listenAddr)
+	var workers sync.WaitGroup
+	background(&workers, func() { notify.RunBackInStock(ctx, time.Minute) })
+	background(&workers, func() { email.RunOutbox(ctx, 30*time.Second) })
+	background(&workers, func() { jobs.Run(ctx, 5*time.Second) })
+	background(&workers, func() {
+		jobs.Every(ctx, 24*time.Hour, jobs.Cleanup, jobs.CleanupPayload{KeepEmails: 30 * 24 * time.Hour})
+	})
+	drainTimeout := time.Duration(config.Envs.DrainTimeoutInSeconds) * time.Second
+	drainGrace := time.Duration(config.Envs.DrainGraceInSeconds) * time.Second
+	srv := serverSettings(listenAddr, r)
+	metricsSrv := serveMetrics(config.Envs.MetricsAddr)
+	listenNServe(ctx, srv, listenAddr)
+	// the requests and the background workers share one deadline, a signal
+	// never waits longer than drainTimeout before cleaning up.
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	drain(drainCtx, srv, drainGrace)
+	waitWorkers(drainCtx, &workers)
+	if err := metricsSrv.Shutdown(drainCtx); err != nil {
+		slog.Error("metrics server shutdown", "err", err)
+	}
 	cleanUp()
+	flushTraces(shutdownTracing, drainTimeout)
+}
+
+// listenNServe serves until ctx is cancelled by a signal.
+func listenNServe(ctx context.Context, srv *http.Server, listenAddr string) {
+	slog.Info("HTTP server started", "address", listenAddr, "public_url", config.Envs.PublicURL)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("listen: %s\n", err)
+		}
+	case <-ctx.Done():
+	}
 }
 
-func listenNServe(srv *http.Server, listenAddr string) {
-	slog.Info("HTTP server started", "address", config.Envs.PublicHost+listenAddr)
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("listen: %s\n", err)
+// drain fails readiness and keeps serving for the grace period, load
+// balancers need a few probes to stop sending traffic. Then it stops taking
+// new connections and gives in-flight requests until ctx is done.
+func drain(ctx context.Context, srv *http.Server, grace time.Duration) {
+	deadline, _ := ctx.Deadline()
+	slog.Info("shutting down, draining requests", "grace", grace, "deadline", deadline)
+	handlers.Drain()
+	select {
+	case <-time.After(grace):
+	case <-ctx.Done():
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("HTTP server shutdown", "err", err)
+	}
+}
+
+func background(workers *sync.WaitGroup, run func()) {
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		run()
+	}()
+}
+
+func waitWorkers(ctx context.Context, workers *sync.WaitGroup) {
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Error("background workers didnt stop in time", "err", ctx.Err())
 	}
 }
 
@@ -139,19 +274,45 @@ func recoverFromPanic() {
 	}
 }
 
-func paypalEndpoints(r *chi.Mux) {
-	r.Post("/create-paypal-order", m.LogErr(paypal.CreatePaypalOrder))
-	r.Post("/capture-paypal-order/{order-id}", m.LogErr(paypal.CaptureOrder))
+// adminEndpoints puts every admin page behind the permission it needs, the
+// roles granting them live in the database. Routes taking a step up code are
+// rate limited like the login codes.
+func adminEndpoints(r chi.Router) {
+	r.With(m.RequirePermission(store.OrdersView)).Get("/admin/orders", m.LogErr(admin.Orders))
+	r.With(m.RequirePermission(store.OrdersView)).Get("/admin/orders/{id}", m.LogErr(admin.Order))
+	r.With(m.RequirePermission(store.OrdersFulfill)).Post("/admin/orders/{id}/pack", m.LogErr(admin.PackOrder))
+	r.With(m.RequirePermission(store.OrdersRefund), m.RateLimit("auth")).Post("/admin/orders/{id}/status", m.LogErr(admin.UpdatePaymentStatus))
+	r.With(m.RequirePermission(store.OrdersFulfill)).Post("/admin/orders/{id}/shipments", m.LogErr(admin.CreateShipment))
+	r.With(m.RequirePermission(store.OrdersFulfill)).Post("/admin/orders/{id}/shipments/{shipment}/deliver", m.LogErr(admin.DeliverShipment))
+	r.With(m.RequirePermission(store.RolesManage)).Get("/admin/roles", m.LogErr(admin.Roles))
+	r.With(m.RequirePermission(store.RolesManage), m.RateLimit("auth")).Post("/admin/roles/grant", m.LogErr(admin.GrantRole))
+	r.With(m.RequirePermission(store.RolesManage), m.RateLimit("auth")).Post("/admin/roles/revoke", m.LogErr(admin.RevokeRole))
+}
+
+func oauthEndpoints(r chi.Router) {
+	r.With(m.RateLimit("auth")).Post("/auth/google/idtoken", m.LogErrAndRedirect(handlers.HandleCredentialsGoogle, "/login"))
+	r.With(m.RateLimit("auth")).Get("/auth/google/login", m.LogErrAndRedirect(handlers.GoogleLogin, "/login"))
+	r.With(m.RateLimit("auth")).Get("/auth/google/callback", m.LogErrAndRedirect(handlers.GoogleCallback, "/login"))
+	r.With(m.RateLimit("auth")).Post("/auth/email", m.LogErr(handlers.MagicLinkSend))
+	r.Get(authMagicLink.CallbackPath, m.LogErr(handlers.MagicLinkPage))
+	r.With(m.RateLimit("auth")).Post(authMagicLink.CallbackPath, m.LogErr(handlers.MagicLinkCallback))
+	r.With(m.RateLimit("auth")).Get("/auth/{provider}/login", m.LogErrAndRedirect(handlers.OIDCLogin, "/login"))
+	r.With(m.RateLimit("auth")).Get("/auth/{provider}/callback", m.LogErrAndRedirect(handlers.OIDCCallback, "/login"))
 }
 
-func googleOAuthEndpoints(r *chi.Mux) {
-	r.Post("/auth/google/idtoken", m.LogErrAndRedirect(handlers.HandleCredentialsGoogle, "/login"))
+// allowedOrigins defaults to the shop itself, a wildcard would let any site
+// send credentialed requests.
+func allowedOrigins() []string {
+	if len(config.Envs.AllowedOrigins) > 0 {
+		return config.Envs.AllowedOrigins
+	}
+	return []string{config.Envs.PublicURL}
 }
 
 func newCors() *cors.Cors {
 	return cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"}, //CHANGE THIS IN PRODUCTION
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedOrigins:   allowedOrigins(),
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: true,
@@ -159,14 +320,15 @@ func newCors() *cors.Cors {
 	})
 }
 
-func newCookieStore() {
-	auth.NewUserCookieStore(auth.SessionOptions{
-		CookiesKey: config.Envs.CookiesAuthSecret,
-		Path:       config.Envs.CookiesPath,
-		MaxAge:     config.Envs.CookiesAuthAgeInSeconds,
-		HttpOnly:   config.Envs.CookiesAuthIsHttpOnly,
-		Secure:     config.Envs.CookiesAuthIsSecure,
-		SameSite:   http.SameSiteStrictMode,
+func newSessionStore() {
+	auth.NewSessionStore(auth.SessionOptions{
+		Path:     config.Envs.CookiesPath,
+		MaxAge:   config.Envs.CookiesAuthAgeInSeconds,
+		HttpOnly: config.Envs.CookiesAuthIsHttpOnly,
+		Secure:   config.Envs.CookiesAuthIsSecure,
+		// lax so the session opened by the google callback is sent on the
+		// redirect that follows it, csrf tokens cover cross site posts.
+		SameSite: http.SameSiteLaxMode,
 	})
 }
 
@@ -174,17 +336,25 @@ func cleanUp() {
 	store.Pub.Close()
 }
 
+func flushTraces(shutdown func(context.Context) error, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		slog.Error("flushing traces", "err", err)
+	}
+}
+
 func initPkgs() error {
 	err := config.LoadEnv()
 	if err != nil {
 		return err
 	}
-	if !config.Envs.Production {
+	if config.Envs.Production {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+	} else {
 		log.SetFlags(log.LstdFlags | log.Lshortfile)
 	}
-	gob.Register(store.User{})
-	gob.Register(store.Admin{})
-	newCookieStore()
+	newSessionStore()
 	err = paypal.Init()
 	if err != nil {
 		return err
@@ -194,9 +364,62 @@ func initPkgs() error {
 	if err != nil {
 		return err
 	}
+	pool, err := s.GetPool()
+	if err != nil {
+		return err
+	}
+	err = metrics.RegisterPool(pool)
+	if err != nil {
+		return err
+	}
+	err = auth.SeedOwners(context.Background())
+	if err != nil {
+		return err
+	}
+	err = email.Init(email.NewSender())
+	if err != nil {
+		return err
+	}
+	err = notify.Init(notify.EmailNotifier{})
+	if err != nil {
+		return err
+	}
+	err = authOIDC.Init(context.Background(), config.Envs.OIDCProviders)
+	if err != nil {
+		return err
+	}
+	limiter, err := ratelimit.New(config.Envs.RateLimitStore)
+	if err != nil {
+		return err
+	}
+	err = ratelimit.Init(limiter)
+	if err != nil {
+		return err
+	}
+	jobs.Init()
 	return nil
 }
 
+// serveMetrics exposes the metrics on their own listener, it is kept off the
+// public router so only what reaches the internal address can scrape it.
+func serveMetrics(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+	go func() {
+		slog.Info("metrics server started", "address", addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("metrics server stopped", "err", err)
+		}
+	}()
+	return srv
+}
+
 func serverSettings(listenAddr string, r *chi.Mux) *http.Server {
 	return &http.Server{
 		Addr:         listenAddr,
@@ -1,7 +1,6 @@
 package marketplace
 
 import (
-	"context"
 	"net/http"
 	"shop/handlers/render"
 	"shop/products"
@@ -14,18 +13,17 @@ func Home(w http.ResponseWriter, r *http.Request) error {
 	params := r.URL.Query()
 	index := params.Get("index")
 	limit := params.Get("limit")
-	products, err := products.Serve(context.Background(), limit, index)
+	products, err := products.Serve(r.Context(), limit, index)
 	if err != nil {
-		http.Redirect(w, r, "/oops", http.StatusSeeOther)
 		return err
 	}
 	user, err := auth.GetUserSession(r)
 	if err != nil {
 		return render.Template(w, r, home.Index(store.User{}, products, 0))
 	}
-	cartCountItems, err := store.Pub.CartCountItems(context.Background(), user.Id)
+	store.PreferCurrency(products, user.Currency)
+	cartCountItems, err := store.Pub.CartCountItems(r.Context(), user.Id)
 	if err != nil {
-		http.Redirect(w, r, "/oops", http.StatusSeeOther)
 		return err
 	}
 	return render.Template(w, r, home.Index(user, products, cartCountItems))
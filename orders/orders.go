@@ -0,0 +1,55 @@
+package orders
+
+import (
+	"errors"
+	"net/http"
+	"shop/handlers"
+	"shop/handlers/render"
+	"shop/services/auth"
+	"shop/services/store"
+	"shop/views/orders"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func List(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/login")
+		return err
+	}
+	list, err := store.Pub.GetOrders(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	countCart, err := store.Pub.CartCountItems(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	return render.Template(w, r, orders.List(user, countCart, list))
+}
+
+func Page(w http.ResponseWriter, r *http.Request) error {
+	user, err := auth.GetUserSession(r)
+	if err != nil {
+		handlers.Redirect(w, r, "/login")
+		return err
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return handlers.NotFound(err)
+	}
+	order, err := store.Pub.GetOrder(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if order.UserId != user.Id {
+		return handlers.NotFound(errors.New("order doesnt belong to the user"))
+	}
+	countCart, err := store.Pub.CartCountItems(r.Context(), user.Id)
+	if err != nil {
+		return err
+	}
+	return render.Template(w, r, orders.Index(user, countCart, order))
+}
@@ -17,7 +17,7 @@ func Serve(ctx context.Context, index, limit string) ([]store.Product, error) {
 		l = 30
 		err = nil
 	}
-	products, err := store.Pub.GetProducts(context.Background(), i, l)
+	products, err := store.Pub.GetProducts(ctx, i, l)
 	if err != nil {
 		return []store.Product{}, err
 	}
@@ -0,0 +1,44 @@
+package products
+
+import (
+	"errors"
+	"net/http"
+	"net/mail"
+	"shop/handlers/render"
+	"shop/services/auth"
+	"shop/services/store"
+	"shop/views/component"
+)
+
+func NotifyMe(w http.ResponseWriter, r *http.Request) error {
+	user, _ := auth.GetUserSession(r)
+	err := r.ParseForm()
+	if err != nil {
+		render.Template(w, r, component.NotifyMeError(errors.New("App error")))
+		return err
+	}
+	sku := store.Sku(r.PostForm.Get("sku"))
+	if len(sku) <= 0 {
+		render.Template(w, r, component.NotifyMeError(errors.New("App error")))
+		return errors.New("need sku which is not present in form")
+	}
+	email := user.Email
+	if user.Id <= 0 {
+		address, err := mail.ParseAddress(r.PostForm.Get("email"))
+		if err != nil {
+			render.Template(w, r, component.NotifyMeError(errors.New("that email doesn't look right")))
+			return err
+		}
+		email = address.Address
+	}
+	err = store.Pub.SubscribeBackInStock(r.Context(), sku, user.Id, email)
+	if err == store.ErrInStock {
+		render.Template(w, r, component.NotifyMeError(errors.New("this product is already in stock")))
+		return err
+	}
+	if err != nil {
+		render.Template(w, r, component.NotifyMeError(errors.New("App error")))
+		return err
+	}
+	return render.Template(w, r, component.NotifyMeDone())
+}
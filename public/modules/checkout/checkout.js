@@ -47,17 +47,25 @@
             const product = $(this)
             products.push({ sku: product.attr("sku"), quantity: parseInt(product.attr("quantity")) })
           })
+          const coupon = $("#applied-coupon").val() || ""
+          const currency = $("#checkout-summary input[name=currency]").val() || "USD"
+          const addressId = parseInt($("#checkout-addresses input[name=address-id]:checked").val() || "0")
+          const shippingMethodId = parseInt($("#checkout-shipping input[name=shipping-method]:checked").val() || "0")
           const response = await fetch("/create-paypal-order", {
             method: "POST",
             headers: {
               "Content-Type": "application/json",
+              "X-CSRF-Token": $("meta[name=csrf-token]").attr("content"),
             },
             body: JSON.stringify({
               products: [
                 ...products
               ],
-              currency: "USD",
-              fromCart: fromCart
+              currency: currency,
+              fromCart: fromCart,
+              coupon: coupon,
+              addressId: addressId,
+              shippingMethodId: shippingMethodId
             }),
           });
           let order = await response.text();
@@ -78,8 +86,11 @@
               products: [
                 ...products
               ],
-              currency: "USD",
-              fromCart: fromCart
+              currency: currency,
+              fromCart: fromCart,
+              coupon: coupon,
+              addressId: addressId,
+              shippingMethodId: shippingMethodId
             });
             codesAPI.setToken({ accessToken: accessToken, referenceId: referenceId })
             return order.id
@@ -106,6 +117,7 @@
               "Content-Type": "application/json",
               "Authorization": `Bearer ${tokens.accessToken}`,
               "Reference-Id": referenceId,
+              "X-CSRF-Token": $("meta[name=csrf-token]").attr("content"),
               "HX-Request": "true"
             },
             body: JSON.stringify(cartAPI.getCart())
@@ -4,6 +4,7 @@ function googleOAuth(response) {
     body: JSON.stringify(response),
     headers: {
       "Content-Type": "application/json",
+      "X-CSRF-Token": document.querySelector("meta[name=csrf-token]").content,
     },
   })
     .then((res) => {
@@ -6,41 +6,24 @@ import (
 	"fmt"
 	"net/http"
 	"shop/services/store"
-	"strconv"
-
-	"github.com/jackc/pgx/v5"
 )
 
 type AuthService interface {
 	ValidUser(context.Context) error
-	AuthUser(context.Context) (store.User, error)
+	AuthUser(ctx context.Context, user store.User) (store.User, error)
 	Logout(context.Context) error
 	RemoveUser(context.Context) error
-	DeleteUser(context.Context) error
+	DeleteUser(ctx context.Context, user store.User) error
 }
 
-func StoreUser(w http.ResponseWriter, r *http.Request, auth AuthService, ctx context.Context) (store.User, error) {
-	user, err := auth.AuthUser(ctx)
+// StoreUser finds or creates the user behind the provider identity and
+// opens its session.
+func StoreUser(w http.ResponseWriter, r *http.Request, auth AuthService, identity store.Identity) (store.User, error) {
+	user, err := store.Pub.LinkIdentity(r.Context(), identity)
 	if err != nil {
 		return store.User{}, err
 	}
-	_, err = store.Pub.GetUser(ctx)
-	if err == nil {
-		user, err := store.Pub.RestoreUser(ctx)
-		if err != nil {
-			return store.User{}, err
-		}
-		err = SetUserSession(w, r, user)
-		if err != nil {
-			return store.User{}, err
-		}
-		return user, nil
-	}
-	if err != pgx.ErrNoRows {
-		return store.User{}, err
-	}
-
-	user, err = store.Pub.NewUser(ctx, user)
+	user, err = auth.AuthUser(r.Context(), user)
 	if err != nil {
 		return store.User{}, err
 	}
@@ -51,16 +34,18 @@ func StoreUser(w http.ResponseWriter, r *http.Request, auth AuthService, ctx con
 	return user, nil
 }
 
-func GetUser(r *http.Request, auth AuthService, ctx context.Context) (store.User, error) {
+// GetUser returns the user of the session, when there is none the claimed
+// user is restored from the store.
+func GetUser(r *http.Request, auth AuthService, claimed store.User) (store.User, error) {
 	user, err := GetUserSession(r)
 	if err != ErrNoUserSessionFound && err != nil {
 		return store.User{}, err
 	}
-	if err := auth.ValidUser(ctx); err != nil {
+	if err := auth.ValidUser(r.Context()); err != nil {
 		return store.User{}, err
 	}
 	if err == ErrNoUserSessionFound {
-		user, err = store.Pub.RestoreUser(ctx)
+		user, err = store.Pub.RestoreUser(r.Context(), claimed)
 		if err != nil {
 			return store.User{}, err
 		}
@@ -68,35 +53,32 @@ func GetUser(r *http.Request, auth AuthService, ctx context.Context) (store.User
 	return user, nil
 }
 
-func DeleteUser(w http.ResponseWriter, r *http.Request, auth AuthService, ctx context.Context) error {
-	user, ok := ctx.Value("user").(store.User)
-	if !ok {
-		return errors.New("context value user was not passed for deleting the user")
-	}
+// DeleteUser tells the provider first and then removes the user from the
+// store, the session cookie goes last so a failed deletion can be retried.
+// A nil auth skips the provider, local users have none to tell.
+func DeleteUser(w http.ResponseWriter, r *http.Request, auth AuthService, user store.User) error {
 	if user.Id <= 0 {
 		return errors.New("user uid is less than zero, invalid for deletion")
 	}
-	err := RemoveUserSession(w, r)
-	if err != nil {
-		return err
-	}
-	err = auth.DeleteUser(ctx)
-	if err != nil {
-		return err
+	if auth != nil {
+		err := auth.DeleteUser(r.Context(), user)
+		if err != nil {
+			return err
+		}
 	}
-	err = store.Pub.DeleteUser(ctx, strconv.Itoa(int(user.Id)))
+	err := store.Pub.DeleteUser(r.Context(), user.Id)
 	if err != nil {
 		return fmt.Errorf("cant delete user with err: %w", err)
 	}
-	return nil
+	return RemoveUserSession(w, r)
 }
 
-func LogOutUser(w http.ResponseWriter, r *http.Request, auth AuthService, ctx context.Context) error {
+func LogOutUser(w http.ResponseWriter, r *http.Request, auth AuthService) error {
 	err := RemoveUserSession(w, r)
 	if err != nil {
 		return err
 	}
-	err = auth.RemoveUser(ctx)
+	err = auth.RemoveUser(r.Context())
 	if err != nil {
 		return err
 	}
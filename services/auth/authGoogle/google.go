@@ -3,12 +3,20 @@ package authGoogle
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
 	"shop/config"
 	"shop/services/store"
+	"shop/services/tracing"
+	"strings"
+	"sync"
 
+	"github.com/jackc/pgx/v5"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/idtoken"
+	"google.golang.org/api/option"
 )
 
 type googleService struct {
@@ -18,10 +26,9 @@ type googleService struct {
 func (g googleService) ValidUser(context.Context) error {
 	return nil
 }
-func (g googleService) AuthUser(ctx context.Context) (store.User, error) {
-	user, ok := ctx.Value("user").(store.User)
-	if !ok {
-		return store.User{}, errors.New("not a user, invalid user from context")
+func (g googleService) AuthUser(ctx context.Context, user store.User) (store.User, error) {
+	if len(user.Email) <= 0 {
+		return store.User{}, errors.New("google user has no email")
 	}
 	user.Provider = store.Google
 	return user, nil
@@ -32,11 +39,44 @@ func (g googleService) Logout(context.Context) error {
 func (g googleService) RemoveUser(context.Context) error {
 	return nil
 }
-func (g googleService) DeleteUser(context.Context) error {
-	return nil
+
+// DeleteUser revokes the grant the user gave the shop. One Tap logins leave
+// no refresh token, their users have nothing to revoke here.
+func (g googleService) DeleteUser(ctx context.Context, user store.User) error {
+	token, err := store.Pub.GetIdentityToken(ctx, user.Id, store.Google)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return revoke(ctx, token)
+}
+
+const revokeURL = "https://oauth2.googleapis.com/revoke"
+
+func revoke(ctx context.Context, token string) error {
+	form := url.Values{"token": {token}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, revokeURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := tracing.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// google answers 400 for a token the user already revoked, the grant is
+	// gone either way.
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusBadRequest {
+		return nil
+	}
+	return fmt.Errorf("google token revoke answered %s", resp.Status)
 }
 
 var scopes = []string{
+	"openid",
 	"https://www.googleapis.com/auth/userinfo.email",
 	"https://www.googleapis.com/auth/userinfo.profile",
 }
@@ -45,15 +85,51 @@ func NewService() googleService {
 	config := &oauth2.Config{
 		ClientID:     config.Envs.GoogleKey,
 		ClientSecret: config.Envs.GoogleSecret,
-		RedirectURL:  "http://locaholhost:8000/auth/google/callback",
+		RedirectURL:  config.Envs.PublicURL + "/auth/google/callback",
 		Scopes:       scopes,
 		Endpoint:     google.Endpoint,
 	}
 	return googleService{service: config}
 }
 
-func VerifyIdToken(idToken string) (*idtoken.Payload, error) {
-	payload, err := idtoken.Validate(context.Background(), idToken, config.Envs.GoogleKey)
+// AuthCodeURL is the Google consent page, the verifier stays with the
+// browser and only its S256 challenge is sent. Offline access gets a refresh
+// token, the shop keeps it to revoke the grant when the account is deleted.
+func (g googleService) AuthCodeURL(state, verifier string) string {
+	return g.service.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier), oauth2.AccessTypeOffline)
+}
+
+// Exchange trades the callback code for tokens and returns the verified
+// claims of the id token Google sends along with the refresh token, Google
+// only sends one the first time the user consents.
+func (g googleService) Exchange(ctx context.Context, code, verifier string) (*idtoken.Payload, string, error) {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, tracing.Client)
+	token, err := g.service.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, "", err
+	}
+	idToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, "", errors.New("google token response has no id token")
+	}
+	payload, err := VerifyIdToken(ctx, idToken)
+	if err != nil {
+		return nil, "", err
+	}
+	return payload, token.RefreshToken, nil
+}
+
+// idTokenValidator is built once, it caches the Google certificates between logins.
+var idTokenValidator = sync.OnceValues(func() (*idtoken.Validator, error) {
+	return idtoken.NewValidator(context.Background(), option.WithHTTPClient(tracing.Client))
+})
+
+func VerifyIdToken(ctx context.Context, idToken string) (*idtoken.Payload, error) {
+	validator, err := idTokenValidator()
+	if err != nil {
+		return nil, err
+	}
+	payload, err := validator.Validate(ctx, idToken, config.Envs.GoogleKey)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,144 @@
+package authMagicLink
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/mail"
+	"shop/config"
+	"shop/services/notify"
+	"shop/services/signed"
+	"shop/services/store"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrInvalidEmail = errors.New("that email doesn't look right")
+var ErrInvalidLink = errors.New("the login link is invalid or expired, ask for a new one")
+
+// limit keeps the shop from being used to flood an inbox, an address gets a
+// few links and an ip address a few more to cover shared networks.
+var limit = store.LinkLimit{
+	PerEmail: 3,
+	PerIP:    10,
+	Window:   15 * time.Minute,
+}
+
+const CallbackPath = "/auth/email/callback"
+
+type magicLinkService struct{}
+
+func (m magicLinkService) ValidUser(context.Context) error {
+	return nil
+}
+
+func (m magicLinkService) AuthUser(ctx context.Context, user store.User) (store.User, error) {
+	if len(user.Email) <= 0 {
+		return store.User{}, errors.New("magic link user has no email")
+	}
+	return user, nil
+}
+
+func (m magicLinkService) Logout(context.Context) error {
+	return nil
+}
+
+func (m magicLinkService) RemoveUser(context.Context) error {
+	return nil
+}
+
+func (m magicLinkService) DeleteUser(context.Context, store.User) error {
+	return nil
+}
+
+func NewService() magicLinkService {
+	return magicLinkService{}
+}
+
+// Send emails a single use login link to the address, it returns
+// store.ErrTooManyMagicLinks once the email or ip address hit the limit.
+func (m magicLinkService) Send(ctx context.Context, email, ipAddress string) error {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return err
+	}
+	token := make([]byte, 32)
+	_, err = rand.Read(token)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(token)
+	_, err = store.Pub.CreateMagicLink(ctx, hash[:], email, ipAddress, ttl(), limit)
+	if err != nil {
+		return err
+	}
+	link := config.Envs.PublicURL + CallbackPath + "?token=" + sign(secret(), token)
+	return notify.MagicLink(ctx, email, link, ttl())
+}
+
+// Consume spends the link and returns the identity of its email, the email
+// is verified since only its owner could open the link.
+func (m magicLinkService) Consume(ctx context.Context, signed string) (store.Identity, error) {
+	token, ok := verify(secret(), signed)
+	if !ok {
+		return store.Identity{}, ErrInvalidLink
+	}
+	hash := sha256.Sum256(token)
+	email, err := store.Pub.ConsumeMagicLink(ctx, hash[:])
+	if err == pgx.ErrNoRows {
+		return store.Identity{}, ErrInvalidLink
+	}
+	if err != nil {
+		return store.Identity{}, err
+	}
+	name, _, _ := strings.Cut(email, "@")
+	return store.Identity{
+		Provider:      store.MagicLink,
+		Subject:       email,
+		Email:         email,
+		EmailVerified: true,
+		Name:          name,
+	}, nil
+}
+
+func ttl() time.Duration {
+	return time.Duration(config.Envs.MagicLinkTTLInMinutes) * time.Minute
+}
+
+func secret() []byte {
+	return []byte(config.Envs.MagicLinkSecret)
+}
+
+// NormalizeEmail takes a bare address, lower cased so every link of an
+// address counts against the same limit and identity.
+func NormalizeEmail(email string) (string, error) {
+	address, err := mail.ParseAddress(strings.TrimSpace(email))
+	if err != nil || address.Address != strings.TrimSpace(email) {
+		return "", ErrInvalidEmail
+	}
+	return strings.ToLower(address.Address), nil
+}
+
+const purpose = "magic-link"
+
+// sign appends the mac of the token so forged or mangled links are turned
+// down before touching the store.
+func sign(secret, token []byte) string {
+	return signed.Sign(secret, purpose, base64.RawURLEncoding.EncodeToString(token))
+}
+
+func verify(secret []byte, link string) ([]byte, bool) {
+	encoded, ok := signed.Verify(secret, purpose, link)
+	if !ok {
+		return nil, false
+	}
+	token, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(token) <= 0 {
+		return nil, false
+	}
+	return token, true
+}
@@ -0,0 +1,71 @@
+package authMagicLink
+
+import (
+	"bytes"
+	"encoding/base64"
+	"shop/config"
+	"shop/services/signed"
+	"testing"
+	"time"
+)
+
+// the mac itself is covered by the signed package, these cases are the
+// token encoding and purpose a magic link adds on top.
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+	token := []byte("0123456789abcdef0123456789abcdef")
+	encoded := base64.RawURLEncoding.EncodeToString(token)
+	tests := map[string]struct {
+		link string
+		ok   bool
+	}{
+		`signedLink`: {
+			link: sign(secret, token),
+			ok:   true,
+		},
+		`csrfPurpose`: {
+			link: signed.Sign(secret, "csrf", encoded),
+		},
+		`notBase64`: {
+			link: signed.Sign(secret, purpose, "not base64!"),
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, ok := verify(secret, tt.link)
+			if ok != tt.ok {
+				t.Fatalf("verify(%q) ok = %v, want %v", tt.link, ok, tt.ok)
+			}
+			if ok && !bytes.Equal(got, token) {
+				t.Errorf("verify(%q) = %q, want %q", tt.link, got, token)
+			}
+		})
+	}
+}
+
+func TestTTL(t *testing.T) {
+	defer func(minutes int) { config.Envs.MagicLinkTTLInMinutes = minutes }(config.Envs.MagicLinkTTLInMinutes)
+	config.Envs.MagicLinkTTLInMinutes = 15
+	if got := ttl(); got != 15*time.Minute {
+		t.Errorf("ttl() = %v, want %v", got, 15*time.Minute)
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	cases := map[string]string{
+		"User@Example.com":   "user@example.com",
+		" user@example.com ": "user@example.com",
+		"user":               "",
+		"User <user@x.com>":  "",
+		"":                   "",
+	}
+	for email, want := range cases {
+		got, err := NormalizeEmail(email)
+		if len(want) <= 0 && err == nil {
+			t.Errorf("NormalizeEmail(%q) = %q, want an error", email, got)
+		}
+		if len(want) > 0 && got != want {
+			t.Errorf("NormalizeEmail(%q) = %q %v, want %q", email, got, err, want)
+		}
+	}
+}
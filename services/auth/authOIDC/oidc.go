@@ -0,0 +1,169 @@
+package authOIDC
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"shop/config"
+	"shop/services/store"
+	"shop/services/tracing"
+	"sort"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Service is an OpenID Connect provider enabled from the config, it logs
+// users in through the authorization code flow with PKCE.
+type Service struct {
+	provider config.OIDCProvider
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+var services = map[string]*Service{}
+
+// Init discovers the issuer of every provider, their keys are fetched from
+// the JWKS endpoint on demand to verify id tokens.
+func Init(ctx context.Context, providers []config.OIDCProvider) error {
+	ctx = oidc.ClientContext(ctx, tracing.Client)
+	for _, provider := range providers {
+		service, err := New(ctx, provider)
+		if err != nil {
+			return err
+		}
+		services[provider.Name] = service
+	}
+	return nil
+}
+
+func New(ctx context.Context, provider config.OIDCProvider) (*Service, error) {
+	issuer, err := oidc.NewProvider(ctx, provider.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("discovering oidc provider %s: %w", provider.Name, err)
+	}
+	return &Service{
+		provider: provider,
+		oauth: &oauth2.Config{
+			ClientID:     provider.ClientID,
+			ClientSecret: provider.ClientSecret,
+			RedirectURL:  config.Envs.PublicURL + CallbackPath(provider.Name),
+			Scopes:       provider.Scopes,
+			Endpoint:     issuer.Endpoint(),
+		},
+		verifier: issuer.Verifier(&oidc.Config{ClientID: provider.ClientID}),
+	}, nil
+}
+
+func Get(name string) (*Service, bool) {
+	service, ok := services[name]
+	return service, ok
+}
+
+// Names lists the enabled providers for the login page.
+func Names() []string {
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func LoginPath(name string) string {
+	return "/auth/" + name + "/login"
+}
+
+func CallbackPath(name string) string {
+	return "/auth/" + name + "/callback"
+}
+
+func (s *Service) ValidUser(context.Context) error {
+	return nil
+}
+
+func (s *Service) AuthUser(ctx context.Context, user store.User) (store.User, error) {
+	if len(user.Email) <= 0 {
+		return store.User{}, fmt.Errorf("%s user has no email", s.provider.Name)
+	}
+	return user, nil
+}
+
+func (s *Service) Logout(context.Context) error {
+	return nil
+}
+
+func (s *Service) RemoveUser(context.Context) error {
+	return nil
+}
+
+func (s *Service) DeleteUser(context.Context, store.User) error {
+	return nil
+}
+
+func (s *Service) AuthCodeURL(state, verifier, nonce string) string {
+	return s.oauth.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier), oidc.Nonce(nonce))
+}
+
+// Exchange trades the callback code for tokens, verifies the id token
+// against the issuer keys and the nonce of the flow, and maps its claims.
+func (s *Service) Exchange(ctx context.Context, code, verifier, nonce string) (store.Identity, error) {
+	ctx = oidc.ClientContext(ctx, tracing.Client)
+	token, err := s.oauth.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return store.Identity{}, err
+	}
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		return store.Identity{}, errors.New("token response has no id token")
+	}
+	idToken, err := s.verifier.Verify(ctx, raw)
+	if err != nil {
+		return store.Identity{}, err
+	}
+	if idToken.Nonce != nonce {
+		return store.Identity{}, errors.New("id token nonce doesnt match")
+	}
+	claims := map[string]any{}
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return store.Identity{}, err
+	}
+	return s.identity(idToken.Subject, claims)
+}
+
+func (s *Service) identity(subject string, claims map[string]any) (store.Identity, error) {
+	provider, err := store.ToProvider(s.provider.Name)
+	if err != nil {
+		return store.Identity{}, err
+	}
+	email, _ := claims[s.provider.EmailClaim].(string)
+	if len(email) <= 0 {
+		return store.Identity{}, fmt.Errorf("claim %q has no email", s.provider.EmailClaim)
+	}
+	name, _ := claims[s.provider.NameClaim].(string)
+	if len(name) <= 0 {
+		name = email
+	}
+	picture, _ := claims[s.provider.PictureClaim].(string)
+	return store.Identity{
+		Provider:      provider,
+		Subject:       subject,
+		Email:         email,
+		EmailVerified: emailVerified(claims["email_verified"]),
+		Name:          name,
+		Picture:       picture,
+	}, nil
+}
+
+// emailVerified accepts the boolean of the spec and the string some
+// providers send instead.
+func emailVerified(claim any) bool {
+	switch verified := claim.(type) {
+	case bool:
+		return verified
+	case string:
+		return verified == "true"
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package authOIDC
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"shop/config"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+const (
+	clientId = "shop"
+	code     = "good-code"
+	verifier = "the-verifier"
+	subject  = "user-1"
+)
+
+// mockIssuer serves discovery, keys and a token endpoint that signs an id
+// token with the nonce it is built with.
+func mockIssuer(t *testing.T, nonce string) *httptest.Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	writeJSON := func(w http.ResponseWriter, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(v)
+	}
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"issuer":                                srv.URL,
+			"authorization_endpoint":                srv.URL + "/authorize",
+			"token_endpoint":                        srv.URL + "/token",
+			"jwks_uri":                              srv.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != code || r.FormValue("code_verifier") != verifier {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		claims, _ := json.Marshal(map[string]any{
+			"iss":            srv.URL,
+			"aud":            clientId,
+			"sub":            subject,
+			"iat":            time.Now().Unix(),
+			"exp":            time.Now().Add(time.Hour).Unix(),
+			"nonce":          nonce,
+			"mail":           "user@example.com",
+			"email_verified": "true",
+			"name":           "User",
+		})
+		signed, err := signer.Sign(claims)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		idToken, _ := signed.CompactSerialize()
+		writeJSON(w, map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func mockProvider(t *testing.T, issuer string) *Service {
+	provider := config.OIDCProvider{
+		Name:         "mock",
+		Issuer:       issuer,
+		ClientID:     clientId,
+		ClientSecret: "secret",
+		Scopes:       []string{"openid", "email"},
+		EmailClaim:   "mail",
+		NameClaim:    "name",
+		PictureClaim: "picture",
+	}
+	config.Envs.OIDCProviders = []config.OIDCProvider{provider}
+	t.Cleanup(func() { config.Envs.OIDCProviders = nil })
+	service, err := New(context.Background(), provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return service
+}
+
+func TestExchange(t *testing.T) {
+	service := mockProvider(t, mockIssuer(t, "the-nonce").URL)
+
+	identity, err := service.Exchange(context.Background(), code, verifier, "the-nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Provider != "mock" || identity.Subject != subject {
+		t.Errorf("identity = %s/%s, want mock/%s", identity.Provider, identity.Subject, subject)
+	}
+	if identity.Email != "user@example.com" || !identity.EmailVerified {
+		t.Errorf("email = %q verified %v, want the mapped claim verified", identity.Email, identity.EmailVerified)
+	}
+	if identity.Name != "User" {
+		t.Errorf("name = %q, want User", identity.Name)
+	}
+}
+
+func TestExchangeRejects(t *testing.T) {
+	service := mockProvider(t, mockIssuer(t, "the-nonce").URL)
+
+	if _, err := service.Exchange(context.Background(), code, verifier, "other-nonce"); err == nil {
+		t.Error("exchange passed with a nonce from another flow")
+	}
+	if _, err := service.Exchange(context.Background(), code, "other-verifier", "the-nonce"); err == nil {
+		t.Error("exchange passed with a wrong PKCE verifier")
+	}
+}
+
+func TestEmailVerified(t *testing.T) {
+	cases := map[any]bool{
+		true:    true,
+		false:   false,
+		"true":  true,
+		"false": false,
+		nil:     false,
+		1:       false,
+	}
+	for claim, want := range cases {
+		if got := emailVerified(claim); got != want {
+			t.Errorf("emailVerified(%v) = %v, want %v", claim, got, want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"shop/services/store"
+	"shop/services/totp"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrMFANotEnabled = errors.New("two factor authentication is not enabled")
+var ErrInvalidCode = errors.New("the code is not valid, try again")
+var ErrStepUpRequired = errors.New("confirm it with a code of your authenticator app")
+
+// stepUpWindow is how long a verified code lets sensitive actions through
+// before another one is asked.
+const stepUpWindow = 5 * time.Minute
+
+func HasMFA(ctx context.Context, userId int) (bool, error) {
+	t, err := store.Pub.GetTOTP(ctx, userId)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return t.Enabled, nil
+}
+
+// VerifyCode accepts a code of the authenticator app or an unused recovery
+// code, either is spent once used.
+func VerifyCode(ctx context.Context, userId int, code string) error {
+	t, err := store.Pub.GetTOTP(ctx, userId)
+	if err == pgx.ErrNoRows || (err == nil && !t.Enabled) {
+		return ErrMFANotEnabled
+	}
+	if err != nil {
+		return err
+	}
+	if step, ok := totp.Match(t.Secret, code, time.Now()); ok {
+		err = store.Pub.UseTOTPStep(ctx, userId, step)
+	} else {
+		err = store.Pub.UseRecoveryCode(ctx, userId, totp.HashRecoveryCode(code))
+	}
+	if err == pgx.ErrNoRows {
+		return ErrInvalidCode
+	}
+	return err
+}
+
+// GetPendingSession returns the user of a session waiting for the second
+// factor, the prompt is the only page it can reach.
+func GetPendingSession(r *http.Request) (store.User, error) {
+	session, err := lookupSession(r)
+	if err != nil {
+		return store.User{}, err
+	}
+	if !session.MFAPending {
+		return store.User{}, ErrNoUserSessionFound
+	}
+	return session.User, nil
+}
+
+// CompleteMFA verifies the code for the session of the request and returns
+// it, admin sessions land on an admin page.
+func CompleteMFA(r *http.Request, code string) (store.SessionUser, error) {
+	session, err := lookupSession(r)
+	if err != nil {
+		return store.SessionUser{}, err
+	}
+	err = VerifyCode(r.Context(), session.User.Id, code)
+	if err != nil {
+		return store.SessionUser{}, err
+	}
+	defer forgetSession(r)
+	return session, store.Pub.VerifySessionMFA(r.Context(), session.SessionId)
+}
+
+// StepUp guards sensitive actions, they go through when the session checked
+// its second factor within stepUpWindow or the code given is valid.
+func StepUp(r *http.Request, code string) error {
+	session, err := getSession(r)
+	if err != nil {
+		return err
+	}
+	if time.Since(session.MFAVerifiedAt) < stepUpWindow {
+		return nil
+	}
+	if len(code) <= 0 {
+		return ErrStepUpRequired
+	}
+	err = VerifyCode(r.Context(), session.User.Id, code)
+	if err != nil {
+		return err
+	}
+	defer forgetSession(r)
+	return store.Pub.VerifySessionMFA(r.Context(), session.SessionId)
+}
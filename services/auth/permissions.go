@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"context"
+	"log/slog"
+	"shop/config"
+	"shop/services/store"
+)
+
+type permissionsKey struct{}
+
+// bootstrapActor is who the audit trail shows granting owner to the emails
+// in ADMIN_EMAILS.
+const bootstrapActor = "config:ADMIN_EMAILS"
+
+func WithPermissions(ctx context.Context, permissions store.Permissions) context.Context {
+	return context.WithValue(ctx, permissionsKey{}, permissions)
+}
+
+// Can tells handlers and templates if the admin of the request may do it,
+// it is false outside the routes behind RequirePermission.
+func Can(ctx context.Context, permission store.Permission) bool {
+	permissions, _ := ctx.Value(permissionsKey{}).(store.Permissions)
+	return permissions.Has(permission)
+}
+
+// SeedOwners makes owner the emails in ADMIN_EMAILS that have an account
+// and never had a role, it runs on startup so a revoke is never undone by a
+// login. An email signing up later is seeded on the next start.
+func SeedOwners(ctx context.Context) error {
+	seeded, err := store.Pub.SeedOwners(ctx, config.Envs.AdminEmails, bootstrapActor)
+	if err != nil {
+		return err
+	}
+	if seeded > 0 {
+		slog.Info("seeded owners from ADMIN_EMAILS", "count", seeded)
+	}
+	return nil
+}
+
+// IsStaff tells if the user has a role.
+func IsStaff(ctx context.Context, user store.User) (bool, error) {
+	permissions, err := store.Pub.GetPermissions(ctx, user.Id)
+	if err != nil {
+		return false, err
+	}
+	return len(permissions) > 0, nil
+}
@@ -1,82 +1,266 @@
 package auth
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
+	"net"
 	"net/http"
+	"net/netip"
+	"shop/config"
 	"shop/services/store"
+	"shop/services/tracing"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/gorilla/sessions"
+	"github.com/jackc/pgx/v5"
 )
 
 var ErrNoUserSessionFound = errors.New("no user found in session")
+var ErrNoAdminSessionFound = errors.New("no admin found in session")
+var ErrMFARequired = errors.New("session waits for the second factor")
 
 const sessionName = "user_session"
 
-var userCookie *sessions.CookieStore
+// cookieAge outlives any session on purpose, the store slides and revokes
+// sessions so the cookie only has to carry the token around.
+const cookieAge = 400 * 24 * time.Hour
+
+var sessionOptions SessionOptions
 
 type SessionOptions struct {
-	CookiesKey string
-	Path       string
-	MaxAge     int
-	HttpOnly   bool
-	Secure     bool
-	SameSite   http.SameSite
+	Path     string
+	MaxAge   int
+	HttpOnly bool
+	Secure   bool
+	SameSite http.SameSite
+}
+
+// NewSessionStore sets the cookie options, MaxAge is how long a session
+// lives without being used.
+func NewSessionStore(opts SessionOptions) {
+	sessionOptions = opts
 }
 
-func NewUserCookieStore(opts SessionOptions) {
-	userCookie = sessions.NewCookieStore([]byte(opts.CookiesKey))
-	userCookie.Options.Path = opts.Path
-	userCookie.Options.MaxAge = opts.MaxAge
-	userCookie.Options.HttpOnly = opts.HttpOnly
-	userCookie.Options.Secure = opts.Secure
-	userCookie.Options.SameSite = opts.SameSite
+func (opts SessionOptions) maxAge() time.Duration {
+	return time.Duration(opts.MaxAge) * time.Second
 }
 
+// SetUserSession opens a new session for the account on this device, a
+// session the device already had is revoked so privileges never carry over.
+// Accounts with two factor on get a session that waits for a code, it
+// returns ErrMFARequired after setting the cookie. Admins without two
+// factor get ErrMFANotEnabled and keep the session they had.
 func SetUserSession(w http.ResponseWriter, r *http.Request, account store.Account) error {
-	session, err := userCookie.Get(r, sessionName)
-	if err != nil {
-		return err
-	}
-	switch account.(type) {
+	var user store.User
+	var admin bool
+	switch account := account.(type) {
 	case store.User:
-		session.Values["user"] = account
+		user = account
 	case store.Admin:
-		session.Values["admin"] = account
+		user = store.User(account)
+		admin = true
 	default:
 		return errors.New("invalid struct for interface account")
 	}
-
-	err = session.Save(r, w)
+	mfaPending, err := HasMFA(r.Context(), user.Id)
 	if err != nil {
 		return err
 	}
+	if admin && !mfaPending {
+		return ErrMFANotEnabled
+	}
 
+	if hash, err := tokenHash(r); err == nil {
+		err = store.Pub.RevokeSessionToken(r.Context(), hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	token := make([]byte, 32)
+	_, err = rand.Read(token)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(token)
+	_, err = store.Pub.CreateSession(r.Context(), hash[:], user, admin, mfaPending, r.UserAgent(), ClientIP(r), sessionOptions.maxAge())
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessionCookie(base64.RawURLEncoding.EncodeToString(token), int(cookieAge.Seconds())))
+	forgetSession(r)
+	if mfaPending {
+		return ErrMFARequired
+	}
 	return nil
 }
 
-func GetUserSession(r *http.Request) (store.Account, error) {
-	session, err := userCookie.Get(r, sessionName)
+func GetUserSession(r *http.Request) (store.User, error) {
+	session, err := getSession(r)
 	if err != nil {
 		return store.User{}, err
 	}
+	return session.User, nil
+}
 
-	user, ok := session.Values["user"].(store.User)
-	if ok {
-		return user, nil
+func GetAdminSession(r *http.Request) (store.Admin, error) {
+	session, err := getSession(r)
+	if err == ErrNoUserSessionFound {
+		return store.Admin{}, ErrNoAdminSessionFound
+	}
+	if err != nil {
+		return store.Admin{}, err
 	}
-	admin, ok := session.Values["admin"].(store.Admin)
-	if ok {
-		return admin, nil
+	if !session.Admin {
+		return store.Admin{}, ErrNoAdminSessionFound
+	}
+	return store.Admin(session.User), nil
+}
+
+// CurrentSessionId is the id of the session of this device, it tells it
+// apart in the list of sessions.
+func CurrentSessionId(r *http.Request) (int, error) {
+	session, err := getSession(r)
+	if err != nil {
+		return -1, err
 	}
-	return user, ErrNoUserSessionFound
+	return session.SessionId, nil
 }
 
 func RemoveUserSession(w http.ResponseWriter, r *http.Request) error {
-	session, err := userCookie.Get(r, sessionName)
+	http.SetCookie(w, sessionCookie("", -1))
+	forgetSession(r)
+	hash, err := tokenHash(r)
 	if err != nil {
 		return err
 	}
+	return store.Pub.RevokeSessionToken(r.Context(), hash)
+}
+
+// getSession returns the usable session of the request, one waiting for the
+// second factor returns ErrMFARequired.
+func getSession(r *http.Request) (store.SessionUser, error) {
+	session, err := lookupSession(r)
+	if err != nil {
+		return store.SessionUser{}, err
+	}
+	if session.MFAPending {
+		return store.SessionUser{}, ErrMFARequired
+	}
+	return session, nil
+}
+
+type sessionKey struct{}
 
-	session.Options.MaxAge = -1
-	return session.Save(r, w)
+// sessionCache holds the session of one request, it is looked up the first
+// time something asks for it and shared with everything after.
+type sessionCache struct {
+	mu      sync.Mutex
+	loaded  bool
+	session store.SessionUser
+	err     error
+}
+
+// WithSessionCache gives the request a place to keep its session, the
+// middleware sets it before the logger and the handlers read the session.
+func WithSessionCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sessionKey{}, &sessionCache{})
+}
+
+func lookupSession(r *http.Request) (store.SessionUser, error) {
+	cache, ok := r.Context().Value(sessionKey{}).(*sessionCache)
+	if !ok {
+		return fetchSession(r)
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if !cache.loaded {
+		cache.session, cache.err = fetchSession(r)
+		cache.loaded = true
+	}
+	return cache.session, cache.err
+}
+
+// forgetSession drops the cached session once the request changed it, the
+// next read looks it up again.
+func forgetSession(r *http.Request) {
+	cache, ok := r.Context().Value(sessionKey{}).(*sessionCache)
+	if !ok {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.loaded = false
+}
+
+func fetchSession(r *http.Request) (store.SessionUser, error) {
+	ctx, span := tracing.Tracer.Start(r.Context(), "session.decode")
+	defer span.End()
+	hash, err := tokenHash(r)
+	if err != nil {
+		return store.SessionUser{}, err
+	}
+	session, err := store.Pub.GetSession(ctx, hash, sessionOptions.maxAge())
+	if err == pgx.ErrNoRows {
+		return store.SessionUser{}, ErrNoUserSessionFound
+	}
+	if err != nil {
+		return store.SessionUser{}, err
+	}
+	return session, nil
+}
+
+func tokenHash(r *http.Request) ([]byte, error) {
+	cookie, err := r.Cookie(sessionName)
+	if err != nil {
+		return nil, ErrNoUserSessionFound
+	}
+	token, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || len(token) <= 0 {
+		return nil, ErrNoUserSessionFound
+	}
+	hash := sha256.Sum256(token)
+	return hash[:], nil
+}
+
+func sessionCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     sessionName,
+		Value:    value,
+		Path:     sessionOptions.Path,
+		MaxAge:   maxAge,
+		HttpOnly: sessionOptions.HttpOnly,
+		Secure:   sessionOptions.Secure,
+		SameSite: sessionOptions.SameSite,
+	}
+}
+
+// ClientIP is the address the request came from, without its port. Behind
+// the proxies in TRUSTED_PROXIES it is the last X-Forwarded-For entry they
+// didnt add, the entries before it are whatever the client sent.
+func ClientIP(r *http.Request) string {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	remote, err := netip.ParseAddr(client)
+	if err != nil || !config.Envs.TrustedProxy(remote) {
+		return client
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			return client
+		}
+		client = addr.Unmap().String()
+		if !config.Envs.TrustedProxy(addr) {
+			return client
+		}
+	}
+	return client
 }
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"shop/config"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	config.Envs.TrustedProxies = []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("192.168.1.5/32"),
+	}
+	defer func() { config.Envs.TrustedProxies = nil }()
+	tests := map[string]struct {
+		remote    string
+		forwarded []string
+		expected  string
+	}{
+		`direct`: {
+			remote:   "203.0.113.7:5000",
+			expected: "203.0.113.7",
+		},
+		`untrustedForwards`: {
+			remote:    "203.0.113.7:5000",
+			forwarded: []string{"198.51.100.1"},
+			expected:  "203.0.113.7",
+		},
+		`trustedProxy`: {
+			remote:    "10.0.0.2:5000",
+			forwarded: []string{"198.51.100.1"},
+			expected:  "198.51.100.1",
+		},
+		`spoofedEntry`: {
+			remote:    "10.0.0.2:5000",
+			forwarded: []string{"1.1.1.1, 198.51.100.1"},
+			expected:  "198.51.100.1",
+		},
+		`proxyChain`: {
+			remote:    "10.0.0.2:5000",
+			forwarded: []string{"198.51.100.1, 192.168.1.5", "10.0.0.9"},
+			expected:  "198.51.100.1",
+		},
+		`mangledEntry`: {
+			remote:    "10.0.0.2:5000",
+			forwarded: []string{"not-an-ip"},
+			expected:  "10.0.0.2",
+		},
+		`noHeader`: {
+			remote:   "10.0.0.2:5000",
+			expected: "10.0.0.2",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, value := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			got := ClientIP(r)
+			if got != tt.expected {
+				t.Errorf("remote: %v, forwarded: %v, got: %v, expected: %v", tt.remote, tt.forwarded, got, tt.expected)
+			}
+		})
+	}
+}
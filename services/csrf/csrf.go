@@ -0,0 +1,67 @@
+package csrf
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"shop/services/signed"
+)
+
+const (
+	CookieName = "csrf_token"
+	HeaderName = "X-CSRF-Token"
+	FieldName  = "csrf_token"
+)
+
+type tokenKey struct{}
+
+// NewToken returns a random token, it goes to the cookie signed and to the
+// page as is, a request is legit when both halves match.
+func NewToken() (string, error) {
+	token := make([]byte, 32)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+const purpose = "csrf"
+
+// Sign appends the mac of the token so a cookie planted by a sibling domain
+// doesnt pass as ours.
+func Sign(secret []byte, token string) string {
+	return signed.Sign(secret, purpose, token)
+}
+
+// Verify returns the token of a signed cookie value.
+func Verify(secret []byte, value string) (string, bool) {
+	return signed.Verify(secret, purpose, value)
+}
+
+func Equal(a, b string) bool {
+	if len(a) <= 0 || len(b) <= 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func WithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// Token is the token of the request, templates render it for forms and
+// scripts to send back.
+func Token(ctx context.Context) string {
+	token, _ := ctx.Value(tokenKey{}).(string)
+	return token
+}
+
+// Headers is the hx-headers value that makes every HTMX request carry the
+// token.
+func Headers(ctx context.Context) string {
+	headers, _ := json.Marshal(map[string]string{HeaderName: Token(ctx)})
+	return string(headers)
+}
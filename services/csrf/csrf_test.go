@@ -0,0 +1,66 @@
+package csrf
+
+import (
+	"testing"
+)
+
+// the mac itself is covered by the signed package, these cases are the
+// pairing of the signed cookie with the token sent by the page.
+func TestPairing(t *testing.T) {
+	secret := []byte("secret")
+	token, err := NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := Sign(secret, token)
+	tests := map[string]struct {
+		cookie string
+		sent   string
+		pairs  bool
+	}{
+		`sameToken`: {
+			cookie: cookie,
+			sent:   token,
+			pairs:  true,
+		},
+		`otherToken`: {
+			cookie: cookie,
+			sent:   other,
+		},
+		`signedSent`: {
+			cookie: cookie,
+			sent:   cookie,
+		},
+		`unsignedCookie`: {
+			cookie: token,
+			sent:   token,
+		},
+		`noneSent`: {
+			cookie: cookie,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, ok := Verify(secret, tt.cookie)
+			if pairs := ok && Equal(got, tt.sent); pairs != tt.pairs {
+				t.Errorf("cookie: %q, sent: %q, pairs = %v, want %v", tt.cookie, tt.sent, pairs, tt.pairs)
+			}
+		})
+	}
+}
+
+func TestEqual(t *testing.T) {
+	if Equal("", "") {
+		t.Error("empty tokens must not match")
+	}
+	if Equal("a", "b") {
+		t.Error("different tokens must not match")
+	}
+	if !Equal("abc", "abc") {
+		t.Error("same tokens must match")
+	}
+}
@@ -0,0 +1,112 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"shop/config"
+	"time"
+
+	"github.com/a-h/templ"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	HTML    string
+	Text    string
+}
+
+type Sender interface {
+	Send(ctx context.Context, message Message) error
+}
+
+var Pub Sender = FileSender{Dir: os.TempDir(), From: "shop@localhost"}
+
+func Init(sender Sender) error {
+	if sender == nil {
+		return errors.New("sender is nil, cant set a nil sender")
+	}
+	Pub = sender
+	return nil
+}
+
+// NewSender sends through SMTP when a host is configured, otherwise emails
+// are written to EMAIL_DIR so they can be opened while developing.
+func NewSender() Sender {
+	if len(config.Envs.SMTPHost) > 0 {
+		return SMTPSender{
+			Host:     config.Envs.SMTPHost,
+			Port:     config.Envs.SMTPPort,
+			Username: config.Envs.SMTPUsername,
+			Password: config.Envs.SMTPPassword,
+			From:     config.Envs.EmailFrom,
+		}
+	}
+	return FileSender{Dir: config.Envs.EmailDir, From: config.Envs.EmailFrom}
+}
+
+func Render(ctx context.Context, to, subject string, html templ.Component, text string) (Message, error) {
+	var buf bytes.Buffer
+	err := html.Render(ctx, &buf)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{To: to, Subject: subject, HTML: buf.String(), Text: text}, nil
+}
+
+func (m Message) Valid() error {
+	if len(m.To) <= 0 {
+		return errors.New("email has no recipient")
+	}
+	if len(m.Subject) <= 0 {
+		return errors.New("email has no subject")
+	}
+	return nil
+}
+
+// Bytes builds the multipart/alternative MIME message, text part first so
+// clients that can show HTML pick the last one.
+func (m Message) Bytes(from string) ([]byte, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	parts := []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=UTF-8", m.Text},
+		{"text/html; charset=UTF-8", m.HTML},
+	}
+	for _, part := range parts {
+		w, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"8bit"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		_, err = w.Write([]byte(part.content))
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", m.To)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", m.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", writer.Boundary())
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
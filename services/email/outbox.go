@@ -0,0 +1,77 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"shop/services/store"
+	"time"
+)
+
+const (
+	outboxBatch       = 20
+	outboxMaxAttempts = 8
+)
+
+// Enqueue stores the message in the outbox, it is sent later by RunOutbox so
+// a failing email provider never breaks the request that produced it.
+func Enqueue(ctx context.Context, message Message) error {
+	if err := message.Valid(); err != nil {
+		return err
+	}
+	_, err := store.Pub.EnqueueEmail(ctx, store.Email{
+		To:      message.To,
+		Subject: message.Subject,
+		HTML:    message.HTML,
+		Text:    message.Text,
+	})
+	return err
+}
+
+// Deliver sends one batch of the outbox. An email that couldnt be recorded
+// doesnt stop the rest of the batch, it is claimed again once its lease runs
+// out.
+func Deliver(ctx context.Context) error {
+	emails, err := store.Pub.ClaimEmails(ctx, outboxBatch)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, email := range emails {
+		err := Pub.Send(ctx, Message{
+			To:      email.To,
+			Subject: email.Subject,
+			HTML:    email.HTML,
+			Text:    email.Text,
+		})
+		if err == nil {
+			err = store.Pub.MarkEmailSent(ctx, email.Id)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("cant mark email %d as sent: %w", email.Id, err))
+			}
+			continue
+		}
+		slog.Error("email delivery failed", "err", err, "email", email.Id, "attempts", email.Attempts)
+		err = store.Pub.MarkEmailFailed(ctx, email.Id, err.Error(), outboxMaxAttempts)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cant mark email %d as failed: %w", email.Id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func RunOutbox(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := Deliver(ctx); err != nil {
+				slog.Error("email outbox run failed", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type SMTPSender struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s SMTPSender) Send(ctx context.Context, message Message) error {
+	if err := message.Valid(); err != nil {
+		return err
+	}
+	msg, err := message.Bytes(s.From)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if len(s.Username) > 0 {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+	return smtp.SendMail(net.JoinHostPort(s.Host, s.Port), auth, s.From, []string{message.To}, msg)
+}
+
+type FileSender struct {
+	Dir  string
+	From string
+}
+
+func (f FileSender) Send(ctx context.Context, message Message) error {
+	if err := message.Valid(); err != nil {
+		return err
+	}
+	msg, err := message.Bytes(f.From)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(f.Dir, 0o755)
+	if err != nil {
+		return err
+	}
+	recipient := strings.NewReplacer("@", "_at_", "/", "_", "\\", "_").Replace(message.To)
+	path := filepath.Join(f.Dir, fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), recipient))
+	err = os.WriteFile(path, msg, 0o644)
+	if err != nil {
+		return err
+	}
+	slog.Info("email written", "to", message.To, "subject", message.Subject, "path", path)
+	return nil
+}
@@ -0,0 +1,167 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"shop/services/store"
+	"sync"
+	"time"
+)
+
+const (
+	batch       = 10
+	lease       = 5 * time.Minute
+	baseBackoff = 30 * time.Second
+	maxBackoff  = 6 * time.Hour
+)
+
+// ErrPermanent wraps errors that retrying cant fix, the job goes straight to
+// the dead jobs table.
+var ErrPermanent = errors.New("permanent job error")
+
+type handler func(ctx context.Context, payload []byte) error
+
+var (
+	handlersMu sync.RWMutex
+	handlers   = map[string]handler{}
+)
+
+// Kind is a job type whose payload is T, it is stored as JSON.
+type Kind[T any] struct {
+	Name string
+}
+
+func (k Kind[T]) Enqueue(ctx context.Context, payload T) error {
+	return k.EnqueueAt(ctx, payload, time.Now())
+}
+
+func (k Kind[T]) EnqueueAt(ctx context.Context, payload T, runAt time.Time) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = store.Pub.EnqueueJob(ctx, k.Name, data, runAt)
+	if err != nil {
+		return fmt.Errorf("cant enqueue %s job: %w", k.Name, err)
+	}
+	return nil
+}
+
+func Handle[T any](kind Kind[T], fn func(ctx context.Context, payload T) error) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	handlers[kind.Name] = func(ctx context.Context, data []byte) error {
+		var payload T
+		if err := json.Unmarshal(data, &payload); err != nil {
+			return fmt.Errorf("%w: %w", ErrPermanent, err)
+		}
+		return fn(ctx, payload)
+	}
+}
+
+// Backoff is how long a job waits before its next attempt, it doubles on
+// every attempt up to maxBackoff.
+func Backoff(attempt int) time.Duration {
+	if attempt <= 1 {
+		return baseBackoff
+	}
+	delay := baseBackoff
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return delay
+}
+
+type jobKey struct{}
+
+// JobId is the id of the job a handler runs, handlers use it to make their
+// work and the job completion one transaction.
+func JobId(ctx context.Context) int {
+	id, _ := ctx.Value(jobKey{}).(int)
+	return id
+}
+
+// Work runs one batch of due jobs and returns how many it claimed. A job
+// that couldnt be recorded doesnt stop the rest of the batch, its lease runs
+// out and it is claimed again.
+func Work(ctx context.Context) (int, error) {
+	claimed, err := store.Pub.ClaimJobs(ctx, batch, lease)
+	if err != nil {
+		return 0, err
+	}
+	var errs []error
+	for _, job := range claimed {
+		err := run(ctx, job)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("job %d: %w", job.Id, err))
+		}
+	}
+	return len(claimed), errors.Join(errs...)
+}
+
+func run(ctx context.Context, job store.Job) error {
+	handlersMu.RLock()
+	fn, ok := handlers[job.Kind]
+	handlersMu.RUnlock()
+	var err error
+	if ok {
+		err = fn(context.WithValue(ctx, jobKey{}, job.Id), job.Payload)
+	} else {
+		err = fmt.Errorf("%w: no handler for job kind %s", ErrPermanent, job.Kind)
+	}
+	if err == nil {
+		return store.Pub.CompleteJob(ctx, job.Id)
+	}
+	slog.Error("job failed", "err", err, "job", job.Id, "kind", job.Kind, "attempts", job.Attempts)
+	if errors.Is(err, ErrPermanent) || job.Attempts >= job.MaxAttempts {
+		return store.Pub.BuryJob(ctx, job.Id, err.Error())
+	}
+	return store.Pub.RetryJob(ctx, job.Id, err.Error(), Backoff(job.Attempts))
+}
+
+// Run works the queue until ctx is done. A batch that already started is
+// finished with a context that isnt cancelled, so shutting down drains the
+// jobs in hand instead of leaving them leased.
+func Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for {
+				claimed, err := Work(context.WithoutCancel(ctx))
+				if err != nil {
+					slog.Error("job queue run failed", "err", err)
+				}
+				if claimed < batch || ctx.Err() != nil {
+					break
+				}
+			}
+		}
+	}
+}
+
+// Every enqueues the job on each tick until ctx is done, handlers of
+// scheduled jobs must be fine running more than once.
+func Every[T any](ctx context.Context, interval time.Duration, kind Kind[T], payload T) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := kind.Enqueue(ctx, payload); err != nil {
+				slog.Error("scheduling job failed", "err", err, "kind", kind.Name)
+			}
+		}
+	}
+}
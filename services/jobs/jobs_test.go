@@ -0,0 +1,38 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := map[string]struct {
+		attempt  int
+		expected time.Duration
+	}{
+		`noAttempts`: {
+			attempt:  0,
+			expected: 30 * time.Second,
+		},
+		`firstAttempt`: {
+			attempt:  1,
+			expected: 30 * time.Second,
+		},
+		`thirdAttempt`: {
+			attempt:  3,
+			expected: 2 * time.Minute,
+		},
+		`capped`: {
+			attempt:  30,
+			expected: 6 * time.Hour,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := Backoff(tt.attempt)
+			if got != tt.expected {
+				t.Errorf("attempt: %v, got: %v, expected: %v", tt.attempt, got, tt.expected)
+			}
+		})
+	}
+}
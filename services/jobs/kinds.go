@@ -0,0 +1,64 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"shop/services/notify"
+	"shop/services/store"
+	"time"
+)
+
+type StockPayload struct {
+	Items []store.OrderItems `json:"items"`
+}
+
+type CartPayload struct {
+	UserId int `json:"userId"`
+}
+
+type OrderPayload struct {
+	OrderId int `json:"orderId"`
+}
+
+type CleanupPayload struct {
+	KeepEmails time.Duration `json:"keepEmails"`
+}
+
+var (
+	UpdateStock  = Kind[StockPayload]{Name: "update_stock"}
+	EmptyCart    = Kind[CartPayload]{Name: "empty_cart"}
+	ConfirmOrder = Kind[OrderPayload]{Name: "confirm_order"}
+	Cleanup      = Kind[CleanupPayload]{Name: "cleanup"}
+)
+
+// Init registers the handlers of the jobs the shop runs.
+func Init() {
+	Handle(UpdateStock, func(ctx context.Context, payload StockPayload) error {
+		err := store.Pub.CompleteStockJob(ctx, JobId(ctx), payload.Items)
+		if err == store.ErrStockBelowZero {
+			return fmt.Errorf("%w: %w", ErrPermanent, err)
+		}
+		return err
+	})
+	Handle(EmptyCart, func(ctx context.Context, payload CartPayload) error {
+		return store.Pub.EmptyingCart(ctx, payload.UserId)
+	})
+	Handle(ConfirmOrder, func(ctx context.Context, payload OrderPayload) error {
+		order, err := store.Pub.GetOrder(ctx, payload.OrderId)
+		if err != nil {
+			return err
+		}
+		return notify.OrderConfirmed(ctx, order)
+	})
+	// every purge runs even when an earlier one fails, a broken table
+	// shouldnt leave the others growing.
+	Handle(Cleanup, func(ctx context.Context, payload CleanupPayload) error {
+		_, emailsErr := store.Pub.PurgeEmails(ctx, payload.KeepEmails)
+		_, sessionsErr := store.Pub.PurgeSessions(ctx)
+		_, magicLinksErr := store.Pub.PurgeMagicLinks(ctx)
+		_, emailChangesErr := store.Pub.PurgeEmailChanges(ctx)
+		_, rateLimitsErr := store.Pub.PurgeRateLimits(ctx)
+		return errors.Join(emailsErr, sessionsErr, magicLinksErr, emailChangesErr, rateLimitsErr)
+	})
+}
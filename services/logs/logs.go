@@ -0,0 +1,23 @@
+package logs
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// FromContext returns the default logger tagged with the request and trace
+// ids of ctx, so store and gateway logs can be matched with the request that
+// caused them.
+func FromContext(ctx context.Context) *slog.Logger {
+	logger := slog.Default()
+	if id := middleware.GetReqID(ctx); len(id) > 0 {
+		logger = logger.With("request_id", id)
+	}
+	if span := trace.SpanContextFromContext(ctx); span.HasTraceID() {
+		logger = logger.With("trace_id", span.TraceID().String())
+	}
+	return logger
+}
@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "shop"
+
+var (
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by chi route pattern, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	RateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Requests turned down with 429 by rate limit policy and bucket kind.",
+	}, []string{"policy", "by"})
+
+	CartAdds = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "checkout",
+		Name:      "cart_adds_total",
+		Help:      "Products added to a cart.",
+	})
+	OrdersCreated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "checkout",
+		Name:      "orders_created_total",
+		Help:      "Orders created on the payment provider.",
+	}, []string{"provider"})
+	PaymentsCaptured = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "checkout",
+		Name:      "payments_captured_total",
+		Help:      "Payments captured by currency.",
+	}, []string{"provider", "currency"})
+	PaymentsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "checkout",
+		Name:      "payments_failed_total",
+		Help:      "Captures that didnt complete by the status the provider returned.",
+	}, []string{"provider", "status"})
+
+	PaypalDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "paypal",
+		Name:      "request_duration_seconds",
+		Help:      "PayPal API call latency by operation.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 20},
+	}, []string{"operation"})
+	PaypalErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "paypal",
+		Name:      "request_errors_total",
+		Help:      "PayPal API calls that failed or answered with an error status.",
+	}, []string{"operation"})
+)
@@ -0,0 +1,38 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	templates "shop/views/email"
+	"time"
+)
+
+func MagicLink(ctx context.Context, to, link string, ttl time.Duration) error {
+	return Pub.Notify(ctx, Notification{
+		To:       to,
+		Subject:  "Your login link",
+		Body:     fmt.Sprintf("Open the link to log in, it works once and expires in %d minutes. If you didn't ask for it you can ignore this email.", int(ttl.Minutes())),
+		Link:     link,
+		Template: templates.MagicLink(link, int(ttl.Minutes())),
+	})
+}
+
+func ConfirmEmail(ctx context.Context, to, link string, ttl time.Duration) error {
+	return Pub.Notify(ctx, Notification{
+		To:       to,
+		Subject:  "Confirm your new email",
+		Body:     fmt.Sprintf("Open the link while logged in to use this email in the shop, it expires in %d hours. If you didn't ask for it you can ignore this email.", int(ttl.Hours())),
+		Link:     link,
+		Template: templates.ConfirmEmail(link, int(ttl.Hours())),
+	})
+}
+
+// EmailChanged tells the old address, in case someone else took the account.
+func EmailChanged(ctx context.Context, to, newEmail string) error {
+	return Pub.Notify(ctx, Notification{
+		To:       to,
+		Subject:  "Your email changed",
+		Body:     fmt.Sprintf("Your account now uses %s, this address no longer logs in. If it wasn't you, contact us right away.", newEmail),
+		Template: templates.EmailChanged(newEmail),
+	})
+}
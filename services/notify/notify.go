@@ -0,0 +1,76 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"shop/services/email"
+	templates "shop/views/email"
+
+	"github.com/a-h/templ"
+)
+
+type Notification struct {
+	To      string
+	Subject string
+	Body    string
+	Link    string
+	// Template is the html version, when nil the body and link are rendered
+	// with the default notification template.
+	Template templ.Component
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, notification Notification) error
+}
+
+var Pub Notifier = logNotifier{}
+
+func Init(notifier Notifier) error {
+	if notifier == nil {
+		return errors.New("notifier is nil, cant set a nil notifier")
+	}
+	Pub = notifier
+	return nil
+}
+
+type logNotifier struct{}
+
+func (l logNotifier) Notify(ctx context.Context, notification Notification) error {
+	if len(notification.To) <= 0 {
+		return errors.New("notification has no recipient")
+	}
+	slog.Info("notification",
+		"to", notification.To,
+		"subject", notification.Subject,
+		"body", notification.Body,
+		"link", notification.Link,
+	)
+	return nil
+}
+
+// EmailNotifier queues notifications in the email outbox.
+type EmailNotifier struct{}
+
+func (e EmailNotifier) Notify(ctx context.Context, notification Notification) error {
+	if len(notification.To) <= 0 {
+		return errors.New("notification has no recipient")
+	}
+	html := notification.Template
+	if html == nil {
+		html = templates.Notification(notification.Subject, notification.Body, notification.Link)
+	}
+	message, err := email.Render(ctx, notification.To, notification.Subject, html, text(notification))
+	if err != nil {
+		return err
+	}
+	return email.Enqueue(ctx, message)
+}
+
+func text(notification Notification) string {
+	if len(notification.Link) <= 0 {
+		return notification.Body + "\n"
+	}
+	return fmt.Sprintf("%s\n\n%s\n", notification.Body, notification.Link)
+}
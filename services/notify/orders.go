@@ -0,0 +1,81 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"shop/config"
+	"shop/services/store"
+	templates "shop/views/email"
+	"strings"
+)
+
+func OrderConfirmed(ctx context.Context, order store.OrderDetail) error {
+	link := OrderURL(order.Id)
+	err := Pub.Notify(ctx, Notification{
+		To:       order.PayerEmail,
+		Subject:  fmt.Sprintf("Order #%d confirmed", order.Id),
+		Body:     orderBody(order, fmt.Sprintf("Thanks for your order, we received the payment for order #%d.", order.Id)),
+		Link:     link,
+		Template: templates.OrderConfirmation(order, link),
+	})
+	for _, admin := range config.Envs.AdminEmails {
+		adminLink := AdminOrderURL(order.Id)
+		err = errors.Join(err, Pub.Notify(ctx, Notification{
+			To:       admin,
+			Subject:  fmt.Sprintf("New order #%d", order.Id),
+			Body:     orderBody(order, fmt.Sprintf("%s <%s> paid order #%d.", order.PayerName, order.PayerEmail, order.Id)),
+			Link:     adminLink,
+			Template: templates.NewOrder(order, adminLink),
+		}))
+	}
+	return err
+}
+
+// OrderShipped and OrderRefunded skip orders without a payer email, the
+// orders of deleted users have no one to tell.
+func OrderShipped(ctx context.Context, order store.OrderDetail, shipment store.Shipment) error {
+	if len(order.PayerEmail) <= 0 {
+		return nil
+	}
+	link := OrderURL(order.Id)
+	return Pub.Notify(ctx, Notification{
+		To:       order.PayerEmail,
+		Subject:  fmt.Sprintf("Your order #%d is on its way", order.Id),
+		Body:     fmt.Sprintf("Your package was shipped with %s, the tracking number is %s.", shipment.Carrier, shipment.TrackingNumber),
+		Link:     link,
+		Template: templates.OrderShipped(order, shipment, link),
+	})
+}
+
+func OrderRefunded(ctx context.Context, order store.OrderDetail, reason string) error {
+	if len(order.PayerEmail) <= 0 {
+		return nil
+	}
+	link := OrderURL(order.Id)
+	return Pub.Notify(ctx, Notification{
+		To:       order.PayerEmail,
+		Subject:  fmt.Sprintf("Order #%d refunded", order.Id),
+		Body:     fmt.Sprintf("Order #%d was %s. %s", order.Id, order.PaymentStatus.Label(), reason),
+		Link:     link,
+		Template: templates.OrderRefunded(order, reason, link),
+	})
+}
+
+func orderBody(order store.OrderDetail, intro string) string {
+	var body strings.Builder
+	body.WriteString(intro + "\n\n")
+	for _, line := range order.Lines {
+		fmt.Fprintf(&body, "%s x%d  %.*f %s\n", line.Name, line.Quantity, 2, line.Total, order.Currency)
+	}
+	fmt.Fprintf(&body, "\ntotal: %.*f %s", 2, order.Total, order.Currency)
+	return body.String()
+}
+
+func OrderURL(id int) string {
+	return fmt.Sprintf("%s/orders/%d", config.Envs.PublicURL, id)
+}
+
+func AdminOrderURL(id int) string {
+	return fmt.Sprintf("%s/admin/orders/%d", config.Envs.PublicURL, id)
+}
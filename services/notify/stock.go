@@ -0,0 +1,62 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"shop/config"
+	"shop/services/store"
+	"time"
+)
+
+const backInStockBatch = 50
+
+func BackInStock(ctx context.Context) error {
+	subscriptions, err := store.Pub.ClaimBackInStock(ctx, backInStockBatch)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, subscription := range subscriptions {
+		err := Pub.Notify(ctx, backInStockNotification(subscription))
+		if err == nil {
+			continue
+		}
+		slog.Error("back in stock notification failed", "err", err, "subscription", subscription.Id)
+		err = store.Pub.ReleaseBackInStock(ctx, subscription.Id)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cant release subscription %d: %w", subscription.Id, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func RunBackInStock(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := BackInStock(ctx); err != nil {
+				slog.Error("back in stock run failed", "err", err)
+			}
+		}
+	}
+}
+
+func backInStockNotification(subscription store.StockSubscription) Notification {
+	return Notification{
+		To:      subscription.Email,
+		Subject: fmt.Sprintf("%s is back in stock", subscription.ProductName),
+		Body:    fmt.Sprintf("Good news, %s is available again. Get it before it runs out.", subscription.ProductName),
+		Link:    ProductURL(subscription.ProductName, subscription.Sku),
+	}
+}
+
+func ProductURL(name string, sku store.Sku) string {
+	return fmt.Sprintf("%s/%s/p/%s", config.Envs.PublicURL, url.PathEscape(name), string(sku))
+}
@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"context"
+	"shop/config"
+	"sync"
+	"time"
+)
+
+// sweepEvery is how often refilled buckets are dropped so keys of clients
+// gone long ago dont pile up.
+const sweepEvery = time.Minute
+
+type entry struct {
+	bucket
+	limit config.RateLimit
+}
+
+// Memory keeps the buckets of this instance only.
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]*entry
+	swept   time.Time
+	now     func() time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{buckets: map[string]*entry{}, now: time.Now}
+}
+
+func (m *Memory) Take(ctx context.Context, key string, limit config.RateLimit) (time.Duration, error) {
+	if limit.PerMinute <= 0 {
+		return 0, nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if now.Sub(m.swept) >= sweepEvery {
+		m.sweep(now)
+	}
+	e, ok := m.buckets[key]
+	if !ok {
+		e = &entry{bucket: bucket{tokens: float64(limit.Burst), at: now}}
+		m.buckets[key] = e
+	}
+	e.limit = limit
+	return e.take(limit, now), nil
+}
+
+func (m *Memory) sweep(now time.Time) {
+	for key, e := range m.buckets {
+		if e.full(e.limit, now) {
+			delete(m.buckets, key)
+		}
+	}
+	m.swept = now
+}
@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"shop/config"
+	"shop/services/store"
+	"time"
+)
+
+// Limiter spends a token of the bucket of the key, it returns how long until
+// the next token when the bucket is empty and zero when the token was taken.
+type Limiter interface {
+	Take(ctx context.Context, key string, limit config.RateLimit) (time.Duration, error)
+}
+
+var Pub Limiter = NewMemory()
+
+func Init(limiter Limiter) error {
+	if limiter == nil {
+		return errors.New("limiter is nil, cant set a nil limiter")
+	}
+	Pub = limiter
+	return nil
+}
+
+// New picks the store of the buckets, memory keeps them per instance while
+// postgres shares them between every instance of the shop.
+func New(name string) (Limiter, error) {
+	switch name {
+	case "memory":
+		return NewMemory(), nil
+	case "postgres":
+		return Postgres{}, nil
+	default:
+		return nil, errors.New("not a supported rate limit store, use memory or postgres")
+	}
+}
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// take refills the bucket for the time since it was last used and spends a
+// token of it when there is a whole one.
+func (b *bucket) take(limit config.RateLimit, now time.Time) time.Duration {
+	perSecond := float64(limit.PerMinute) / 60
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.at).Seconds()*perSecond)
+	b.at = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+}
+
+// full tells if the bucket refilled, forgetting it then changes nothing.
+func (b *bucket) full(limit config.RateLimit, now time.Time) bool {
+	perSecond := float64(limit.PerMinute) / 60
+	return b.tokens+now.Sub(b.at).Seconds()*perSecond >= float64(limit.Burst)
+}
+
+// Postgres keeps the buckets in the database.
+type Postgres struct{}
+
+func (p Postgres) Take(ctx context.Context, key string, limit config.RateLimit) (time.Duration, error) {
+	if limit.PerMinute <= 0 {
+		return 0, nil
+	}
+	return store.Pub.TakeRateToken(ctx, key, limit.PerMinute, limit.Burst)
+}
@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"context"
+	"shop/config"
+	"testing"
+	"time"
+)
+
+func TestMemoryTake(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := NewMemory()
+	m.now = func() time.Time { return now }
+	limit := config.RateLimit{PerMinute: 60, Burst: 2}
+	for i := 0; i < 2; i++ {
+		if wait, _ := m.Take(context.Background(), "ip", limit); wait != 0 {
+			t.Fatalf("take %d waited %s, want the burst to go through", i, wait)
+		}
+	}
+	if wait, _ := m.Take(context.Background(), "ip", limit); wait != time.Second {
+		t.Fatalf("take past the burst waited %s, want 1s", wait)
+	}
+	if wait, _ := m.Take(context.Background(), "other", limit); wait != 0 {
+		t.Fatalf("another key waited %s, want its own bucket", wait)
+	}
+	now = now.Add(time.Second)
+	if wait, _ := m.Take(context.Background(), "ip", limit); wait != 0 {
+		t.Fatalf("take after the refill waited %s", wait)
+	}
+}
+
+func TestMemoryDisabled(t *testing.T) {
+	m := NewMemory()
+	for i := 0; i < 100; i++ {
+		if wait, _ := m.Take(context.Background(), "ip", config.RateLimit{}); wait != 0 {
+			t.Fatalf("a limit without rate waited %s", wait)
+		}
+	}
+}
+
+func TestMemorySweep(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := NewMemory()
+	m.now = func() time.Time { return now }
+	limit := config.RateLimit{PerMinute: 60, Burst: 5}
+	m.Take(context.Background(), "gone", limit)
+	now = now.Add(sweepEvery)
+	m.Take(context.Background(), "here", limit)
+	if _, ok := m.buckets["gone"]; ok {
+		t.Error("sweep kept a refilled bucket")
+	}
+	if _, ok := m.buckets["here"]; !ok {
+		t.Error("sweep dropped the bucket in use")
+	}
+}
@@ -0,0 +1,34 @@
+package signed
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// Sign appends the mac of the value, the purpose goes into the mac so a
+// value signed for one use doesnt pass as another one.
+func Sign(secret []byte, purpose, value string) string {
+	return value + "." + base64.RawURLEncoding.EncodeToString(mac(secret, purpose, value))
+}
+
+// Verify returns the value of a signed string, ok is false when the mac
+// doesnt match the secret and purpose.
+func Verify(secret []byte, purpose, signed string) (string, bool) {
+	value, sum, ok := strings.Cut(signed, ".")
+	if !ok || len(value) <= 0 {
+		return "", false
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sum)
+	if err != nil || !hmac.Equal(got, mac(secret, purpose, value)) {
+		return "", false
+	}
+	return value, true
+}
+
+func mac(secret []byte, purpose, value string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(purpose + ":" + value))
+	return h.Sum(nil)
+}
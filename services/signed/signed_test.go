@@ -0,0 +1,32 @@
+package signed
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+	signed := Sign(secret, "test", "value")
+
+	got, ok := Verify(secret, "test", signed)
+	if !ok || got != "value" {
+		t.Fatalf("Verify(%q) = %q, %v, want value, true", signed, got, ok)
+	}
+	value, sum, _ := strings.Cut(signed, ".")
+	cases := map[string]string{
+		"empty":        "",
+		"no mac":       value,
+		"empty mac":    value + ".",
+		"no value":     "." + sum,
+		"other value":  "A" + signed,
+		"cut mac":      value + "." + sum[1:],
+		"other secret": Sign([]byte("other"), "test", "value"),
+		"other use":    Sign(secret, "other", "value"),
+	}
+	for name, s := range cases {
+		if _, ok := Verify(secret, "test", s); ok {
+			t.Errorf("%s: Verify(%q) passed", name, s)
+		}
+	}
+}
@@ -5,8 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"shop/config"
 	"shop/gateaways"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -16,27 +21,73 @@ import (
 type provider string
 type Sku string
 type currency string
+type fulfillmentStatus string
+type orderStatus string
 
 const (
 	Google provider = "google"
 	Local  provider = "local"
+	// MagicLink users log in with a link sent to their email.
+	MagicLink provider = "email"
 )
 const (
 	USD currency = "USD"
 	COP currency = "COP"
 )
+const (
+	Paid             fulfillmentStatus = "paid"
+	Packed           fulfillmentStatus = "packed"
+	PartiallyShipped fulfillmentStatus = "partially_shipped"
+	Shipped          fulfillmentStatus = "shipped"
+	Delivered        fulfillmentStatus = "delivered"
+)
+const (
+	Completed         orderStatus = "COMPLETED"
+	Pending           orderStatus = "PENDING"
+	PartiallyRefunded orderStatus = "PARTIALLY_REFUNDED"
+	Declined          orderStatus = "DECLINED"
+	Refunded          orderStatus = "REFUNDED"
+	Failed            orderStatus = "FAILED"
+)
+
+var ErrIllegalTransition = errors.New("illegal order transition")
+
+// orderStatusTransitions and fulfillmentTransitions list where an order can go
+// from each state, states missing as keys are final.
+var orderStatusTransitions = map[orderStatus][]orderStatus{
+	Pending:           {Completed, Declined, Failed},
+	Completed:         {PartiallyRefunded, Refunded},
+	PartiallyRefunded: {PartiallyRefunded, Refunded},
+}
+
+var fulfillmentTransitions = map[fulfillmentStatus][]fulfillmentStatus{
+	Paid:             {Packed},
+	Packed:           {PartiallyShipped, Shipped},
+	PartiallyShipped: {PartiallyShipped, Shipped},
+	Shipped:          {Delivered},
+}
 
 type Store interface {
 	Init() error
 	Close()
+	Ping(ctx context.Context) error
 
-	RestoreUser(context.Context) (User, error)
-	GetUser(context.Context) (User, error)
+	RestoreUser(ctx context.Context, user User) (User, error)
+	GetUser(ctx context.Context, user User) (User, error)
 	NewUser(context.Context, User) (User, error)
-	DeleteUser(ctx context.Context, id string) error
+	DeleteUser(ctx context.Context, userId int) error
+	GetFavorites(ctx context.Context, userId int) ([]Favorite, error)
+	UpdateProfile(ctx context.Context, userId int, profile Profile) error
+	RequestEmailChange(ctx context.Context, userId int, email string, tokenHash []byte, ttl time.Duration) error
+	ConfirmEmailChange(ctx context.Context, userId int, tokenHash []byte) (string, string, error)
+	PurgeEmailChanges(ctx context.Context) (int64, error)
+
+	TakeRateToken(ctx context.Context, key string, perMinute, burst int) (time.Duration, error)
+	PurgeRateLimits(ctx context.Context) (int64, error)
 
 	GetProducts(ctx context.Context, index, limit int) ([]Product, error)
-	GetProduct(context.Context) (Product, error)
+	GetProduct(ctx context.Context, id int) (Product, error)
+	GetProductByName(ctx context.Context, name string) (Product, error)
 	InsertProduct(context.Context, Product) (Product, error)
 	UpdateCombinations(context.Context, int, []Combination) error
 	UpdateVariants(context.Context, int, []Variant) error
@@ -51,12 +102,78 @@ type Store interface {
 	AddToCartWithItem(ctx context.Context, userId int, sku Sku, quantity int) (Items, int, error)
 	GetCart(ctx context.Context, userId int) ([]Items, error)
 	TotalItems(ctx context.Context, items []OrderItems) (float64, error)
+	QuoteItems(ctx context.Context, request QuoteRequest) (Quote, error)
+	ShippingOptions(ctx context.Context, items []OrderItems, currency currency, address Address) ([]ShippingOption, error)
+	LineTaxes(ctx context.Context, items []OrderItems, address Address) ([]LineTax, error)
 
-	MakeOrder(ctx context.Context, paymentProvider gateaways.PaymentProvider, userId int, cartItems []OrderItems, total float64, currency currency, orderId, payerName, payerEmail, payerId string, referenceIds, captureIds []string) (int, error)
+	MakeOrder(ctx context.Context, paymentProvider gateaways.PaymentProvider, userId int, cartItems []OrderItems, quote Quote, shipping Address, total float64, currency currency, orderId, payerName, payerEmail, payerId string, referenceIds, captureIds []string) (int, error)
 
 	UpdateStock(ctx context.Context, items []OrderItems) error
+	CompleteStockJob(ctx context.Context, jobId int, items []OrderItems) error
 	CheckStockFromItemsAndUpdateCart(ctx context.Context, userId int, items []OrderItems) (bool, error)
 	CheckStockFromItems(ctx context.Context, items []OrderItems) error
+
+	SubscribeBackInStock(ctx context.Context, sku Sku, userId int, email string) error
+	ClaimBackInStock(ctx context.Context, limit int) ([]StockSubscription, error)
+	ReleaseBackInStock(ctx context.Context, id int) error
+
+	EnqueueEmail(ctx context.Context, email Email) (int, error)
+	ClaimEmails(ctx context.Context, limit int) ([]Email, error)
+	MarkEmailSent(ctx context.Context, id int) error
+	MarkEmailFailed(ctx context.Context, id int, reason string, maxAttempts int) error
+
+	EnqueueJob(ctx context.Context, kind string, payload []byte, runAt time.Time) (int, error)
+	ClaimJobs(ctx context.Context, limit int, lease time.Duration) ([]Job, error)
+	CompleteJob(ctx context.Context, id int) error
+	RetryJob(ctx context.Context, id int, reason string, delay time.Duration) error
+	BuryJob(ctx context.Context, id int, reason string) error
+	PurgeEmails(ctx context.Context, olderThan time.Duration) (int64, error)
+
+	LinkIdentity(ctx context.Context, identity Identity) (User, error)
+	SetIdentityToken(ctx context.Context, provider provider, subject, refreshToken string) error
+	GetIdentityToken(ctx context.Context, userId int, provider provider) (string, error)
+
+	CreateSession(ctx context.Context, tokenHash []byte, user User, admin, mfaPending bool, userAgent, ipAddress string, maxAge time.Duration) (int, error)
+	GetSession(ctx context.Context, tokenHash []byte, maxAge time.Duration) (SessionUser, error)
+	GetSessions(ctx context.Context, userId int) ([]Session, error)
+	RevokeSession(ctx context.Context, userId, sessionId int) error
+	RevokeSessionToken(ctx context.Context, tokenHash []byte) error
+	RevokeSessions(ctx context.Context, userId int) (int64, error)
+	PurgeSessions(ctx context.Context) (int64, error)
+	VerifySessionMFA(ctx context.Context, sessionId int) error
+
+	GetTOTP(ctx context.Context, userId int) (TOTP, error)
+	EnrollTOTP(ctx context.Context, userId int, secret string) error
+	EnableTOTP(ctx context.Context, userId int, step int64, codeHashes [][]byte) error
+	DisableTOTP(ctx context.Context, userId int) error
+	UseTOTPStep(ctx context.Context, userId int, step int64) error
+	UseRecoveryCode(ctx context.Context, userId int, codeHash []byte) error
+	ReplaceRecoveryCodes(ctx context.Context, userId int, codeHashes [][]byte) error
+
+	GetPermissions(ctx context.Context, userId int) (Permissions, error)
+	GetRoles(ctx context.Context) ([]Role, error)
+	GetStaff(ctx context.Context) ([]StaffMember, error)
+	GrantRole(ctx context.Context, email, role, actor string) error
+	SeedOwners(ctx context.Context, emails []string, actor string) (int, error)
+	RevokeRole(ctx context.Context, userId int, role, actor string) error
+	GetRoleEvents(ctx context.Context, limit int) ([]RoleEvent, error)
+
+	CreateMagicLink(ctx context.Context, tokenHash []byte, email, ipAddress string, ttl time.Duration, limit LinkLimit) (int, error)
+	ConsumeMagicLink(ctx context.Context, tokenHash []byte) (string, error)
+	PurgeMagicLinks(ctx context.Context) (int64, error)
+
+	GetAddresses(ctx context.Context, userId int) ([]UserAddress, error)
+	GetAddress(ctx context.Context, userId, addressId int) (UserAddress, error)
+	SaveAddress(ctx context.Context, userId int, address Address, isDefault bool) (int, error)
+	DeleteAddress(ctx context.Context, userId, addressId int) error
+
+	GetOrders(ctx context.Context, userId int) ([]OrderSummary, error)
+	GetOpenOrders(ctx context.Context, limit int) ([]OrderSummary, error)
+	GetOrder(ctx context.Context, id int) (OrderDetail, error)
+	TransitionOrder(ctx context.Context, id int, to OrderState, actor, reason string) error
+	PackOrder(ctx context.Context, id int, actor string) error
+	CreateShipment(ctx context.Context, orderId int, actor, carrier, trackingNumber string, items []OrderItems) (int, error)
+	DeliverShipment(ctx context.Context, orderId, shipmentId int, actor string) error
 }
 
 type count struct {
@@ -101,11 +218,255 @@ type Variant struct {
 }
 
 type Combination struct {
+	Sku            Sku
+	Price          float64
+	Currency       currency
+	Stock          int
+	Options        []Option
+	CompareAtPrice float64
+	Weight         float64
+	Length         float64
+	Width          float64
+	Height         float64
+}
+
+type StockSubscription struct {
+	Id          int
+	Sku         Sku
+	UserId      int
+	Email       string
+	ProductName string
+	CreatedAt   time.Time
+}
+
+type Email struct {
+	Id        int
+	To        string
+	Subject   string
+	HTML      string
+	Text      string
+	Attempts  int
+	CreatedAt time.Time
+}
+
+// Identity is a user as a login provider knows it, Subject is its stable id
+// within the provider.
+type Identity struct {
+	Provider      provider
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Picture       string
+}
+
+// Session is a logged device, the token that opens it only lives in the
+// device cookie, the store keeps its hash.
+type Session struct {
+	Id         int
+	Admin      bool
+	UserAgent  string
+	IPAddress  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+}
+
+type SessionUser struct {
+	SessionId int
+	User      User
+	Admin     bool
+	// MFAPending sessions wait for the second factor before they are usable.
+	MFAPending    bool
+	MFAVerifiedAt time.Time
+}
+
+// TOTP is the second factor of a user, the secret is being enrolled until
+// it is Enabled. LastStep is the last time step used, codes never replay.
+type TOTP struct {
+	Secret        string
+	LastStep      int64
+	Enabled       bool
+	RecoveryCodes int
+}
+
+// Profile is what users edit of themselves, an empty AvatarUrl falls back
+// to the picture of the login provider.
+type Profile struct {
+	Name      string
+	AvatarUrl string
+	Locale    string
+	Currency  currency
+}
+
+const DefaultLocale = "en"
+
+type Locale struct {
+	Code string
+	Name string
+}
+
+// Locales the shop speaks, in the order they are offered.
+var Locales = []Locale{
+	{Code: "en", Name: "English"},
+	{Code: "es", Name: "Español"},
+}
+
+func ValidLocale(code string) bool {
+	return slices.ContainsFunc(Locales, func(l Locale) bool { return l.Code == code })
+}
+
+var Currencies = []currency{USD, COP}
+
+// LinkLimit caps the magic links asked for an email and from an ip address
+// within the window.
+type LinkLimit struct {
+	PerEmail int
+	PerIP    int
+	Window   time.Duration
+}
+
+type Job struct {
+	Id          int
+	Kind        string
+	Payload     []byte
+	Attempts    int
+	MaxAttempts int
+	CreatedAt   time.Time
+}
+
+// Address mirrors the address composite type, fields keep the PayPal naming,
+// admin area 2 is the city and admin area 1 the state or province.
+type Address struct {
+	FullName     string
+	AddressLine1 string
+	AddressLine2 string
+	AdminArea2   string
+	AdminArea1   string
+	PostalCode   string
+	CountryCode  string
+}
+
+type Favorite struct {
+	ProductId int
+	Name      string
+	Sku       Sku
+}
+
+type UserAddress struct {
+	Id        int
+	IsDefault bool
+	Address   Address
+	CreatedAt time.Time
+}
+
+type OrderSummary struct {
+	Id         int
+	OrderId    string
+	UserId     int
+	PayerName  string
+	PayerEmail string
+	Total      float64
+	Currency   currency
+	Status     fulfillmentStatus
+	CreatedAt  time.Time
+}
+
+type OrderLine struct {
+	Id       int
 	Sku      Sku
-	Price    float64
-	Currency currency
-	Stock    int
-	Options  []Option
+	Name     string
+	Quantity int
+	Shipped  int
+	Total    float64
+}
+
+type Shipment struct {
+	Id             int
+	Carrier        string
+	TrackingNumber string
+	Items          []OrderItems
+	ShippedAt      time.Time
+	DeliveredAt    *time.Time
+}
+
+// OrderState is where an order is in both its payment and its fulfillment,
+// every change of it is validated by Transition.
+type OrderState struct {
+	Status      orderStatus
+	Fulfillment fulfillmentStatus
+}
+
+type OrderEvent struct {
+	Id              int
+	FromStatus      *orderStatus
+	ToStatus        orderStatus
+	FromFulfillment *fulfillmentStatus
+	ToFulfillment   fulfillmentStatus
+	Actor           string
+	Reason          string
+	CreatedAt       time.Time
+}
+
+type OrderDetail struct {
+	OrderSummary
+	PaymentStatus   orderStatus
+	ShippingAddress *Address
+	PackedAt        *time.Time
+	ShippedAt       *time.Time
+	DeliveredAt     *time.Time
+	Lines           []OrderLine
+	Shipments       []Shipment
+	Events          []OrderEvent
+}
+
+type TimelineEvent struct {
+	Label string
+	At    time.Time
+}
+
+type Permission string
+
+const (
+	OrdersView    Permission = "orders:view"
+	OrdersFulfill Permission = "orders:fulfill"
+	OrdersRefund  Permission = "orders:refund"
+	CatalogEdit   Permission = "catalog:edit"
+	RolesManage   Permission = "roles:manage"
+)
+
+// Owner is the role with every permission, the store never revokes its
+// last holder.
+const Owner = "owner"
+
+// Permissions is what the roles of a user allow, together.
+type Permissions map[Permission]bool
+
+func (p Permissions) Has(permission Permission) bool {
+	return p[permission]
+}
+
+type Role struct {
+	Name        string
+	Description string
+	Permissions []string
+}
+
+// StaffMember is a user with at least one role.
+type StaffMember struct {
+	UserId int
+	Name   string
+	Email  string
+	Roles  []string
+}
+
+type RoleEvent struct {
+	Id        int
+	Email     string
+	Role      string
+	Action    string
+	Actor     string
+	CreatedAt time.Time
 }
 
 type Account interface {
@@ -121,12 +482,22 @@ type User struct {
 	CartId      int
 	FavoritesId int
 	Provider    provider
+	Locale      string
+	Currency    currency
 }
 
 func (u User) Legit() bool {
 	return false
 }
 
+// Lang is the locale the views render in, visitors get the default one.
+func (u User) Lang() string {
+	if ValidLocale(u.Locale) {
+		return u.Locale
+	}
+	return DefaultLocale
+}
+
 type Admin struct {
 	Id          int
 	Name        string
@@ -136,16 +507,75 @@ type Admin struct {
 	CartId      int
 	FavoritesId int
 	Provider    provider
+	Locale      string
+	Currency    currency
 }
 
 func (a Admin) Legit() bool {
 	return true
 }
 
+// Actor identifies the admin in the order history.
+func (a Admin) Actor() string {
+	return "admin:" + a.Email
+}
+
 type Order struct {
-	Products []OrderItems `json:"products"`
-	Currency currency     `json:"currency"`
-	FromCart bool         `json:"fromCart"`
+	Products         []OrderItems `json:"products"`
+	Currency         currency     `json:"currency"`
+	FromCart         bool         `json:"fromCart"`
+	Coupon           string       `json:"coupon"`
+	AddressId        int          `json:"addressId"`
+	ShippingMethodId int          `json:"shippingMethodId"`
+}
+
+type QuoteRequest struct {
+	Items            []OrderItems
+	UserId           int
+	Currency         currency
+	CouponCode       string
+	ShippingMethodId int
+	Address          Address
+}
+
+type Quote struct {
+	Currency          currency
+	ItemTotal         float64
+	PromotionDiscount float64
+	Promotions        []string
+	Discount          float64
+	FreeShipping      bool
+	Shipping          float64
+	ShippingMethodId  int
+	ShippingMethod    string
+	ShippingError     string
+	Tax               float64
+	TaxIncluded       float64
+	TaxLines          []LineTax
+	Total             float64
+	CouponCode        string
+	CouponError       string
+}
+
+// LineTax mirrors the line_tax composite type, Tax is already part of Total
+// when TaxInclusive is set.
+type LineTax struct {
+	Sku          Sku
+	Quantity     int
+	Total        float64
+	TaxName      string
+	TaxRate      float64
+	TaxInclusive bool
+	Tax          float64
+}
+
+type ShippingOption struct {
+	MethodId int
+	Name     string
+	Zone     string
+	Rate     float64
+	MinDays  int
+	MaxDays  int
 }
 
 type OrderItems struct {
@@ -164,6 +594,14 @@ func ToCurrency(curr string) (currency, error) {
 	}
 }
 
+func ToOrderStatus(status string) (orderStatus, error) {
+	s := orderStatus(status)
+	if err := s.Valid(); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
 func (curr currency) Valid() error {
 	switch curr {
 	case USD, COP:
@@ -183,6 +621,185 @@ func (curr currency) Truncate() int {
 	return -1
 }
 
+func (comb Combination) OnSale() bool {
+	return comb.CompareAtPrice > comb.Price
+}
+
+func (q Quote) TotalDiscount() float64 {
+	total, _ := decimal.NewFromFloat(q.PromotionDiscount).Add(decimal.NewFromFloat(q.Discount)).Float64()
+	return total
+}
+
+func (p Profile) Valid() error {
+	name := strings.TrimSpace(p.Name)
+	if len(name) <= 0 || len(name) > 50 {
+		return errors.New("name must have between 1 and 50 characters")
+	}
+	if len(p.AvatarUrl) > 0 {
+		avatar, err := url.Parse(p.AvatarUrl)
+		if err != nil || avatar.Scheme != "https" || len(avatar.Host) <= 0 || len(p.AvatarUrl) > 500 {
+			return errors.New("avatar must be an https link up to 500 characters")
+		}
+	}
+	if !ValidLocale(p.Locale) {
+		return errors.New("not a supported language")
+	}
+	return p.Currency.Valid()
+}
+
+// PreferCurrency moves the combinations priced in the currency first, views
+// show the first combination of a product as its price.
+func PreferCurrency(products []Product, curr currency) {
+	if curr.Valid() != nil {
+		return
+	}
+	for _, product := range products {
+		slices.SortStableFunc(product.Combinations, func(a, b Combination) int {
+			switch {
+			case a.Currency == curr && b.Currency != curr:
+				return -1
+			case a.Currency != curr && b.Currency == curr:
+				return 1
+			}
+			return 0
+		})
+	}
+}
+
+func (a Address) Valid() error {
+	if len(strings.TrimSpace(a.FullName)) <= 0 {
+		return errors.New("full name len cant be equals or below zero")
+	}
+	if len(strings.TrimSpace(a.AddressLine1)) <= 0 {
+		return errors.New("address line len cant be equals or below zero")
+	}
+	if len(strings.TrimSpace(a.AdminArea2)) <= 0 {
+		return errors.New("city len cant be equals or below zero")
+	}
+	if len(a.CountryCode) != 2 {
+		return errors.New("country code must be two letters")
+	}
+	return nil
+}
+
+func (a Address) Empty() bool {
+	return a == Address{}
+}
+
+func (a Address) String() string {
+	parts := []string{a.AddressLine1, a.AddressLine2, a.AdminArea2, a.AdminArea1, a.PostalCode, a.CountryCode}
+	filled := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if len(part) > 0 {
+			filled = append(filled, part)
+		}
+	}
+	return strings.Join(filled, ", ")
+}
+
+func (q Quote) LineTax(sku Sku) LineTax {
+	return FindLineTax(q.TaxLines, sku)
+}
+
+func FindLineTax(lines []LineTax, sku Sku) LineTax {
+	for _, line := range lines {
+		if line.Sku == sku {
+			return line
+		}
+	}
+	return LineTax{}
+}
+
+func (s fulfillmentStatus) Valid() error {
+	switch s {
+	case Paid, Packed, PartiallyShipped, Shipped, Delivered:
+		return nil
+	default:
+		return errors.New("not supported fulfillment status")
+	}
+}
+
+func (s fulfillmentStatus) Label() string {
+	return strings.ReplaceAll(string(s), "_", " ")
+}
+
+func (s orderStatus) Valid() error {
+	switch s {
+	case Completed, Pending, PartiallyRefunded, Declined, Refunded, Failed:
+		return nil
+	default:
+		return errors.New("not supported order status")
+	}
+}
+
+func (s orderStatus) Label() string {
+	return strings.ToLower(strings.ReplaceAll(string(s), "_", " "))
+}
+
+// Settled tells if the payment went through, only settled orders are fulfilled.
+func (s orderStatus) Settled() bool {
+	return s == Completed || s == PartiallyRefunded
+}
+
+func (s OrderState) Transition(to OrderState) error {
+	if err := to.Status.Valid(); err != nil {
+		return err
+	}
+	if err := to.Fulfillment.Valid(); err != nil {
+		return err
+	}
+	statusMoves := slices.Contains(orderStatusTransitions[s.Status], to.Status)
+	fulfillmentMoves := slices.Contains(fulfillmentTransitions[s.Fulfillment], to.Fulfillment)
+	if s.Status != to.Status && !statusMoves {
+		return fmt.Errorf("%w: order cant go from %s to %s", ErrIllegalTransition, s.Status, to.Status)
+	}
+	if s.Fulfillment != to.Fulfillment && !fulfillmentMoves {
+		return fmt.Errorf("%w: order cant go from %s to %s", ErrIllegalTransition, s.Fulfillment, to.Fulfillment)
+	}
+	if s == to && !statusMoves && !fulfillmentMoves {
+		return fmt.Errorf("%w: order is already %s and %s", ErrIllegalTransition, s.Status, s.Fulfillment)
+	}
+	if s.Fulfillment != to.Fulfillment && !to.Status.Settled() {
+		return fmt.Errorf("%w: order cant be %s while its payment is %s", ErrIllegalTransition, to.Fulfillment.Label(), to.Status.Label())
+	}
+	return nil
+}
+
+func (l OrderLine) Pending() int {
+	return l.Quantity - l.Shipped
+}
+
+func (o OrderDetail) Timeline() []TimelineEvent {
+	events := []TimelineEvent{{Label: "paid", At: o.CreatedAt}}
+	if o.PackedAt != nil {
+		events = append(events, TimelineEvent{Label: "packed", At: *o.PackedAt})
+	}
+	for _, shipment := range o.Shipments {
+		events = append(events, TimelineEvent{
+			Label: fmt.Sprintf("shipped with %s, tracking %s", shipment.Carrier, shipment.TrackingNumber),
+			At:    shipment.ShippedAt,
+		})
+		if shipment.DeliveredAt != nil {
+			events = append(events, TimelineEvent{
+				Label: fmt.Sprintf("delivered, tracking %s", shipment.TrackingNumber),
+				At:    *shipment.DeliveredAt,
+			})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].At.Before(events[j].At)
+	})
+	return events
+}
+
+func ToOrderItems(items ...Items) []OrderItems {
+	orderItems := make([]OrderItems, 0, len(items))
+	for _, item := range items {
+		orderItems = append(orderItems, OrderItems{Sku: item.Comb.Sku, Quantity: item.Quantity})
+	}
+	return orderItems
+}
+
 func (item *Items) SetComb(sku Sku, combs []Combination) error {
 	for _, comb := range combs {
 		if sku == comb.Sku {
@@ -194,15 +811,20 @@ func (item *Items) SetComb(sku Sku, combs []Combination) error {
 }
 
 func GetProvider(r *http.Request) (provider, error) {
-	provider := provider(chi.URLParam(r, "provider"))
-	switch provider {
-	case Google:
-		return provider, nil
-	case Local:
+	return ToProvider(chi.URLParam(r, "provider"))
+}
+
+// ToProvider accepts the built in providers and the OpenID Connect ones
+// enabled in the config.
+func ToProvider(name string) (provider, error) {
+	switch provider := provider(name); provider {
+	case Google, Local, MagicLink:
 		return provider, nil
-	default:
-		return "", errors.New("not supported provider")
 	}
+	if _, ok := config.Envs.OIDCProvider(name); ok {
+		return provider(name), nil
+	}
+	return "", errors.New("not supported provider")
 }
 
 func (sku Sku) ProductId() (int, error) {
@@ -0,0 +1,73 @@
+package store_test
+
+import (
+	. "shop/services/store"
+	"testing"
+)
+
+// TestOrderStateTransition needs no database, it runs with go test -short.
+func TestOrderStateTransition(t *testing.T) {
+	tests := map[string]struct {
+		from    OrderState
+		to      OrderState
+		illegal bool
+	}{
+		`pack`: {
+			from: OrderState{Status: Completed, Fulfillment: Paid},
+			to:   OrderState{Status: Completed, Fulfillment: Packed},
+		},
+		`packUnpaid`: {
+			from:    OrderState{Status: Pending, Fulfillment: Paid},
+			to:      OrderState{Status: Pending, Fulfillment: Packed},
+			illegal: true,
+		},
+		`shipAgain`: {
+			from: OrderState{Status: Completed, Fulfillment: PartiallyShipped},
+			to:   OrderState{Status: Completed, Fulfillment: PartiallyShipped},
+		},
+		`skipPacking`: {
+			from:    OrderState{Status: Completed, Fulfillment: Paid},
+			to:      OrderState{Status: Completed, Fulfillment: Shipped},
+			illegal: true,
+		},
+		`deliverAfterPartialRefund`: {
+			from: OrderState{Status: PartiallyRefunded, Fulfillment: Shipped},
+			to:   OrderState{Status: PartiallyRefunded, Fulfillment: Delivered},
+		},
+		`refundDelivered`: {
+			from: OrderState{Status: Completed, Fulfillment: Delivered},
+			to:   OrderState{Status: Refunded, Fulfillment: Delivered},
+		},
+		`refundTwice`: {
+			from:    OrderState{Status: Refunded, Fulfillment: Paid},
+			to:      OrderState{Status: Refunded, Fulfillment: Paid},
+			illegal: true,
+		},
+		`reopenDeclined`: {
+			from:    OrderState{Status: Declined, Fulfillment: Paid},
+			to:      OrderState{Status: Completed, Fulfillment: Paid},
+			illegal: true,
+		},
+		`shipRefunded`: {
+			from:    OrderState{Status: Completed, Fulfillment: Packed},
+			to:      OrderState{Status: Refunded, Fulfillment: Shipped},
+			illegal: true,
+		},
+		`unknownStatus`: {
+			from:    OrderState{Status: Pending, Fulfillment: Paid},
+			to:      OrderState{Status: "SETTLED", Fulfillment: Paid},
+			illegal: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := tt.from.Transition(tt.to)
+			if tt.illegal && err == nil {
+				t.Errorf("from: %v, to: %v, expected an illegal transition", tt.from, tt.to)
+			}
+			if !tt.illegal && err != nil {
+				t.Errorf("from: %v, to: %v, err: %v", tt.from, tt.to, err)
+			}
+		})
+	}
+}
@@ -8,8 +8,10 @@ import (
 	"shop/gateaways"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/multitracer"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -20,6 +22,17 @@ type PostgresStore struct {
 }
 
 var ErrNoStock error = errors.New("ERROR: item quantity overpass stock. (SQLSTATE P0001)")
+var ErrInStock error = errors.New("ERROR: item is in stock. (SQLSTATE P0001)")
+var ErrEmailNotVerified error = errors.New("ERROR: identity email is not verified (SQLSTATE P0001)")
+var ErrTOTPNotEnrolling error = errors.New("ERROR: totp is not being enrolled (SQLSTATE P0001)")
+var ErrRoleUserNotFound error = errors.New("ERROR: user for role not found (SQLSTATE P0001)")
+var ErrRoleNotFound error = errors.New("ERROR: role not found (SQLSTATE P0001)")
+var ErrRoleNotGranted error = errors.New("ERROR: user doesnt have the role (SQLSTATE P0001)")
+var ErrLastOwner error = errors.New("ERROR: cant revoke the last owner (SQLSTATE P0001)")
+var ErrEmailInUse error = errors.New("ERROR: email already in use (SQLSTATE P0001)")
+var ErrDeleteLastOwner error = errors.New("ERROR: cant delete the last owner (SQLSTATE P0001)")
+var ErrTooManyMagicLinks error = errors.New("ERROR: too many magic links requested (SQLSTATE P0001)")
+var ErrStockBelowZero error = errors.New("ERROR: tried to store stock with invalid quantity below zero (SQLSTATE P0001)")
 
 func (s *PostgresStore) SqlAddr() string {
 	return fmt.Sprintf("postgresql://%s:%s@%s:%s/%s?sslmode=%s",
@@ -53,14 +66,19 @@ func (s *PostgresStore) NewStore() (*pgxpool.Pool, error) {
 		return nil, fmt.Errorf("unable to parse database URL: %w", err)
 	}
 
+	poolConfig.ConnConfig.Tracer = multitracer.New(querySpans{}, queryLogger{})
 	poolConfig.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
 		dataTypeNames := []string{
 			"option",
 			"option[]",
 			"items",
 			"items[]",
+			"address",
+			"line_tax",
+			"line_tax[]",
 			"currency",
 			"order_status",
+			"fulfillment_status",
 			"payment_provider",
 		}
 		for _, typeName := range dataTypeNames {
@@ -85,11 +103,7 @@ func (s *PostgresStore) NewStore() (*pgxpool.Pool, error) {
 	return pool, nil
 }
 
-func (s *PostgresStore) GetProductByName(ctx context.Context) (Product, error) {
-	productName, ok := ctx.Value("productName").(string)
-	if !ok {
-		return Product{}, errors.New("product name was not found in the context")
-	}
+func (s *PostgresStore) GetProductByName(ctx context.Context, productName string) (Product, error) {
 	if len(productName) <= 0 {
 		return Product{}, errors.New("product name has an invalid length")
 	}
@@ -113,21 +127,10 @@ func (s *PostgresStore) GetProductByName(ctx context.Context) (Product, error) {
 	return product, nil
 }
 
-func (s *PostgresStore) GetProduct(ctx context.Context) (Product, error) {
-	id, ok := ctx.Value("productId").(int)
-	if !ok {
-		return Product{}, errors.New("product id was not found in the context")
-	}
+func (s *PostgresStore) GetProduct(ctx context.Context, id int) (Product, error) {
 	if id <= 0 {
 		return Product{}, errors.New("product id is not valid, less than zero")
 	}
-	sku, ok := ctx.Value("sku").(Sku)
-	if !ok {
-		return Product{}, errors.New("sku was not found in the context")
-	}
-	if len(sku) <= 0 {
-		return Product{}, errors.New("sku not valid cant be 0 len")
-	}
 	var product Product
 	query := `
 	SELECT 
@@ -143,7 +146,8 @@ func (s *PostgresStore) GetProduct(ctx context.Context) (Product, error) {
 		(
 			SELECT array_agg(c)
 			FROM (
-			SELECT c.sku, c.price, c.currency, c.stock, c.options
+			SELECT c.sku, current_price(c) AS price, c.currency, c.stock, c.options,
+				compare_at_price(c) AS compare_at_price, c.weight, c.length, c.width, c.height
 			FROM combinations AS c
 			WHERE c.product_id = p.id
 			) c
@@ -203,9 +207,10 @@ func (s *PostgresStore) InsertProduct(ctx context.Context, product Product) (Pro
 		}
 		combination.Sku = Sku(sku)
 		query := `
-		INSERT INTO combinations (sku, price, stock, currency, options, product_id)
-		VALUES ($1, $2, $3, $4, $5, $6)`
-		ct, err := s.db.Exec(ctx, query, combination.Sku, combination.Price, combination.Stock, combination.Currency, combination.Options, product.Id)
+		INSERT INTO combinations (sku, price, stock, currency, options, product_id, weight, length, width, height)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+		ct, err := s.db.Exec(ctx, query, combination.Sku, combination.Price, combination.Stock, combination.Currency, combination.Options, product.Id,
+			combination.Weight, combination.Length, combination.Width, combination.Height)
 		if err != nil {
 			return Product{}, err
 		}
@@ -256,7 +261,8 @@ func (s *PostgresStore) GetProducts(ctx context.Context, index int, limit int) (
 		(
 			SELECT array_agg(c)
 			FROM (
-				SELECT c.sku, c.price, c.currency, c.stock, c.options
+				SELECT c.sku, current_price(c) AS price, c.currency, c.stock, c.options,
+					compare_at_price(c) AS compare_at_price, c.weight, c.length, c.width, c.height
 				FROM combinations AS c
 				WHERE c.product_id = p.id
 			) c
@@ -446,6 +452,9 @@ func (s *PostgresStore) UpdateStock(ctx context.Context, items []OrderItems) err
 	SELECT FROM update_stock($1)
 	`
 	ct, err := s.db.Exec(ctx, query, items)
+	if err != nil && strings.Contains(err.Error(), "invalid quantity below zero") {
+		return ErrStockBelowZero
+	}
 	if err != nil {
 		return err
 	}
@@ -455,226 +464,1632 @@ func (s *PostgresStore) UpdateStock(ctx context.Context, items []OrderItems) err
 	return nil
 }
 
-func (s *PostgresStore) RemoveProductFromCart(ctx context.Context, userId int, sku Sku) (count, error) {
-	if userId <= 0 {
-		return count{}, errors.New("user id cant be equals or below zero")
+// CompleteStockJob updates the stock in the same transaction that deletes
+// the job, so the stock of a job is only taken once.
+func (s *PostgresStore) CompleteStockJob(ctx context.Context, jobId int, items []OrderItems) error {
+	if jobId <= 0 {
+		return errors.New("job id cant be equals or below zero")
+	}
+	if len(items) <= 0 {
+		return errors.New("items len cant be equals or below zero")
+	}
+	query := `
+	SELECT FROM complete_stock_job($1, $2)
+	`
+	_, err := s.db.Exec(ctx, query, jobId, items)
+	if err != nil && strings.Contains(err.Error(), "invalid quantity below zero") {
+		return ErrStockBelowZero
+	}
+	if err != nil {
+		return err
 	}
+	return nil
+}
+
+func (s *PostgresStore) SubscribeBackInStock(ctx context.Context, sku Sku, userId int, email string) error {
 	if len(sku) <= 0 {
-		return count{}, errors.New("sku len cant be equals or below zero")
+		return errors.New("sku len cant be equals or below zero")
+	}
+	if len(email) <= 0 {
+		return errors.New("email len cant be equals or below zero")
+	}
+	var uid *int
+	if userId > 0 {
+		uid = &userId
 	}
 	query := `
-	SELECT cart_count_items, total_cart_balance FROM delete_product_from_cart($1,$2)
+	SELECT FROM subscribe_back_in_stock($1, $2, $3)
 	`
-	counter := count{}
-	err := s.db.QueryRow(ctx, query, userId, string(sku)).Scan(&counter.CartCount, &counter.CartBalance)
+	_, err := s.db.Exec(ctx, query, string(sku), uid, email)
+	if err != nil && strings.Contains(err.Error(), "item is in stock") {
+		return ErrInStock
+	}
 	if err != nil {
-		return count{}, err
+		return err
 	}
-	return counter, nil
+	return nil
 }
 
-func (s *PostgresStore) GetCart(ctx context.Context, userId int) ([]Items, error) {
-	if userId <= 0 {
-		return []Items{}, errors.New("user id cant be equals or below zero")
+func (s *PostgresStore) ClaimBackInStock(ctx context.Context, limit int) ([]StockSubscription, error) {
+	if limit <= 0 {
+		return []StockSubscription{}, errors.New("limit cant be equals or below zero")
 	}
 	query := `
-	SELECT products.id, combinations.sku, cart_items.quantity, created_at,
-		products.name, products.description, products.short_description,
-		combinations.price, products.images, combinations.options
-	FROM get_cart_items($1) AS cart_items
-	JOIN products ON products.id = cart_items.product_id
-	JOIN combinations ON combinations.sku = cart_items.sku
-	ORDER BY created_at DESC
+	SELECT id, sku, user_id, email, product_name, created_at
+	FROM claim_back_in_stock($1)
 	`
-	rows, _ := s.db.Query(ctx, query, userId)
-	items, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Items, error) {
-		var item Items
-		var combination Combination
+	rows, _ := s.db.Query(ctx, query, limit)
+	subscriptions, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (StockSubscription, error) {
+		var (
+			subscription StockSubscription
+			userId       *int
+		)
 		err := row.Scan(
-			&item.Id,
-			&combination.Sku,
-			&item.Quantity,
-			&item.CreatedAt,
-			&item.Name,
-			&item.Description,
-			&item.ShortDescription,
-			&combination.Price,
-			&item.Images,
-			&combination.Options,
+			&subscription.Id,
+			&subscription.Sku,
+			&userId,
+			&subscription.Email,
+			&subscription.ProductName,
+			&subscription.CreatedAt,
 		)
-		if err != nil {
-			return Items{}, err
+		if userId != nil {
+			subscription.UserId = *userId
 		}
-		item.Comb = combination
-		return item, nil
+		return subscription, err
 	})
 	if err != nil {
-		return []Items{}, err
+		return []StockSubscription{}, err
 	}
-	return items, nil
+	return subscriptions, nil
 }
 
-func (s *PostgresStore) EmptyingCart(ctx context.Context, userId int) error {
-	if userId <= 0 {
-		return errors.New("user id cant be zero or below")
+func (s *PostgresStore) ReleaseBackInStock(ctx context.Context, id int) error {
+	if id <= 0 {
+		return errors.New("subscription id cant be equals or below zero")
 	}
 	query := `
-	SELECT FROM emptying_cart($1)
+	UPDATE stock_subscriptions
+	SET notified_at = NULL
+	WHERE id = $1
 	`
-	ct, err := s.db.Exec(ctx, query, userId)
+	ct, err := s.db.Exec(ctx, query, id)
 	if err != nil {
 		return err
 	}
-	if ct.RowsAffected() <= 0 {
-		return errors.New("there were no rows deleted")
+	if ct.RowsAffected() != 1 {
+		return errors.New("no subscription found to release")
 	}
 	return nil
 }
 
-func (s *PostgresStore) MakeOrder(ctx context.Context, paymentProvider gateaways.PaymentProvider, userId int, cartItems []OrderItems, total float64, currency currency, orderId, payerName, payerEmail, payerId string, referenceIds, captureIds []string) (int, error) {
-	if err := paymentProvider.Valid(); err != nil {
-		return -1, err
+func (s *PostgresStore) EnqueueEmail(ctx context.Context, email Email) (int, error) {
+	if len(email.To) <= 0 {
+		return -1, errors.New("email recipient len cant be equals or below zero")
 	}
-	if err := currency.Valid(); err != nil {
+	if len(email.Subject) <= 0 {
+		return -1, errors.New("email subject len cant be equals or below zero")
+	}
+	query := `
+	INSERT INTO email_outbox(recipient, subject, html_body, text_body)
+	VALUES ($1, $2, $3, $4)
+	RETURNING id
+	`
+	var id int
+	err := s.db.QueryRow(ctx, query, email.To, email.Subject, email.HTML, email.Text).Scan(&id)
+	if err != nil {
 		return -1, err
 	}
-	if len(cartItems) <= 0 {
-		return -1, errors.New("len of items cant be zero or below")
+	return id, nil
+}
+
+func (s *PostgresStore) ClaimEmails(ctx context.Context, limit int) ([]Email, error) {
+	if limit <= 0 {
+		return []Email{}, errors.New("limit cant be equals or below zero")
 	}
-	if len(payerId) <= 0 {
-		return -1, errors.New("len of payer id cant be zero or below")
+	query := `
+	SELECT id, recipient, subject, html_body, text_body, attempts, created_at
+	FROM claim_emails($1)
+	`
+	rows, _ := s.db.Query(ctx, query, limit)
+	emails, err := pgx.CollectRows(rows, pgx.RowToStructByPos[Email])
+	if err != nil {
+		return []Email{}, err
 	}
-	if userId <= 0 {
-		return -1, errors.New("user id cant be zero or below")
+	return emails, nil
+}
+
+func (s *PostgresStore) MarkEmailSent(ctx context.Context, id int) error {
+	if id <= 0 {
+		return errors.New("email id cant be equals or below zero")
 	}
-	if total <= 0 {
-		return -1, errors.New("total cant be zero or below")
+	query := `
+	UPDATE email_outbox
+	SET sent_at = CURRENT_TIMESTAMP, locked_until = NULL, last_error = NULL
+	WHERE id = $1
+	`
+	_, err := s.db.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) MarkEmailFailed(ctx context.Context, id int, reason string, maxAttempts int) error {
+	if id <= 0 {
+		return errors.New("email id cant be equals or below zero")
+	}
+	query := `
+	SELECT FROM fail_email($1, $2, $3)
+	`
+	_, err := s.db.Exec(ctx, query, id, reason, maxAttempts)
+	if err != nil {
+		return err
 	}
+	return nil
+}
+
+func (s *PostgresStore) PurgeEmails(ctx context.Context, olderThan time.Duration) (int64, error) {
+	if olderThan <= 0 {
+		return 0, errors.New("older than cant be equals or below zero")
+	}
+	query := `
+	DELETE FROM email_outbox
+	WHERE COALESCE(sent_at, failed_at) < CURRENT_TIMESTAMP - make_interval(secs => $1)
+	`
+	ct, err := s.db.Exec(ctx, query, olderThan.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return ct.RowsAffected(), nil
+}
 
+func (s *PostgresStore) EnqueueJob(ctx context.Context, kind string, payload []byte, runAt time.Time) (int, error) {
+	if len(kind) <= 0 {
+		return -1, errors.New("job kind len cant be equals or below zero")
+	}
 	query := `
-	SELECT order_id FROM make_order($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	INSERT INTO jobs(kind, payload, run_at)
+	VALUES ($1, $2, $3)
+	RETURNING id
 	`
 	var id int
-	err := s.db.QueryRow(ctx, query, paymentProvider, userId, cartItems, total, currency, orderId, payerName, payerEmail, payerId, referenceIds, captureIds).Scan(&id)
+	err := s.db.QueryRow(ctx, query, kind, payload, runAt).Scan(&id)
 	if err != nil {
 		return -1, err
 	}
 	return id, nil
 }
 
-func (s *PostgresStore) TotalItems(ctx context.Context, items []OrderItems) (float64, error) {
-	if len(items) <= 0 {
-		return -1, errors.New("len of items cant be zero or below")
+func (s *PostgresStore) ClaimJobs(ctx context.Context, limit int, lease time.Duration) ([]Job, error) {
+	if limit <= 0 {
+		return []Job{}, errors.New("limit cant be equals or below zero")
+	}
+	if lease < time.Second {
+		return []Job{}, errors.New("lease cant be below a second")
 	}
 	query := `
-	SELECT total_items_balance FROM total_items($1)
+	SELECT id, kind, payload, attempts, max_attempts, created_at
+	FROM claim_jobs($1, $2)
 	`
-	var total_items float64
-	err := s.db.QueryRow(ctx, query, items).Scan(&total_items)
+	rows, _ := s.db.Query(ctx, query, limit, int(lease.Seconds()))
+	jobs, err := pgx.CollectRows(rows, pgx.RowToStructByPos[Job])
 	if err != nil {
-		return -1, err
+		return []Job{}, err
 	}
-	return total_items, nil
+	return jobs, nil
 }
 
-func (s *PostgresStore) RestoreUser(ctx context.Context) (User, error) {
-	user, ok := ctx.Value("user").(User)
-	if !ok {
-		return User{}, errors.New("cannot restore user, has not user struct. bad interface or void value")
+func (s *PostgresStore) CompleteJob(ctx context.Context, id int) error {
+	if id <= 0 {
+		return errors.New("job id cant be equals or below zero")
 	}
-	validUid := user.Id > 0
-	validEmail := len(user.Email) > 0
-	if !validEmail && !validUid {
-		return User{}, errors.New("there is no valid user context values to restore user info")
+	query := `
+	DELETE FROM jobs
+	WHERE id = $1
+	`
+	_, err := s.db.Exec(ctx, query, id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) RetryJob(ctx context.Context, id int, reason string, delay time.Duration) error {
+	if id <= 0 {
+		return errors.New("job id cant be equals or below zero")
 	}
 	query := `
-	SELECT out_user_id, name, email,
-		created_at, cart_id, favorites_id
-	FROM get_core_user_data($1,$2)`
-	err := s.db.QueryRow(ctx, query, user.Id, user.Email).
-		Scan(&user.Id, &user.Name, &user.Email, &user.CreatedAt, &user.CartId, &user.FavoritesId)
+	UPDATE jobs
+	SET last_error = $2, locked_until = NULL,
+		run_at = CURRENT_TIMESTAMP + make_interval(secs => $3)
+	WHERE id = $1
+	`
+	_, err := s.db.Exec(ctx, query, id, reason, delay.Seconds())
 	if err != nil {
-		return User{}, err
+		return err
 	}
-	return user, nil
+	return nil
 }
 
-func (s *PostgresStore) NewUser(ctx context.Context, user User) (User, error) {
-	if len(user.Name) == 0 {
-		return User{}, errors.New("invalid length for username, cant set user to database")
+func (s *PostgresStore) BuryJob(ctx context.Context, id int, reason string) error {
+	if id <= 0 {
+		return errors.New("job id cant be equals or below zero")
 	}
-	if len(user.Email) == 0 {
-		return User{}, errors.New("invalid length for user email, cant set user to database")
+	query := `
+	SELECT FROM bury_job($1, $2)
+	`
+	_, err := s.db.Exec(ctx, query, id, reason)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) LinkIdentity(ctx context.Context, identity Identity) (User, error) {
+	if len(identity.Provider) <= 0 {
+		return User{}, errors.New("identity provider len cant be equals or below zero")
+	}
+	if len(identity.Subject) <= 0 {
+		return User{}, errors.New("identity subject len cant be equals or below zero")
+	}
+	if len(identity.Email) <= 0 {
+		return User{}, errors.New("identity email len cant be equals or below zero")
 	}
 	query := `
-		SELECT user_id, out_created_at, cart_id, favorites_id
-		FROM create_user($1, $2)
+	SELECT out_user_id, out_name, out_email, out_created_at, out_cart_id, out_favorites_id
+	FROM link_identity($1, $2, $3, $4, $5)
 	`
-	err := s.db.QueryRow(ctx, query, user.Name, user.Email).
-		Scan(&user.Id, &user.CreatedAt, &user.CartId, &user.FavoritesId)
+	user := User{AvatarUrl: identity.Picture, Provider: identity.Provider}
+	err := s.db.QueryRow(ctx, query, string(identity.Provider), identity.Subject, identity.Email, identity.EmailVerified, identity.Name).
+		Scan(&user.Id, &user.Name, &user.Email, &user.CreatedAt, &user.CartId, &user.FavoritesId)
+	if err != nil && strings.Contains(err.Error(), "identity email is not verified") {
+		return User{}, ErrEmailNotVerified
+	}
 	if err != nil {
 		return User{}, err
 	}
 	return user, nil
 }
 
-func (s *PostgresStore) GetUser(ctx context.Context) (User, error) {
-	user, ok := ctx.Value("user").(User)
-	if !ok {
-		return User{}, errors.New("cannot restore user, has not user struct. bad interface or void value")
+// SetIdentityToken keeps the refresh token of the identity, it is only used
+// to revoke the grant when the user deletes the account.
+func (s *PostgresStore) SetIdentityToken(ctx context.Context, provider provider, subject, refreshToken string) error {
+	if len(subject) <= 0 {
+		return errors.New("identity subject len cant be equals or below zero")
 	}
-	validUid := user.Id > 0
-	validEmail := len(user.Email) > 0
-	if !validEmail && !validUid {
-		return User{}, errors.New("there is no valid user context values to restore user info")
+	if len(refreshToken) <= 0 {
+		return errors.New("refresh token len cant be equals or below zero")
 	}
 	query := `
-	SELECT id, name, email, created_at
-	FROM users
-	WHERE id = $1 OR email = $2
+	UPDATE user_identities
+	SET refresh_token = $3
+	WHERE provider = $1 AND subject = $2
+	`
+	ct, err := s.db.Exec(ctx, query, string(provider), subject, refreshToken)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() <= 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetIdentityToken(ctx context.Context, userId int, provider provider) (string, error) {
+	if userId <= 0 {
+		return "", errors.New("user id cant be equals or below zero")
+	}
+	query := `
+	SELECT refresh_token
+	FROM user_identities
+	WHERE user_id = $1 AND provider = $2 AND refresh_token IS NOT NULL
+	ORDER BY last_login_at DESC
 	LIMIT 1
 	`
-	err := s.db.QueryRow(ctx, query, user.Id, user.Email).
-		Scan(&user.Id, &user.Name, &user.Email, &user.CreatedAt)
+	var refreshToken string
+	err := s.db.QueryRow(ctx, query, userId, string(provider)).Scan(&refreshToken)
 	if err != nil {
-		return User{}, err
+		return "", err
 	}
-	return user, nil
+	return refreshToken, nil
 }
 
-func (s *PostgresStore) DeleteUser(ctx context.Context, uid string) error {
-	id, err := strconv.Atoi(uid)
+func (s *PostgresStore) CreateSession(ctx context.Context, tokenHash []byte, user User, admin, mfaPending bool, userAgent, ipAddress string, maxAge time.Duration) (int, error) {
+	if len(tokenHash) <= 0 {
+		return -1, errors.New("session token hash len cant be equals or below zero")
+	}
+	if user.Id <= 0 {
+		return -1, errors.New("user id cant be equals or below zero")
+	}
+	if maxAge <= 0 {
+		return -1, errors.New("session max age cant be equals or below zero")
+	}
+	query := `
+	INSERT INTO sessions(token_hash, user_id, is_admin, mfa_pending, provider, avatar_url, user_agent, ip_address, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, CURRENT_TIMESTAMP + make_interval(secs => $9))
+	RETURNING id
+	`
+	var id int
+	err := s.db.QueryRow(ctx, query, tokenHash, user.Id, admin, mfaPending, string(user.Provider), user.AvatarUrl,
+		userAgent, ipAddress, maxAge.Seconds()).Scan(&id)
 	if err != nil {
-		return err
+		return -1, err
 	}
-	query := `DELETE FROM users WHERE id = $1`
-	ct, err := s.db.Exec(ctx, query, id)
+	return id, nil
+}
+
+func (s *PostgresStore) GetSession(ctx context.Context, tokenHash []byte, maxAge time.Duration) (SessionUser, error) {
+	if len(tokenHash) <= 0 {
+		return SessionUser{}, errors.New("session token hash len cant be equals or below zero")
+	}
+	query := `
+	SELECT session_id, user_id, name, email, created_at, cart_id, favorites_id, is_admin, provider, avatar_url,
+		mfa_pending, mfa_verified_at, locale, currency
+	FROM get_session($1, $2)
+	`
+	var session SessionUser
+	var cartId, favoritesId *int
+	var providerName string
+	var mfaVerifiedAt *time.Time
+	err := s.db.QueryRow(ctx, query, tokenHash, int(maxAge.Seconds())).Scan(
+		&session.SessionId,
+		&session.User.Id,
+		&session.User.Name,
+		&session.User.Email,
+		&session.User.CreatedAt,
+		&cartId,
+		&favoritesId,
+		&session.Admin,
+		&providerName,
+		&session.User.AvatarUrl,
+		&session.MFAPending,
+		&mfaVerifiedAt,
+		&session.User.Locale,
+		&session.User.Currency,
+	)
+	if err != nil {
+		return SessionUser{}, err
+	}
+	if cartId != nil {
+		session.User.CartId = *cartId
+	}
+	if favoritesId != nil {
+		session.User.FavoritesId = *favoritesId
+	}
+	if mfaVerifiedAt != nil {
+		session.MFAVerifiedAt = *mfaVerifiedAt
+	}
+	session.User.Provider = provider(providerName)
+	return session, nil
+}
+
+func (s *PostgresStore) GetSessions(ctx context.Context, userId int) ([]Session, error) {
+	if userId <= 0 {
+		return []Session{}, errors.New("user id cant be equals or below zero")
+	}
+	query := `
+	SELECT id, is_admin, user_agent, ip_address, created_at, last_seen_at, expires_at
+	FROM sessions
+	WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+	ORDER BY last_seen_at DESC
+	`
+	rows, _ := s.db.Query(ctx, query, userId)
+	sessions, err := pgx.CollectRows(rows, pgx.RowToStructByPos[Session])
+	if err != nil {
+		return []Session{}, err
+	}
+	return sessions, nil
+}
+
+func (s *PostgresStore) RevokeSession(ctx context.Context, userId, sessionId int) error {
+	if userId <= 0 {
+		return errors.New("user id cant be equals or below zero")
+	}
+	if sessionId <= 0 {
+		return errors.New("session id cant be equals or below zero")
+	}
+	query := `
+	UPDATE sessions
+	SET revoked_at = CURRENT_TIMESTAMP
+	WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`
+	ct, err := s.db.Exec(ctx, query, sessionId, userId)
 	if err != nil {
 		return err
 	}
-	if ct.RowsAffected() != 1 {
-		return errors.New("no row found to delete")
+	if ct.RowsAffected() <= 0 {
+		return pgx.ErrNoRows
 	}
 	return nil
 }
 
-func (s *PostgresStore) CreateOrder(ctx context.Context, items []OrderItems) error {
+func (s *PostgresStore) RevokeSessionToken(ctx context.Context, tokenHash []byte) error {
+	if len(tokenHash) <= 0 {
+		return errors.New("session token hash len cant be equals or below zero")
+	}
+	query := `
+	UPDATE sessions
+	SET revoked_at = CURRENT_TIMESTAMP
+	WHERE token_hash = $1 AND revoked_at IS NULL
+	`
+	_, err := s.db.Exec(ctx, query, tokenHash)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
-func (s *PostgresStore) Init() error {
-	if Pub != nil {
-		return fmt.Errorf("pub init function already called")
+func (s *PostgresStore) RevokeSessions(ctx context.Context, userId int) (int64, error) {
+	if userId <= 0 {
+		return 0, errors.New("user id cant be equals or below zero")
 	}
-	pool, err := s.NewStore()
+	query := `
+	UPDATE sessions
+	SET revoked_at = CURRENT_TIMESTAMP
+	WHERE user_id = $1 AND revoked_at IS NULL
+	`
+	ct, err := s.db.Exec(ctx, query, userId)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	return ct.RowsAffected(), nil
+}
+
+func (s *PostgresStore) PurgeSessions(ctx context.Context) (int64, error) {
+	query := `
+	DELETE FROM sessions
+	WHERE expires_at < CURRENT_TIMESTAMP OR revoked_at IS NOT NULL
+	`
+	ct, err := s.db.Exec(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return ct.RowsAffected(), nil
+}
+
+// VerifySessionMFA records the second factor was just checked on the
+// session, a pending session becomes usable.
+func (s *PostgresStore) VerifySessionMFA(ctx context.Context, sessionId int) error {
+	if sessionId <= 0 {
+		return errors.New("session id cant be equals or below zero")
+	}
+	query := `
+	UPDATE sessions
+	SET mfa_pending = FALSE, mfa_verified_at = CURRENT_TIMESTAMP
+	WHERE id = $1 AND revoked_at IS NULL
+	`
+	ct, err := s.db.Exec(ctx, query, sessionId)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() <= 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetTOTP(ctx context.Context, userId int) (TOTP, error) {
+	if userId <= 0 {
+		return TOTP{}, errors.New("user id cant be equals or below zero")
+	}
+	query := `
+	SELECT t.secret, t.last_step, t.enabled_at IS NOT NULL,
+		(SELECT count(*) FROM recovery_codes AS rc WHERE rc.user_id = t.user_id AND rc.used_at IS NULL)
+	FROM user_totp AS t
+	WHERE t.user_id = $1
+	`
+	var totp TOTP
+	err := s.db.QueryRow(ctx, query, userId).Scan(&totp.Secret, &totp.LastStep, &totp.Enabled, &totp.RecoveryCodes)
+	if err != nil {
+		return TOTP{}, err
+	}
+	return totp, nil
+}
+
+// EnrollTOTP keeps the secret until the user confirms it, an enabled secret
+// is never replaced.
+func (s *PostgresStore) EnrollTOTP(ctx context.Context, userId int, secret string) error {
+	if userId <= 0 {
+		return errors.New("user id cant be equals or below zero")
+	}
+	if len(secret) <= 0 {
+		return errors.New("totp secret len cant be equals or below zero")
+	}
+	query := `
+	INSERT INTO user_totp(user_id, secret)
+	VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE
+	SET secret = EXCLUDED.secret, created_at = CURRENT_TIMESTAMP
+	WHERE user_totp.enabled_at IS NULL
+	`
+	ct, err := s.db.Exec(ctx, query, userId, secret)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() <= 0 {
+		return ErrTOTPNotEnrolling
+	}
+	return nil
+}
+
+func (s *PostgresStore) EnableTOTP(ctx context.Context, userId int, step int64, codeHashes [][]byte) error {
+	if userId <= 0 {
+		return errors.New("user id cant be equals or below zero")
+	}
+	if len(codeHashes) <= 0 {
+		return errors.New("recovery codes len cant be equals or below zero")
+	}
+	_, err := s.db.Exec(ctx, `SELECT enable_totp($1, $2, $3)`, userId, step, codeHashes)
+	if err != nil && strings.Contains(err.Error(), "totp is not being enrolled") {
+		return ErrTOTPNotEnrolling
+	}
+	return err
+}
+
+func (s *PostgresStore) DisableTOTP(ctx context.Context, userId int) error {
+	if userId <= 0 {
+		return errors.New("user id cant be equals or below zero")
+	}
+	query := `
+	WITH codes AS (
+		DELETE FROM recovery_codes WHERE user_id = $1
+	)
+	DELETE FROM user_totp WHERE user_id = $1
+	`
+	_, err := s.db.Exec(ctx, query, userId)
+	return err
+}
+
+// UseTOTPStep moves the last used step forward, a code of a step already
+// used returns pgx.ErrNoRows so it cant be replayed.
+func (s *PostgresStore) UseTOTPStep(ctx context.Context, userId int, step int64) error {
+	if userId <= 0 {
+		return errors.New("user id cant be equals or below zero")
+	}
+	query := `
+	UPDATE user_totp
+	SET last_step = $2
+	WHERE user_id = $1 AND last_step < $2 AND enabled_at IS NOT NULL
+	`
+	ct, err := s.db.Exec(ctx, query, userId, step)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() <= 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func (s *PostgresStore) UseRecoveryCode(ctx context.Context, userId int, codeHash []byte) error {
+	if userId <= 0 {
+		return errors.New("user id cant be equals or below zero")
+	}
+	if len(codeHash) <= 0 {
+		return errors.New("recovery code hash len cant be equals or below zero")
+	}
+	query := `
+	UPDATE recovery_codes
+	SET used_at = CURRENT_TIMESTAMP
+	WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`
+	ct, err := s.db.Exec(ctx, query, userId, codeHash)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() <= 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// ReplaceRecoveryCodes swaps the codes of a user with two factor enabled,
+// the old ones stop working.
+func (s *PostgresStore) ReplaceRecoveryCodes(ctx context.Context, userId int, codeHashes [][]byte) error {
+	if userId <= 0 {
+		return errors.New("user id cant be equals or below zero")
+	}
+	if len(codeHashes) <= 0 {
+		return errors.New("recovery codes len cant be equals or below zero")
+	}
+	query := `
+	WITH old AS (
+		DELETE FROM recovery_codes WHERE user_id = $1
+	)
+	INSERT INTO recovery_codes(user_id, code_hash)
+	SELECT $1, code_hash
+	FROM unnest($2::BYTEA[]) AS code_hash
+	WHERE EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL)
+	`
+	ct, err := s.db.Exec(ctx, query, userId, codeHashes)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() <= 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetPermissions(ctx context.Context, userId int) (Permissions, error) {
+	if userId <= 0 {
+		return Permissions{}, errors.New("user id cant be equals or below zero")
+	}
+	query := `
+	SELECT DISTINCT rp.permission
+	FROM user_roles AS ur
+	JOIN role_permissions AS rp ON rp.role_id = ur.role_id
+	WHERE ur.user_id = $1
+	`
+	rows, _ := s.db.Query(ctx, query, userId)
+	granted, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return Permissions{}, err
+	}
+	permissions := Permissions{}
+	for _, permission := range granted {
+		permissions[Permission(permission)] = true
+	}
+	return permissions, nil
+}
+
+func (s *PostgresStore) GetRoles(ctx context.Context) ([]Role, error) {
+	query := `
+	SELECT r.name, r.description,
+		coalesce(array_agg(rp.permission ORDER BY rp.permission) FILTER (WHERE rp.permission IS NOT NULL), '{}')
+	FROM roles AS r
+	LEFT JOIN role_permissions AS rp ON rp.role_id = r.id
+	GROUP BY r.id
+	ORDER BY r.id
+	`
+	rows, _ := s.db.Query(ctx, query)
+	roles, err := pgx.CollectRows(rows, pgx.RowToStructByPos[Role])
+	if err != nil {
+		return []Role{}, err
+	}
+	return roles, nil
+}
+
+func (s *PostgresStore) GetStaff(ctx context.Context) ([]StaffMember, error) {
+	query := `
+	SELECT u.id, coalesce(u.name, ''), coalesce(u.email, ''), array_agg(r.name ORDER BY r.id)
+	FROM users AS u
+	JOIN user_roles AS ur ON ur.user_id = u.id
+	JOIN roles AS r ON r.id = ur.role_id
+	GROUP BY u.id
+	ORDER BY u.email
+	`
+	rows, _ := s.db.Query(ctx, query)
+	staff, err := pgx.CollectRows(rows, pgx.RowToStructByPos[StaffMember])
+	if err != nil {
+		return []StaffMember{}, err
+	}
+	return staff, nil
+}
+
+func (s *PostgresStore) GrantRole(ctx context.Context, email, role, actor string) error {
+	if len(email) <= 0 {
+		return errors.New("email len cant be equals or below zero")
+	}
+	if len(actor) <= 0 {
+		return errors.New("actor len cant be equals or below zero")
+	}
+	_, err := s.db.Exec(ctx, `SELECT grant_role($1, $2, $3)`, email, role, actor)
+	if err == nil {
+		return nil
+	}
+	switch {
+	case strings.Contains(err.Error(), "user for role not found"):
+		return ErrRoleUserNotFound
+	case strings.Contains(err.Error(), "role not found"):
+		return ErrRoleNotFound
+	}
+	return err
+}
+
+func (s *PostgresStore) SeedOwners(ctx context.Context, emails []string, actor string) (int, error) {
+	if len(actor) <= 0 {
+		return -1, errors.New("actor len cant be equals or below zero")
+	}
+	if len(emails) <= 0 {
+		return 0, nil
+	}
+	var seeded int
+	err := s.db.QueryRow(ctx, `SELECT seed_owners($1, $2)`, emails, actor).Scan(&seeded)
+	if err != nil {
+		return -1, err
+	}
+	return seeded, nil
+}
+
+func (s *PostgresStore) RevokeRole(ctx context.Context, userId int, role, actor string) error {
+	if userId <= 0 {
+		return errors.New("user id cant be equals or below zero")
+	}
+	if len(actor) <= 0 {
+		return errors.New("actor len cant be equals or below zero")
+	}
+	_, err := s.db.Exec(ctx, `SELECT revoke_role($1, $2, $3)`, userId, role, actor)
+	if err == nil {
+		return nil
+	}
+	switch {
+	case strings.Contains(err.Error(), "cant revoke the last owner"):
+		return ErrLastOwner
+	case strings.Contains(err.Error(), "user doesnt have the role"):
+		return ErrRoleNotGranted
+	case strings.Contains(err.Error(), "role not found"):
+		return ErrRoleNotFound
+	}
+	return err
+}
+
+func (s *PostgresStore) GetRoleEvents(ctx context.Context, limit int) ([]RoleEvent, error) {
+	if limit <= 0 {
+		return []RoleEvent{}, errors.New("limit cant be equals or below zero")
+	}
+	query := `
+	SELECT id, email, role, action, actor, created_at
+	FROM role_events
+	ORDER BY created_at DESC
+	LIMIT $1
+	`
+	rows, _ := s.db.Query(ctx, query, limit)
+	events, err := pgx.CollectRows(rows, pgx.RowToStructByPos[RoleEvent])
+	if err != nil {
+		return []RoleEvent{}, err
+	}
+	return events, nil
+}
+
+func (s *PostgresStore) CreateMagicLink(ctx context.Context, tokenHash []byte, email, ipAddress string, ttl time.Duration, limit LinkLimit) (int, error) {
+	if len(tokenHash) <= 0 {
+		return -1, errors.New("magic link token hash len cant be equals or below zero")
+	}
+	if len(email) <= 0 {
+		return -1, errors.New("magic link email len cant be equals or below zero")
+	}
+	if ttl <= 0 {
+		return -1, errors.New("magic link ttl cant be equals or below zero")
+	}
+	if limit.PerEmail <= 0 || limit.PerIP <= 0 || limit.Window <= 0 {
+		return -1, errors.New("magic link limits cant be equals or below zero")
+	}
+	query := `SELECT create_magic_link($1, $2, $3, $4, $5, $6, $7)`
+	var id int
+	err := s.db.QueryRow(ctx, query, tokenHash, email, ipAddress, int(ttl.Seconds()),
+		limit.PerEmail, limit.PerIP, int(limit.Window.Seconds())).Scan(&id)
+	if err != nil && strings.Contains(err.Error(), "too many magic links requested") {
+		return -1, ErrTooManyMagicLinks
+	}
+	if err != nil {
+		return -1, err
+	}
+	return id, nil
+}
+
+// ConsumeMagicLink marks a live link as used and returns its email, a link
+// that expired or was already used returns pgx.ErrNoRows.
+func (s *PostgresStore) ConsumeMagicLink(ctx context.Context, tokenHash []byte) (string, error) {
+	if len(tokenHash) <= 0 {
+		return "", errors.New("magic link token hash len cant be equals or below zero")
+	}
+	query := `
+	UPDATE magic_links
+	SET used_at = CURRENT_TIMESTAMP
+	WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+	RETURNING email
+	`
+	var email string
+	err := s.db.QueryRow(ctx, query, tokenHash).Scan(&email)
+	if err != nil {
+		return "", err
+	}
+	return email, nil
+}
+
+// PurgeMagicLinks keeps a day of links, enough to count them against any
+// rate limit window.
+func (s *PostgresStore) PurgeMagicLinks(ctx context.Context) (int64, error) {
+	query := `
+	DELETE FROM magic_links
+	WHERE created_at < CURRENT_TIMESTAMP - INTERVAL '1 day'
+	`
+	ct, err := s.db.Exec(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return ct.RowsAffected(), nil
+}
+
+func (s *PostgresStore) GetAddresses(ctx context.Context, userId int) ([]UserAddress, error) {
+	if userId <= 0 {
+		return []UserAddress{}, errors.New("user id cant be equals or below zero")
+	}
+	query := `
+	SELECT id, is_default, full_name, address_line_1, address_line_2,
+		admin_area_2, admin_area_1, postal_code, country_code, created_at
+	FROM addresses
+	WHERE user_id = $1
+	ORDER BY is_default DESC, created_at DESC
+	`
+	rows, _ := s.db.Query(ctx, query, userId)
+	addresses, err := pgx.CollectRows(rows, scanUserAddress)
+	if err != nil {
+		return []UserAddress{}, err
+	}
+	return addresses, nil
+}
+
+func (s *PostgresStore) GetAddress(ctx context.Context, userId, addressId int) (UserAddress, error) {
+	if userId <= 0 {
+		return UserAddress{}, errors.New("user id cant be equals or below zero")
+	}
+	if addressId <= 0 {
+		return UserAddress{}, errors.New("address id cant be equals or below zero")
+	}
+	query := `
+	SELECT id, is_default, full_name, address_line_1, address_line_2,
+		admin_area_2, admin_area_1, postal_code, country_code, created_at
+	FROM addresses
+	WHERE user_id = $1 AND id = $2
+	`
+	rows, _ := s.db.Query(ctx, query, userId, addressId)
+	address, err := pgx.CollectExactlyOneRow(rows, scanUserAddress)
+	if err != nil {
+		return UserAddress{}, err
+	}
+	return address, nil
+}
+
+func scanUserAddress(row pgx.CollectableRow) (UserAddress, error) {
+	var address UserAddress
+	err := row.Scan(
+		&address.Id,
+		&address.IsDefault,
+		&address.Address.FullName,
+		&address.Address.AddressLine1,
+		&address.Address.AddressLine2,
+		&address.Address.AdminArea2,
+		&address.Address.AdminArea1,
+		&address.Address.PostalCode,
+		&address.Address.CountryCode,
+		&address.CreatedAt,
+	)
+	return address, err
+}
+
+func (s *PostgresStore) SaveAddress(ctx context.Context, userId int, address Address, isDefault bool) (int, error) {
+	if userId <= 0 {
+		return -1, errors.New("user id cant be equals or below zero")
+	}
+	if err := address.Valid(); err != nil {
+		return -1, err
+	}
+	query := `
+	SELECT address_id FROM save_address($1, $2, $3)
+	`
+	var id int
+	err := s.db.QueryRow(ctx, query, userId, address, isDefault).Scan(&id)
+	if err != nil {
+		return -1, err
+	}
+	return id, nil
+}
+
+func (s *PostgresStore) DeleteAddress(ctx context.Context, userId, addressId int) error {
+	if userId <= 0 {
+		return errors.New("user id cant be equals or below zero")
+	}
+	if addressId <= 0 {
+		return errors.New("address id cant be equals or below zero")
+	}
+	query := `
+	SELECT FROM delete_address($1, $2)
+	`
+	_, err := s.db.Exec(ctx, query, userId, addressId)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetOrders(ctx context.Context, userId int) ([]OrderSummary, error) {
+	if userId <= 0 {
+		return []OrderSummary{}, errors.New("user id cant be equals or below zero")
+	}
+	query := `
+	SELECT id, order_id, COALESCE(user_id, 0), COALESCE(payer_name, ''), COALESCE(payer_email, ''),
+		total, currency, fulfillment_status, created_at
+	FROM orders
+	WHERE user_id = $1
+	ORDER BY created_at DESC
+	`
+	rows, _ := s.db.Query(ctx, query, userId)
+	orders, err := pgx.CollectRows(rows, pgx.RowToStructByPos[OrderSummary])
+	if err != nil {
+		return []OrderSummary{}, err
+	}
+	return orders, nil
+}
+
+func (s *PostgresStore) GetOpenOrders(ctx context.Context, limit int) ([]OrderSummary, error) {
+	if limit <= 0 {
+		return []OrderSummary{}, errors.New("limit cant be equals or below zero")
+	}
+	query := `
+	SELECT id, order_id, COALESCE(user_id, 0), COALESCE(payer_name, ''), COALESCE(payer_email, ''),
+		total, currency, fulfillment_status, created_at
+	FROM orders
+	WHERE fulfillment_status <> 'delivered'
+		AND COALESCE(status, 'PENDING') IN ('COMPLETED', 'PARTIALLY_REFUNDED')
+	ORDER BY created_at
+	LIMIT $1
+	`
+	rows, _ := s.db.Query(ctx, query, limit)
+	orders, err := pgx.CollectRows(rows, pgx.RowToStructByPos[OrderSummary])
+	if err != nil {
+		return []OrderSummary{}, err
+	}
+	return orders, nil
+}
+
+func (s *PostgresStore) GetOrder(ctx context.Context, id int) (OrderDetail, error) {
+	if id <= 0 {
+		return OrderDetail{}, errors.New("order id cant be equals or below zero")
+	}
+	var order OrderDetail
+	query := `
+	SELECT id, order_id, COALESCE(user_id, 0), COALESCE(payer_name, ''), COALESCE(payer_email, ''),
+		total, currency, fulfillment_status, created_at,
+		COALESCE(status, 'PENDING'), shipping_address, packed_at, shipped_at, delivered_at
+	FROM orders
+	WHERE id = $1
+	`
+	err := s.db.QueryRow(ctx, query, id).Scan(
+		&order.Id,
+		&order.OrderId,
+		&order.UserId,
+		&order.PayerName,
+		&order.PayerEmail,
+		&order.Total,
+		&order.Currency,
+		&order.Status,
+		&order.CreatedAt,
+		&order.PaymentStatus,
+		&order.ShippingAddress,
+		&order.PackedAt,
+		&order.ShippedAt,
+		&order.DeliveredAt,
+	)
+	if err != nil {
+		return OrderDetail{}, err
+	}
+	query = `
+	SELECT oi.id, oi.sku, COALESCE(MAX(products.name), oi.sku), oi.quantity,
+		COALESCE(SUM(si.quantity), 0)::INT, oi.line_total
+	FROM order_items AS oi
+	LEFT JOIN combinations ON combinations.sku = oi.sku
+	LEFT JOIN products ON products.id = combinations.product_id
+	LEFT JOIN shipment_items AS si ON si.order_item_id = oi.id
+	WHERE oi.order_id = $1
+	GROUP BY oi.id
+	ORDER BY oi.id
+	`
+	rows, _ := s.db.Query(ctx, query, id)
+	order.Lines, err = pgx.CollectRows(rows, pgx.RowToStructByPos[OrderLine])
+	if err != nil {
+		return OrderDetail{}, err
+	}
+	query = `
+	SELECT s.id, s.carrier, s.tracking_number,
+		COALESCE(array_agg(ROW(oi.sku, si.quantity)::items) FILTER (WHERE si.id IS NOT NULL), '{}'),
+		s.shipped_at, s.delivered_at
+	FROM shipments AS s
+	LEFT JOIN shipment_items AS si ON si.shipment_id = s.id
+	LEFT JOIN order_items AS oi ON oi.id = si.order_item_id
+	WHERE s.order_id = $1
+	GROUP BY s.id
+	ORDER BY s.shipped_at
+	`
+	rows, _ = s.db.Query(ctx, query, id)
+	order.Shipments, err = pgx.CollectRows(rows, pgx.RowToStructByPos[Shipment])
+	if err != nil {
+		return OrderDetail{}, err
+	}
+	query = `
+	SELECT id, from_status, to_status, from_fulfillment, to_fulfillment,
+		actor, reason, created_at
+	FROM order_events
+	WHERE order_id = $1
+	ORDER BY created_at, id
+	`
+	rows, _ = s.db.Query(ctx, query, id)
+	order.Events, err = pgx.CollectRows(rows, pgx.RowToStructByPos[OrderEvent])
+	if err != nil {
+		return OrderDetail{}, err
+	}
+	return order, nil
+}
+
+func (s *PostgresStore) orderState(ctx context.Context, id int) (OrderState, error) {
+	query := `
+	SELECT COALESCE(status, 'PENDING'), fulfillment_status
+	FROM orders
+	WHERE id = $1
+	`
+	var state OrderState
+	err := s.db.QueryRow(ctx, query, id).Scan(&state.Status, &state.Fulfillment)
+	if err != nil {
+		return OrderState{}, err
+	}
+	return state, nil
+}
+
+func (s *PostgresStore) TransitionOrder(ctx context.Context, id int, to OrderState, actor, reason string) error {
+	if id <= 0 {
+		return errors.New("order id cant be equals or below zero")
+	}
+	if len(actor) <= 0 {
+		return errors.New("actor len cant be equals or below zero")
+	}
+	from, err := s.orderState(ctx, id)
+	if err != nil {
+		return err
+	}
+	err = from.Transition(to)
+	if err != nil {
+		return err
+	}
+	query := `
+	SELECT FROM transition_order($1, $2, $3, $4, $5, $6, $7)
+	`
+	_, err = s.db.Exec(ctx, query, id, from.Status, from.Fulfillment, to.Status, to.Fulfillment, actor, reason)
+	if err != nil && strings.Contains(err.Error(), "illegal order transition") {
+		return ErrIllegalTransition
+	}
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) PackOrder(ctx context.Context, id int, actor string) error {
+	if id <= 0 {
+		return errors.New("order id cant be equals or below zero")
+	}
+	state, err := s.orderState(ctx, id)
+	if err != nil {
+		return err
+	}
+	return s.TransitionOrder(ctx, id, OrderState{Status: state.Status, Fulfillment: Packed}, actor, "order packed")
+}
+
+func (s *PostgresStore) CreateShipment(ctx context.Context, orderId int, actor, carrier, trackingNumber string, items []OrderItems) (int, error) {
+	if orderId <= 0 {
+		return -1, errors.New("order id cant be equals or below zero")
+	}
+	if len(actor) <= 0 {
+		return -1, errors.New("actor len cant be equals or below zero")
+	}
+	if len(carrier) <= 0 {
+		return -1, errors.New("carrier len cant be equals or below zero")
+	}
+	if len(trackingNumber) <= 0 {
+		return -1, errors.New("tracking number len cant be equals or below zero")
+	}
+	if len(items) <= 0 {
+		return -1, errors.New("len of items cant be zero or below")
+	}
+	state, err := s.orderState(ctx, orderId)
+	if err != nil {
+		return -1, err
+	}
+	// the db decides between partially shipped and shipped, both are reachable
+	// from the same states so checking one of them is enough.
+	err = state.Transition(OrderState{Status: state.Status, Fulfillment: PartiallyShipped})
+	if err != nil {
+		return -1, err
+	}
+	query := `
+	SELECT shipment_id FROM create_shipment($1, $2, $3, $4, $5)
+	`
+	var id int
+	err = s.db.QueryRow(ctx, query, orderId, carrier, trackingNumber, items, actor).Scan(&id)
+	if err != nil && strings.Contains(err.Error(), "illegal order transition") {
+		return -1, ErrIllegalTransition
+	}
+	if err != nil {
+		return -1, err
+	}
+	return id, nil
+}
+
+func (s *PostgresStore) DeliverShipment(ctx context.Context, orderId, shipmentId int, actor string) error {
+	if orderId <= 0 {
+		return errors.New("order id cant be equals or below zero")
+	}
+	if shipmentId <= 0 {
+		return errors.New("shipment id cant be equals or below zero")
+	}
+	if len(actor) <= 0 {
+		return errors.New("actor len cant be equals or below zero")
+	}
+	query := `
+	SELECT FROM deliver_shipment($1, $2, $3)
+	`
+	_, err := s.db.Exec(ctx, query, orderId, shipmentId, actor)
+	if err != nil && strings.Contains(err.Error(), "illegal order transition") {
+		return ErrIllegalTransition
+	}
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStore) RemoveProductFromCart(ctx context.Context, userId int, sku Sku) (count, error) {
+	if userId <= 0 {
+		return count{}, errors.New("user id cant be equals or below zero")
+	}
+	if len(sku) <= 0 {
+		return count{}, errors.New("sku len cant be equals or below zero")
+	}
+	query := `
+	SELECT cart_count_items, total_cart_balance FROM delete_product_from_cart($1,$2)
+	`
+	counter := count{}
+	err := s.db.QueryRow(ctx, query, userId, string(sku)).Scan(&counter.CartCount, &counter.CartBalance)
+	if err != nil {
+		return count{}, err
+	}
+	return counter, nil
+}
+
+func (s *PostgresStore) GetCart(ctx context.Context, userId int) ([]Items, error) {
+	if userId <= 0 {
+		return []Items{}, errors.New("user id cant be equals or below zero")
+	}
+	query := `
+	SELECT products.id, combinations.sku, cart_items.quantity, created_at,
+		products.name, products.description, products.short_description,
+		current_price(combinations), compare_at_price(combinations),
+		combinations.currency, products.images, combinations.options
+	FROM get_cart_items($1) AS cart_items
+	JOIN products ON products.id = cart_items.product_id
+	JOIN combinations ON combinations.sku = cart_items.sku
+	ORDER BY created_at DESC
+	`
+	rows, _ := s.db.Query(ctx, query, userId)
+	items, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Items, error) {
+		var item Items
+		var combination Combination
+		err := row.Scan(
+			&item.Id,
+			&combination.Sku,
+			&item.Quantity,
+			&item.CreatedAt,
+			&item.Name,
+			&item.Description,
+			&item.ShortDescription,
+			&combination.Price,
+			&combination.CompareAtPrice,
+			&combination.Currency,
+			&item.Images,
+			&combination.Options,
+		)
+		if err != nil {
+			return Items{}, err
+		}
+		item.Comb = combination
+		return item, nil
+	})
+	if err != nil {
+		return []Items{}, err
+	}
+	return items, nil
+}
+
+func (s *PostgresStore) EmptyingCart(ctx context.Context, userId int) error {
+	if userId <= 0 {
+		return errors.New("user id cant be zero or below")
+	}
+	query := `
+	SELECT FROM emptying_cart($1)
+	`
+	ct, err := s.db.Exec(ctx, query, userId)
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() <= 0 {
+		return errors.New("there were no rows deleted")
+	}
+	return nil
+}
+
+func (s *PostgresStore) MakeOrder(ctx context.Context, paymentProvider gateaways.PaymentProvider, userId int, cartItems []OrderItems, quote Quote, shipping Address, total float64, currency currency, orderId, payerName, payerEmail, payerId string, referenceIds, captureIds []string) (int, error) {
+	if err := paymentProvider.Valid(); err != nil {
+		return -1, err
+	}
+	if err := currency.Valid(); err != nil {
+		return -1, err
+	}
+	if len(cartItems) <= 0 {
+		return -1, errors.New("len of items cant be zero or below")
+	}
+	if len(payerId) <= 0 {
+		return -1, errors.New("len of payer id cant be zero or below")
+	}
+	if userId <= 0 {
+		return -1, errors.New("user id cant be zero or below")
+	}
+	if total <= 0 {
+		return -1, errors.New("total cant be zero or below")
+	}
+
+	if quote.ItemTotal <= 0 {
+		return -1, errors.New("item total cant be zero or below")
+	}
+
+	query := `
+	SELECT order_id FROM make_order($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)
+	`
+	var shippingAddress *Address
+	if !shipping.Empty() {
+		shippingAddress = &shipping
+	}
+	var shippingMethodId *int
+	if quote.ShippingMethodId > 0 {
+		shippingMethodId = &quote.ShippingMethodId
+	}
+	var id int
+	err := s.db.QueryRow(ctx, query, paymentProvider, userId, cartItems, quote.ItemTotal, quote.TotalDiscount(), quote.CouponCode, quote.Promotions,
+		shippingAddress, shippingMethodId, quote.ShippingMethod, quote.Shipping, quote.Tax, quote.TaxIncluded, total, currency, orderId, payerName, payerEmail, payerId, referenceIds, captureIds).Scan(&id)
+	if err != nil {
+		return -1, err
+	}
+	return id, nil
+}
+
+func (s *PostgresStore) TotalItems(ctx context.Context, items []OrderItems) (float64, error) {
+	if len(items) <= 0 {
+		return -1, errors.New("len of items cant be zero or below")
+	}
+	query := `
+	SELECT total_items_balance FROM total_items($1)
+	`
+	var total_items float64
+	err := s.db.QueryRow(ctx, query, items).Scan(&total_items)
+	if err != nil {
+		return -1, err
+	}
+	return total_items, nil
+}
+
+func (s *PostgresStore) QuoteItems(ctx context.Context, request QuoteRequest) (Quote, error) {
+	if len(request.Items) <= 0 {
+		return Quote{}, errors.New("len of items cant be zero or below")
+	}
+	if err := request.Currency.Valid(); err != nil {
+		return Quote{}, err
+	}
+	query := `
+	SELECT item_total, promotion_discount, promotions, discount,
+		free_shipping, shipping_total, COALESCE(shipping_method_id, 0), shipping_method,
+		shipping_error, tax_total, tax_included, tax_lines,
+		total, coupon_code, coupon_error
+	FROM quote_items($1, $2, $3, $4, $5, $6)
+	`
+	var address *Address
+	if !request.Address.Empty() {
+		address = &request.Address
+	}
+	quote := Quote{Currency: request.Currency}
+	err := s.db.QueryRow(ctx, query, request.Items, request.UserId, request.Currency, request.CouponCode, request.ShippingMethodId, address).Scan(
+		&quote.ItemTotal,
+		&quote.PromotionDiscount,
+		&quote.Promotions,
+		&quote.Discount,
+		&quote.FreeShipping,
+		&quote.Shipping,
+		&quote.ShippingMethodId,
+		&quote.ShippingMethod,
+		&quote.ShippingError,
+		&quote.Tax,
+		&quote.TaxIncluded,
+		&quote.TaxLines,
+		&quote.Total,
+		&quote.CouponCode,
+		&quote.CouponError,
+	)
+	if err != nil {
+		return Quote{}, err
+	}
+	return quote, nil
+}
+
+func (s *PostgresStore) ShippingOptions(ctx context.Context, items []OrderItems, currency currency, address Address) ([]ShippingOption, error) {
+	if len(items) <= 0 {
+		return []ShippingOption{}, errors.New("len of items cant be zero or below")
+	}
+	if err := currency.Valid(); err != nil {
+		return []ShippingOption{}, err
+	}
+	if len(address.CountryCode) <= 0 {
+		return []ShippingOption{}, errors.New("country code len cant be equals or below zero")
+	}
+	query := `
+	SELECT method_id, method_name, zone_name, rate, min_days, max_days
+	FROM shipping_options($1, $2, $3)
+	`
+	rows, _ := s.db.Query(ctx, query, items, currency, address)
+	options, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (ShippingOption, error) {
+		var option ShippingOption
+		err := row.Scan(
+			&option.MethodId,
+			&option.Name,
+			&option.Zone,
+			&option.Rate,
+			&option.MinDays,
+			&option.MaxDays,
+		)
+		return option, err
+	})
+	if err != nil {
+		return []ShippingOption{}, err
+	}
+	return options, nil
+}
+
+func (s *PostgresStore) LineTaxes(ctx context.Context, items []OrderItems, address Address) ([]LineTax, error) {
+	if len(items) <= 0 {
+		return []LineTax{}, errors.New("len of items cant be zero or below")
+	}
+	var taxAddress *Address
+	if !address.Empty() {
+		taxAddress = &address
+	}
+	query := `
+	SELECT sku, quantity, line_total, tax_name, tax_rate, tax_inclusive, tax_amount
+	FROM line_taxes($1, $2, 1)
+	`
+	rows, _ := s.db.Query(ctx, query, items, taxAddress)
+	lines, err := pgx.CollectRows(rows, pgx.RowToStructByPos[LineTax])
+	if err != nil {
+		return []LineTax{}, err
+	}
+	return lines, nil
+}
+
+func (s *PostgresStore) RestoreUser(ctx context.Context, user User) (User, error) {
+	validUid := user.Id > 0
+	validEmail := len(user.Email) > 0
+	if !validEmail && !validUid {
+		return User{}, errors.New("there is no valid user context values to restore user info")
+	}
+	query := `
+	SELECT out_user_id, name, email,
+		created_at, cart_id, favorites_id
+	FROM get_core_user_data($1,$2)`
+	err := s.db.QueryRow(ctx, query, user.Id, user.Email).
+		Scan(&user.Id, &user.Name, &user.Email, &user.CreatedAt, &user.CartId, &user.FavoritesId)
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (s *PostgresStore) NewUser(ctx context.Context, user User) (User, error) {
+	if len(user.Name) == 0 {
+		return User{}, errors.New("invalid length for username, cant set user to database")
+	}
+	if len(user.Email) == 0 {
+		return User{}, errors.New("invalid length for user email, cant set user to database")
+	}
+	query := `
+		SELECT user_id, out_created_at, cart_id, favorites_id
+		FROM create_user($1, $2)
+	`
+	err := s.db.QueryRow(ctx, query, user.Name, user.Email).
+		Scan(&user.Id, &user.CreatedAt, &user.CartId, &user.FavoritesId)
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+func (s *PostgresStore) GetUser(ctx context.Context, user User) (User, error) {
+	validUid := user.Id > 0
+	validEmail := len(user.Email) > 0
+	if !validEmail && !validUid {
+		return User{}, errors.New("there is no valid user context values to restore user info")
+	}
+	query := `
+	SELECT id, name, email, created_at
+	FROM users
+	WHERE id = $1 OR email = $2
+	LIMIT 1
+	`
+	err := s.db.QueryRow(ctx, query, user.Id, user.Email).
+		Scan(&user.Id, &user.Name, &user.Email, &user.CreatedAt)
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// DeleteUser removes the user with its email everywhere, its orders stay
+// without the personal data of the buyer.
+func (s *PostgresStore) DeleteUser(ctx context.Context, userId int) error {
+	if userId <= 0 {
+		return errors.New("user id cant be equals or below zero")
+	}
+	_, err := s.db.Exec(ctx, `SELECT delete_user($1)`, userId)
+	if err == nil {
+		return nil
+	}
+	switch {
+	case strings.Contains(err.Error(), "cant delete the last owner"):
+		return ErrDeleteLastOwner
+	case strings.Contains(err.Error(), "user to delete not found"):
+		return pgx.ErrNoRows
+	}
+	return err
+}
+
+func (s *PostgresStore) GetFavorites(ctx context.Context, userId int) ([]Favorite, error) {
+	if userId <= 0 {
+		return []Favorite{}, errors.New("user id cant be equals or below zero")
+	}
+	query := `
+	SELECT p.id, p.name,
+		COALESCE((SELECT c.sku FROM combinations AS c WHERE c.product_id = p.id ORDER BY c.sku LIMIT 1), '')
+	FROM favorites AS f
+	JOIN favorites_items AS fi ON fi.favorites_id = f.id
+	JOIN products AS p ON p.id = fi.product_id
+	WHERE f.user_id = $1
+	ORDER BY fi.id
+	`
+	rows, _ := s.db.Query(ctx, query, userId)
+	favorites, err := pgx.CollectRows(rows, pgx.RowToStructByPos[Favorite])
+	if err != nil {
+		return []Favorite{}, err
+	}
+	return favorites, nil
+}
+
+func (s *PostgresStore) UpdateProfile(ctx context.Context, userId int, profile Profile) error {
+	if userId <= 0 {
+		return errors.New("user id cant be equals or below zero")
+	}
+	if err := profile.Valid(); err != nil {
+		return err
+	}
+	query := `
+	UPDATE users
+	SET name = $2, avatar_url = NULLIF($3, ''), locale = $4, currency = $5
+	WHERE id = $1
+	`
+	ct, err := s.db.Exec(ctx, query, userId, strings.TrimSpace(profile.Name), profile.AvatarUrl, profile.Locale, string(profile.Currency))
+	if err != nil {
+		return err
+	}
+	if ct.RowsAffected() != 1 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// RequestEmailChange stores the link that moves the user to the email, it
+// returns ErrEmailInUse when another user has it.
+func (s *PostgresStore) RequestEmailChange(ctx context.Context, userId int, email string, tokenHash []byte, ttl time.Duration) error {
+	if userId <= 0 {
+		return errors.New("user id cant be equals or below zero")
+	}
+	if len(email) <= 0 {
+		return errors.New("email len cant be equals or below zero")
+	}
+	if len(tokenHash) <= 0 {
+		return errors.New("email change token hash len cant be equals or below zero")
+	}
+	if ttl <= 0 {
+		return errors.New("email change ttl cant be equals or below zero")
+	}
+	_, err := s.db.Exec(ctx, `SELECT request_email_change($1, $2, $3, $4)`, userId, email, tokenHash, int(ttl.Seconds()))
+	if err != nil && strings.Contains(err.Error(), "email already in use") {
+		return ErrEmailInUse
+	}
+	return err
+}
+
+// ConfirmEmailChange spends the link of the user and returns the old and the
+// new email, it returns pgx.ErrNoRows when the link is used, expired or of
+// someone else.
+func (s *PostgresStore) ConfirmEmailChange(ctx context.Context, userId int, tokenHash []byte) (string, string, error) {
+	if userId <= 0 {
+		return "", "", errors.New("user id cant be equals or below zero")
+	}
+	if len(tokenHash) <= 0 {
+		return "", "", errors.New("email change token hash len cant be equals or below zero")
+	}
+	var oldEmail, newEmail string
+	err := s.db.QueryRow(ctx, `SELECT old_email, new_email FROM confirm_email_change($1, $2)`, userId, tokenHash).
+		Scan(&oldEmail, &newEmail)
+	if err != nil && strings.Contains(err.Error(), "email already in use") {
+		return "", "", ErrEmailInUse
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return oldEmail, newEmail, nil
+}
+
+func (s *PostgresStore) PurgeEmailChanges(ctx context.Context) (int64, error) {
+	query := `
+	DELETE FROM email_changes
+	WHERE expires_at < CURRENT_TIMESTAMP - INTERVAL '1 day'
+	`
+	ct, err := s.db.Exec(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return ct.RowsAffected(), nil
+}
+
+// TakeRateToken spends a token of the bucket of the key, it returns how long
+// until the next one when the bucket is empty.
+func (s *PostgresStore) TakeRateToken(ctx context.Context, key string, perMinute, burst int) (time.Duration, error) {
+	if len(key) <= 0 {
+		return 0, errors.New("rate limit key len cant be equals or below zero")
+	}
+	if perMinute <= 0 {
+		return 0, errors.New("rate limit per minute cant be equals or below zero")
+	}
+	var seconds float64
+	err := s.db.QueryRow(ctx, `SELECT take_rate_token($1, $2, $3)`, key, perMinute, burst).Scan(&seconds)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// PurgeRateLimits forgets buckets unused for an hour, they refilled by then.
+func (s *PostgresStore) PurgeRateLimits(ctx context.Context) (int64, error) {
+	query := `
+	DELETE FROM rate_limits
+	WHERE updated_at < CURRENT_TIMESTAMP - INTERVAL '1 hour'
+	`
+	ct, err := s.db.Exec(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return ct.RowsAffected(), nil
+}
+
+func (s *PostgresStore) CreateOrder(ctx context.Context, items []OrderItems) error {
+	return nil
+}
+
+func (s *PostgresStore) Init() error {
+	if Pub != nil {
+		return fmt.Errorf("pub init function already called")
+	}
+	pool, err := s.NewStore()
+	if err != nil {
+		return err
 	}
 	s.db = pool
 	Pub = s
 	return err
 }
 
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	if s.db == nil {
+		return errors.New("pg pool is nil")
+	}
+	return s.db.Ping(ctx)
+}
+
 func (s *PostgresStore) Close() {
 	if s.db != nil {
 		s.db.Close()
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"context"
+	"regexp"
+	"shop/services/logs"
+	"shop/services/tracing"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const slowQuery = 500 * time.Millisecond
+
+type queryStartKey struct{}
+
+type queryStart struct {
+	sql string
+	at  time.Time
+}
+
+// queryLogger logs failed and slow queries with the request id of their
+// context.
+type queryLogger struct{}
+
+func (queryLogger) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, queryStartKey{}, queryStart{sql: data.SQL, at: time.Now()})
+}
+
+func (queryLogger) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	start, ok := ctx.Value(queryStartKey{}).(queryStart)
+	if !ok {
+		return
+	}
+	duration := time.Since(start.at)
+	sql := strings.Join(strings.Fields(start.sql), " ")
+	switch {
+	case data.Err != nil && data.Err != pgx.ErrNoRows:
+		logs.FromContext(ctx).Error("query failed", "err", data.Err, "sql", sql, "duration", duration)
+	case duration >= slowQuery:
+		logs.FromContext(ctx).Warn("slow query", "sql", sql, "duration", duration)
+	}
+}
+
+var querySubject = regexp.MustCompile(`(?i)\b(?:from|into|update|call)\s+([a-z_][a-z0-9_.]*)`)
+
+// querySpans opens a client span for every query, named after its verb and
+// the plpgsql function or table it hits.
+type querySpans struct{}
+
+func (querySpans) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	sql := strings.Join(strings.Fields(data.SQL), " ")
+	ctx, _ = tracing.Tracer.Start(ctx, querySpanName(sql),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBQueryText(sql),
+		))
+	return ctx
+}
+
+func (querySpans) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	span := trace.SpanFromContext(ctx)
+	if data.Err != nil && data.Err != pgx.ErrNoRows {
+		span.RecordError(data.Err)
+		span.SetStatus(codes.Error, data.Err.Error())
+	}
+	span.End()
+}
+
+func querySpanName(sql string) string {
+	verb, _, _ := strings.Cut(sql, " ")
+	verb = strings.ToUpper(verb)
+	if match := querySubject.FindStringSubmatch(sql); match != nil {
+		return verb + " " + match[1]
+	}
+	return verb
+}
@@ -2,6 +2,7 @@ package store_test
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -28,6 +29,9 @@ func variant() Variant {
 }
 
 func TestInsertProducts(t *testing.T) {
+	if testing.Short() {
+		t.Skip("needs a database")
+	}
 	poolConn, err := pg.GetPool()
 	if err != nil {
 		log.Fatalf("init failed for testing: %v \n", err)
@@ -289,6 +293,10 @@ func product(pp float64) Product {
 }
 
 func TestMain(m *testing.M) {
+	flag.Parse()
+	if testing.Short() {
+		os.Exit(m.Run())
+	}
 	defer pg.Close()
 	err := config.LoadEnv()
 	if err != nil {
@@ -0,0 +1,85 @@
+package totp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+func TestMatch(t *testing.T) {
+	key, err := NewKey("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+	code := func(at time.Time) string {
+		code, err := totp.GenerateCodeCustom(key.Secret(), at, totp.ValidateOpts{
+			Period:    period,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	step, ok := Match(key.Secret(), code(now), now)
+	if !ok || step != now.Unix()/period {
+		t.Errorf("Match(current code) = %d %v, want step %d", step, ok, now.Unix()/period)
+	}
+	if step, ok := Match(key.Secret(), code(now.Add(-period*time.Second)), now); !ok || step != now.Unix()/period-1 {
+		t.Errorf("Match(previous code) = %d %v, want the previous step", step, ok)
+	}
+	if _, ok := Match(key.Secret(), code(now.Add(-3*period*time.Second)), now); ok {
+		t.Error("Match passed a code three steps old")
+	}
+	for _, bad := range []string{"", "12345", "1234567", "abcdef"} {
+		if _, ok := Match(key.Secret(), bad, now); ok {
+			t.Errorf("Match(%q) passed", bad)
+		}
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes, err := RecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodes || len(hashes) != recoveryCodes {
+		t.Fatalf("got %d codes and %d hashes, want %d", len(codes), len(hashes), recoveryCodes)
+	}
+	seen := map[string]bool{}
+	for i, code := range codes {
+		if seen[code] {
+			t.Errorf("code %q repeated", code)
+		}
+		seen[code] = true
+		if !bytes.Equal(HashRecoveryCode(code), hashes[i]) {
+			t.Errorf("hash of %q doesnt match", code)
+		}
+	}
+	if !bytes.Equal(HashRecoveryCode("ABCD-efgh"), HashRecoveryCode(" abcd efgh")) {
+		t.Error("recovery codes hash differently by case, spaces or dashes")
+	}
+}
+
+func TestPendingKey(t *testing.T) {
+	key, err := NewKey("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := PendingKey("user@example.com", key.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Secret() != key.Secret() {
+		t.Errorf("PendingKey secret = %q, want %q", pending.Secret(), key.Secret())
+	}
+	if _, err := PendingKey("user@example.com", "not base32!"); err == nil {
+		t.Error("PendingKey took a secret that isnt base32")
+	}
+}